@@ -0,0 +1,59 @@
+package document
+
+// Represents the kind of error returned to a client
+const (
+	// The request could not be processed as sent
+	InvalidRequest = "invalid_request"
+	// The request is not allowed by the rules
+	Forbidden = "forbidden"
+	// The request value failed schema validation
+	ValidationFailed = "validation_failed"
+	// The database rejected or failed the request
+	DatabaseError = "database_error"
+	// The client fell behind and messages addressed to it were dropped
+	SlowConsumer = "slow_consumer"
+	// The request was cancelled by an administrator
+	Cancelled = "cancelled"
+	// The client sent requests faster than a rate limit allows, and may retry later
+	RateLimited = "rate_limited"
+	// The client holds as many watches as allowed
+	QuotaExceeded = "quota_exceeded"
+)
+
+// Describes why a single field of a document value is invalid
+type FieldError struct {
+
+	// The dotted path of the field
+	Field string `json:"field" bson:"field"`
+
+	// The human readable error message
+	Message string `json:"message" bson:"message"`
+}
+
+// Encapsulates an error returned to a client in place of a snapshot value
+type DocumentError struct {
+
+	// The kind of error
+	Code string `json:"code" bson:"code"`
+
+	// The human readable error message
+	Message string `json:"message" bson:"message"`
+
+	// The invalid fields (optional)
+	Fields []FieldError `json:"fields,omitempty" bson:"fields,omitempty"`
+
+	// The milliseconds to wait before retrying a rate limited request (optional)
+	RetryAfter int64 `json:"retryAfter,omitempty" bson:"retryAfter,omitempty"`
+}
+
+func (e *DocumentError) Error() string {
+	return e.Message
+}
+
+// Wraps an error into a document error with the specified code
+func NewDocumentError(code string, err error) *DocumentError {
+	if de, ok := err.(*DocumentError); ok {
+		return de
+	}
+	return &DocumentError{Code: code, Message: err.Error()}
+}
@@ -0,0 +1,119 @@
+package document
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// A document encoded as MongoDB Extended JSON (canonical or relaxed) on the wire, so typed values
+// such as {"$oid": ...}, {"$date": ...} and {"$numberDecimal": ...} round-trip as their bson types.
+type Document map[string]interface{}
+
+// UnmarshalJSON unmarshals an extended json document
+func (d *Document) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(bytes.TrimSpace(b), []byte("null")) {
+		*d = nil
+		return nil
+	}
+
+	m := map[string]interface{}{}
+	if err := bson.UnmarshalExtJSON(b, false, &m); err != nil {
+		return err
+	}
+	*d = m
+	return nil
+}
+
+// MarshalJSON marshals the document as relaxed extended json
+func (d Document) MarshalJSON() ([]byte, error) {
+	if d == nil {
+		return []byte("null"), nil
+	}
+	return bson.MarshalExtJSON(map[string]interface{}(d), false, false)
+}
+
+// MarshalBSONValue marshals the enum as a bson string
+func (operation DocumentOperation) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(operation.String())
+}
+
+// MarshalBSONValue marshals the enum as a bson string
+func (scope DocumentScope) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(scope.String())
+}
+
+// UnmarshalBSONValue unmarshals a bson string to the enum value
+func (operation *DocumentOperation) UnmarshalBSONValue(t bsontype.Type, b []byte) error {
+	name, ok := bson.RawValue{Type: t, Value: b}.StringValueOK()
+	if !ok {
+		return fmt.Errorf("expected a string, got %s", t)
+	}
+	id, ok := operationID[name]
+	if !ok {
+		return &EnumError{Field: "operation", Value: name}
+	}
+	*operation = id
+	return nil
+}
+
+// UnmarshalBSONValue unmarshals a bson string to the enum value
+func (scope *DocumentScope) UnmarshalBSONValue(t bsontype.Type, b []byte) error {
+	name, ok := bson.RawValue{Type: t, Value: b}.StringValueOK()
+	if !ok {
+		return fmt.Errorf("expected a string, got %s", t)
+	}
+	id, ok := scopeID[name]
+	if !ok {
+		return &EnumError{Field: "scope", Value: name}
+	}
+	*scope = id
+	return nil
+}
+
+// Marshals a response as extended json, either canonical (type preserving) or relaxed (readable)
+func MarshalResponse(response interface{}, canonical bool) ([]byte, error) {
+	return bson.MarshalExtJSON(response, canonical, false)
+}
+
+// Replaces {"$uuid": true} sentinels with generated uuids, leaving extended json uuids untouched
+func resolveUUIDs(b []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value, err := replaceUUIDs(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func replaceUUIDs(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if arg, ok := v[UUID].(bool); ok && arg && len(v) == 1 {
+			return uuid()
+		}
+		for k, child := range v {
+			resolved, err := replaceUUIDs(child)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = resolved
+		}
+	case []interface{}:
+		for i, child := range v {
+			resolved, err := replaceUUIDs(child)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,51 @@
+package document_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.springy.io/api/document"
+	"testing"
+)
+
+func TestExtendedJSON(t *testing.T) {
+
+	message := []byte(`{
+		"_uid": "1",
+		"collection": "users",
+		"query": {"_id": {"$in": ["5f8f8c44b54764421b7156c9", {"$oid": "5f8f8c44b54764421b7156ca"}]}},
+		"scope": "write",
+		"operation": "update",
+		"value": {"$set": {
+			"born": {"$date": "2020-01-01T00:00:00Z"},
+			"balance": {"$numberDecimal": "1.50"},
+			"ref": {"$uuid": true}
+		}}
+	}`)
+
+	request, err := document.DecodeRequest(message)
+	assert.Nil(t, err)
+
+	set := request.Value["$set"].(map[string]interface{})
+	assert.IsType(t, primitive.DateTime(0), set["born"])
+	assert.IsType(t, primitive.Decimal128{}, set["balance"])
+	assert.Len(t, set["ref"], 36)
+
+	ids := request.Filter()["_id"].(map[string]interface{})["$in"].(primitive.A)
+	assert.IsType(t, primitive.ObjectID{}, ids[0])
+	assert.IsType(t, primitive.ObjectID{}, ids[1])
+
+	// Queries do not resolve uuid sentinels
+	_, err = document.DecodeRequest([]byte(`{"_uid": "2", "collection": "users", "scope": "find", "query": {"_id": {"$uuid": true}}}`))
+	assert.NotNil(t, err)
+
+	response, err := document.MarshalResponse(bson.M{
+		"_uid":       request.Uid,
+		"_operation": request.Operation,
+		"value":      request.Value,
+	}, false)
+	assert.Nil(t, err)
+	assert.Contains(t, string(response), `"_operation":"update"`)
+	assert.Contains(t, string(response), `{"$numberDecimal":"1.50"}`)
+	assert.Contains(t, string(response), `{"$date":"2020-01-01T00:00:00Z"}`)
+}
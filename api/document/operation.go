@@ -43,12 +43,18 @@ func (operation DocumentOperation) MarshalJSON() ([]byte, error) {
 
 // UnmarshalJSON unmarshalls a quoted json string to the enum value
 func (operation *DocumentOperation) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
 	var j string
 	err := json.Unmarshal(b, &j)
 	if err != nil {
 		return err
 	}
-	// Note that if the string cannot be found then it will be set to the zero value, 'Insert' in this case.
-	*operation = operationID[j]
+	id, ok := operationID[j]
+	if !ok {
+		return &EnumError{Field: "operation", Value: j}
+	}
+	*operation = id
 	return nil
 }
@@ -0,0 +1,397 @@
+package document
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+)
+
+// Limits the shape of the query filters clients may send
+type QueryLimits struct {
+
+	// The maximum nesting depth of sub documents, arrays and logical operators
+	MaxDepth int
+
+	// The maximum number of clauses and operands in a filter
+	MaxClauses int
+}
+
+// The operators allowed inside a query filter
+var queryOperators = map[string]bool{
+	// Comparison
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true, "$in": true, "$nin": true,
+	// Logical
+	"$and": true, "$or": true, "$nor": true, "$not": true,
+	// Element
+	"$exists": true, "$type": true,
+	// Evaluation
+	"$regex": true, "$options": true, "$mod": true, "$text": true, "$search": true, "$language": true,
+	"$caseSensitive": true, "$diacriticSensitive": true,
+	// Array
+	"$all": true, "$elemMatch": true, "$size": true,
+	// Geospatial
+	"$geoWithin": true, "$geoIntersects": true, "$near": true, "$nearSphere": true, "$geometry": true,
+	"$box": true, "$center": true, "$centerSphere": true, "$polygon": true, "$maxDistance": true, "$minDistance": true,
+	// Misc
+	"$comment": true,
+}
+
+// The operators that execute server side JavaScript or arbitrary expressions
+var dangerousOperators = map[string]bool{
+	"$where":       true,
+	"$function":    true,
+	"$accumulator": true,
+	"$expr":        true,
+}
+
+// A query filter parsed into a tree of clauses
+type Query struct {
+	Clauses []*Clause
+}
+
+// A single clause of a query filter
+type Clause struct {
+
+	// The field the clause matches (empty for top level logical and text clauses)
+	Field string
+
+	// The operator of the clause ($eq for implicit equality)
+	Operator string
+
+	// True when the field is matched against a literal rather than an operator expression
+	Literal bool
+
+	// The operand of the clause (nil when the clause holds sub queries)
+	Value interface{}
+
+	// The sub queries of logical operators and $elemMatch
+	Queries []*Query
+
+	// The nested operator clauses of $not and operator expressions
+	Clauses []*Clause
+}
+
+// Describes why a query filter was rejected
+type QueryError struct {
+
+	// The dotted path of the rejected clause
+	Path string
+
+	// The human readable error message
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	if e.Path == "" {
+		return "invalid query: " + e.Message
+	}
+	return fmt.Sprintf("invalid query at '%s': %s", e.Path, e.Message)
+}
+
+// Builds the filter sent to the database from the parsed clauses, so that only what the parser
+// validated reaches the database.
+//
+// For compatibility plain hex strings matched against the _id field are converted to object ids.
+func (query *Query) Filter() bson.M {
+	filter := bson.M{}
+	for _, clause := range query.Clauses {
+		if clause.Field == "" {
+			filter[clause.Operator] = clause.operand()
+			continue
+		}
+		value := clause.match()
+		if clause.Field == "_id" {
+			value = objectID(value)
+		}
+		filter[clause.Field] = value
+	}
+	return filter
+}
+
+// Returns the value a field is matched against, either a literal or an operator expression
+func (clause *Clause) match() interface{} {
+	if clause.Literal {
+		return clause.Value
+	}
+	if clause.Operator == "$and" && clause.Clauses != nil {
+		// Several operators applied to the same field
+		return expressionOf(clause.Clauses)
+	}
+	return map[string]interface{}{clause.Operator: clause.operand()}
+}
+
+// Returns the operand of the clause operator
+func (clause *Clause) operand() interface{} {
+	switch clause.Operator {
+	case "$and", "$or", "$nor":
+		if clause.Field == "" {
+			filters := make(primitive.A, len(clause.Queries))
+			for i, query := range clause.Queries {
+				filters[i] = query.Filter()
+			}
+			return filters
+		}
+	case "$not":
+		if clause.Value == nil {
+			return expressionOf(clause.Clauses)
+		}
+	case "$elemMatch":
+		if len(clause.Queries) > 0 {
+			return clause.Queries[0].Filter()
+		}
+		return expressionOf(clause.Clauses)
+	}
+	return clause.Value
+}
+
+// Builds an operator expression such as {"$gt": 1, "$lt": 5}
+func expressionOf(clauses []*Clause) map[string]interface{} {
+	expr := make(map[string]interface{}, len(clauses))
+	for _, clause := range clauses {
+		expr[clause.Operator] = clause.operand()
+	}
+	return expr
+}
+
+// Parses and validates the query of the request
+func (request *DocumentRequest) ParseQuery(limits QueryLimits) (*Query, error) {
+	return ParseQuery(request.Query, limits)
+}
+
+// Parses a query filter into a tree of clauses, rejecting dangerous or unknown operators and
+// filters exceeding the limits
+func ParseQuery(filter map[string]interface{}, limits QueryLimits) (*Query, error) {
+	p := &parser{limits: limits}
+	return p.query("", filter, 1)
+}
+
+type parser struct {
+	limits  QueryLimits
+	clauses int
+}
+
+func (p *parser) count(path string) error {
+	p.clauses++
+	if p.limits.MaxClauses > 0 && p.clauses > p.limits.MaxClauses {
+		return &QueryError{Path: path, Message: fmt.Sprintf("exceeds the maximum of %d clauses", p.limits.MaxClauses)}
+	}
+	return nil
+}
+
+func (p *parser) depth(path string, depth int) error {
+	if p.limits.MaxDepth > 0 && depth > p.limits.MaxDepth {
+		return &QueryError{Path: path, Message: fmt.Sprintf("exceeds the maximum depth of %d", p.limits.MaxDepth)}
+	}
+	return nil
+}
+
+// Parses a filter document whose keys are field names or top level operators
+func (p *parser) query(path string, filter map[string]interface{}, depth int) (*Query, error) {
+	if err := p.depth(path, depth); err != nil {
+		return nil, err
+	}
+
+	query := &Query{}
+	for k, v := range filter {
+		if err := p.count(join(path, k)); err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(k, "$") {
+			clause, err := p.field(join(path, k), k, v, depth)
+			if err != nil {
+				return nil, err
+			}
+			query.Clauses = append(query.Clauses, clause)
+			continue
+		}
+
+		if err := operator(path, k); err != nil {
+			return nil, err
+		}
+
+		clause := &Clause{Operator: k}
+		switch k {
+		case "$and", "$or", "$nor":
+			filters, ok := array(v)
+			if !ok || len(filters) == 0 {
+				return nil, &QueryError{Path: join(path, k), Message: "must be a non-empty array"}
+			}
+			for i, f := range filters {
+				m, ok := f.(map[string]interface{})
+				if !ok {
+					return nil, &QueryError{Path: fmt.Sprintf("%s[%d]", join(path, k), i), Message: "must be a document"}
+				}
+				sub, err := p.query(fmt.Sprintf("%s[%d]", join(path, k), i), m, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				clause.Queries = append(clause.Queries, sub)
+			}
+		case "$text", "$comment":
+			if err := p.operand(join(path, k), v, depth+1); err != nil {
+				return nil, err
+			}
+			clause.Value = v
+		default:
+			return nil, &QueryError{Path: join(path, k), Message: "is not a top level operator"}
+		}
+		query.Clauses = append(query.Clauses, clause)
+	}
+	return query, nil
+}
+
+// Parses the value matched against a field, either a literal or an operator expression
+func (p *parser) field(path, field string, value interface{}, depth int) (*Clause, error) {
+	m, ok := value.(map[string]interface{})
+	if !ok || !expression(m) {
+		// Implicit equality
+		if err := p.operand(path, value, depth+1); err != nil {
+			return nil, err
+		}
+		return &Clause{Field: field, Operator: "$eq", Literal: true, Value: value}, nil
+	}
+
+	clauses, err := p.expression(path, m, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(clauses) == 1 {
+		clauses[0].Field = field
+		return clauses[0], nil
+	}
+	return &Clause{Field: field, Operator: "$and", Clauses: clauses}, nil
+}
+
+// Parses an operator expression such as {"$gt": 1, "$lt": 5}
+func (p *parser) expression(path string, expr map[string]interface{}, depth int) ([]*Clause, error) {
+	if err := p.depth(path, depth); err != nil {
+		return nil, err
+	}
+
+	var clauses []*Clause
+	for op, v := range expr {
+		if !strings.HasPrefix(op, "$") {
+			return nil, &QueryError{Path: path, Message: "cannot mix operators and fields"}
+		}
+		if err := operator(path, op); err != nil {
+			return nil, err
+		}
+		if err := p.count(join(path, op)); err != nil {
+			return nil, err
+		}
+
+		clause := &Clause{Operator: op}
+		switch op {
+		case "$not":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				// A regular expression
+				clause.Value = v
+				break
+			}
+			sub, err := p.expression(join(path, op), m, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			clause.Clauses = sub
+		case "$elemMatch":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, &QueryError{Path: join(path, op), Message: "must be a document"}
+			}
+			if expression(m) {
+				sub, err := p.expression(join(path, op), m, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				clause.Clauses = sub
+			} else {
+				sub, err := p.query(join(path, op), m, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				clause.Queries = append(clause.Queries, sub)
+			}
+		case "$in", "$nin", "$all":
+			if _, ok := array(v); !ok {
+				return nil, &QueryError{Path: join(path, op), Message: "must be an array"}
+			}
+			fallthrough
+		default:
+			if err := p.operand(join(path, op), v, depth+1); err != nil {
+				return nil, err
+			}
+			clause.Value = v
+		}
+		clauses = append(clauses, clause)
+	}
+	return clauses, nil
+}
+
+// Walks a literal operand, counting its values and rejecting embedded dangerous operators
+func (p *parser) operand(path string, value interface{}, depth int) error {
+	if values, ok := array(value); ok {
+		if err := p.depth(path, depth); err != nil {
+			return err
+		}
+		for i, v := range values {
+			if err := p.count(path); err != nil {
+				return err
+			}
+			if err := p.operand(fmt.Sprintf("%s[%d]", path, i), v, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		if err := p.depth(path, depth); err != nil {
+			return err
+		}
+		for k, v := range m {
+			if dangerousOperators[k] {
+				return &QueryError{Path: join(path, k), Message: fmt.Sprintf("operator '%s' is not allowed", k)}
+			}
+			if err := p.count(join(path, k)); err != nil {
+				return err
+			}
+			if err := p.operand(join(path, k), v, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns an error if the operator is dangerous or unknown
+func operator(path, op string) error {
+	if dangerousOperators[op] {
+		return &QueryError{Path: join(path, op), Message: fmt.Sprintf("operator '%s' is not allowed", op)}
+	}
+	if !queryOperators[op] {
+		return &QueryError{Path: join(path, op), Message: fmt.Sprintf("unknown operator '%s'", op)}
+	}
+	return nil
+}
+
+// Returns true if the document is an operator expression (any key is an operator)
+func expression(m map[string]interface{}) bool {
+	for k := range m {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func array(value interface{}) ([]interface{}, bool) {
+	switch a := value.(type) {
+	case []interface{}:
+		return a, true
+	case primitive.A:
+		return a, true
+	}
+	return nil, false
+}
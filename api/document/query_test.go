@@ -0,0 +1,77 @@
+package document_test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.springy.io/api/document"
+	"testing"
+)
+
+var limits = document.QueryLimits{MaxDepth: 4, MaxClauses: 16}
+
+func parse(t *testing.T, filter string) (*document.Query, error) {
+	var query document.Document
+	assert.Nil(t, json.Unmarshal([]byte(filter), &query))
+	return document.ParseQuery(query, limits)
+}
+
+func TestParseQuery(t *testing.T) {
+
+	query, err := parse(t, `{"name": "Foo", "age": {"$gte": 18, "$lt": 65}, "$or": [{"role": {"$in": ["admin"]}}, {"tags": {"$elemMatch": {"$eq": "x"}}}]}`)
+	assert.Nil(t, err)
+	assert.Len(t, query.Clauses, 3)
+
+	for _, clause := range query.Clauses {
+		switch clause.Field {
+		case "name":
+			assert.Equal(t, "$eq", clause.Operator)
+		case "age":
+			assert.Equal(t, "$and", clause.Operator)
+			assert.Len(t, clause.Clauses, 2)
+		case "":
+			assert.Equal(t, "$or", clause.Operator)
+			assert.Len(t, clause.Queries, 2)
+		}
+	}
+}
+
+func TestRejectQuery(t *testing.T) {
+
+	for _, filter := range []string{
+		`{"$where": "sleep(1000)"}`,
+		`{"name": {"$function": {"body": "return true", "args": [], "lang": "js"}}}`,
+		`{"$expr": {"$function": {}}}`,
+		`{"name": {"$foo": 1}}`,
+		`{"name": {"$eq": 1, "age": 2}}`,
+		`{"$and": {}}`,
+		`{"a": {"b": {"c": {"d": {"e": 1}}}}}`,
+		`{"a": {"$in": [1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16]}}`,
+		`{"name": "Foo", "meta": {"$where": "1"}}`,
+	} {
+		_, err := parse(t, filter)
+		assert.IsType(t, &document.QueryError{}, err, filter)
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+
+	for _, filter := range []string{
+		`{"name": "Foo", "age": {"$gte": 18, "$lt": 65}}`,
+		`{"$or": [{"role": {"$in": ["admin", "owner"]}}, {"tags": {"$elemMatch": {"$eq": "x"}}}]}`,
+		`{"meta": {"a": 1}, "name": {"$not": {"$regex": "^F"}}, "items": {"$elemMatch": {"qty": {"$gt": 1}}}}`,
+		`{"$text": {"$search": "foo"}, "tags": {"$size": 2}}`,
+	} {
+		query, err := parse(t, filter)
+		assert.Nil(t, err)
+		data, err := json.Marshal(query.Filter())
+		assert.Nil(t, err)
+		assert.JSONEq(t, filter, string(data), filter)
+	}
+
+	// Hex strings matched against _id are object ids
+	query, err := parse(t, `{"_id": {"$in": ["62f7c6e0a1b2c3d4e5f60718"]}}`)
+	assert.Nil(t, err)
+	ids := query.Filter()["_id"].(map[string]interface{})["$in"].(primitive.A)
+	assert.IsType(t, primitive.ObjectID{}, ids[0])
+}
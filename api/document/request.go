@@ -1,8 +1,15 @@
 package document
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 // Encapsulates a basic pub/sub request sent from a client
@@ -14,8 +21,11 @@ type DocumentRequest struct {
 	// The database collection name
 	Collection string `json:"collection"`
 
+	// The channel (room) name of presence and ephemeral pub/sub requests
+	Channel string `json:"channel"`
+
 	// The key of a document inside the collection (optional)
-	Query map[string]interface{} `json:"query"`
+	Query Document `json:"query"`
 
 	// The scope of work to perform
 	Scope DocumentScope `json:"scope"`
@@ -24,24 +34,197 @@ type DocumentRequest struct {
 	Operation DocumentOperation `json:"operation"`
 
 	// The document value (optional)
-	Value map[string]interface{} `json:"value"`
+	Value Document `json:"value"`
 
 	// Flag indicating if request should be processed on disconnect
 	OnDisconnect bool `json:"onDisconnect"`
+
+	// The W3C trace context the request is traced under (optional)
+	Traceparent string `json:"_traceparent"`
+}
+
+// EnumError is returned when decoding an unknown scope or operation name
+type EnumError struct {
+
+	// The field holding the enum
+	Field string
+
+	// The unknown name
+	Value string
+}
+
+func (e *EnumError) Error() string {
+	return fmt.Sprintf("unknown %s '%s'", e.Field, e.Value)
+}
+
+// The json names of the request fields
+var requestFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(DocumentRequest{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = true
+	}
+	return fields
+}()
+
+// Strictly decodes a json request. Unknown fields, unknown scope or operation names and missing
+// required fields are returned as an invalid request *DocumentError listing the fields. The
+// request uid is decoded whenever possible so the error can be routed back to the client.
+func DecodeRequest(data []byte) (DocumentRequest, error) {
+	var request DocumentRequest
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return request, &DocumentError{Code: InvalidRequest, Message: "request is not a json object: " + err.Error()}
+	}
+	json.Unmarshal(raw["_uid"], &request.Uid)
+
+	var fields []FieldError
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !requestFields[k] {
+			fields = append(fields, FieldError{Field: k, Message: "unknown field"})
+		}
+	}
+
+	present := func(k string) bool {
+		v, ok := raw[k]
+		return ok && string(v) != "null" && string(v) != `""`
+	}
+	enum := func(k string, v json.Unmarshaler) bool {
+		if !present(k) {
+			return false
+		}
+		err := v.UnmarshalJSON(raw[k])
+		if err != nil {
+			var enumError *EnumError
+			if errors.As(err, &enumError) {
+				fields = append(fields, FieldError{Field: k, Message: fmt.Sprintf("unknown value '%s'", enumError.Value)})
+			} else {
+				fields = append(fields, FieldError{Field: k, Message: "must be a string"})
+			}
+		}
+		return err == nil
+	}
+	scoped := enum("scope", &request.Scope)
+	enum("operation", &request.Operation)
+
+	if !present("scope") {
+		fields = append(fields, FieldError{Field: "scope", Message: "is required"})
+	} else if scoped {
+		switch request.Scope {
+		case Find, FindOne, Watch:
+			if !present("collection") {
+				fields = append(fields, FieldError{Field: "collection", Message: "is required"})
+			}
+		case Unwatch:
+			// Cancels the watch opened under the uid
+			if !present("_uid") {
+				fields = append(fields, FieldError{Field: "_uid", Message: "is required"})
+			}
+		case Write:
+			if !present("collection") {
+				fields = append(fields, FieldError{Field: "collection", Message: "is required"})
+			}
+			if !present("operation") {
+				fields = append(fields, FieldError{Field: "operation", Message: "is required"})
+			}
+		default:
+			if !present("channel") {
+				fields = append(fields, FieldError{Field: "channel", Message: "is required"})
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		return request, &DocumentError{Code: InvalidRequest, Message: "invalid request", Fields: fields}
+	}
+
+	// The $uuid sentinel collides with the extended json $uuid binary, so it is resolved up front.
+	// Only values resolve sentinels, in queries it is rejected as an invalid uuid binary.
+	if value, ok := raw["value"]; ok && bytes.Contains(value, []byte(UUID)) {
+		resolved, err := resolveUUIDs(value)
+		if err != nil {
+			return request, &DocumentError{Code: InvalidRequest, Message: "invalid request", Fields: []FieldError{{Field: "value", Message: err.Error()}}}
+		}
+		raw["value"] = resolved
+		data, _ = json.Marshal(raw)
+	}
+
+	uid := request.Uid
+	if err := json.Unmarshal(data, &request); err != nil {
+		request.Uid = uid
+		return request, &DocumentError{Code: InvalidRequest, Message: err.Error()}
+	}
+	return request, nil
+}
+
+// Returns the attributes identifying the request in log lines
+func (request *DocumentRequest) LogAttrs() []any {
+	attrs := []any{"uid", request.Uid, "scope", request.Scope.String()}
+	if request.Collection != "" {
+		attrs = append(attrs, "collection", request.Collection)
+	}
+	if request.Channel != "" {
+		attrs = append(attrs, "channel", request.Channel)
+	}
+	if request.Scope == Write || request.Scope == Watch {
+		attrs = append(attrs, "operation", request.Operation.String())
+	}
+	return attrs
 }
 
-// Builds a document filter based on the query passed into the request
+// Builds a document filter based on the query passed into the request.
+//
+// Typed values arrive as extended json, but for compatibility plain hex strings matched against
+// the _id field are still converted to object ids.
 func (request *DocumentRequest) Filter() bson.M {
 
 	var filters = bson.M{}
 	for k, v := range request.Query {
 		switch k {
 		case "_id":
-			docID, _ := primitive.ObjectIDFromHex(v.(string))
-			filters[k] = docID
+			filters[k] = objectID(v)
 		default:
 			filters[k] = v
 		}
 	}
 	return filters
 }
+
+// Converts hex strings (including inside comparison operators) to object ids
+func objectID(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if id, err := primitive.ObjectIDFromHex(v); err == nil {
+			return id
+		}
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for op, arg := range v {
+			switch op {
+			case "$eq", "$ne":
+				converted[op] = objectID(arg)
+			case "$in", "$nin":
+				if values, ok := arg.(primitive.A); ok {
+					ids := make(primitive.A, len(values))
+					for i, value := range values {
+						ids[i] = objectID(value)
+					}
+					converted[op] = ids
+					continue
+				}
+				converted[op] = arg
+			default:
+				converted[op] = arg
+			}
+		}
+		return converted
+	}
+	return value
+}
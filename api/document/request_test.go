@@ -0,0 +1,69 @@
+package document_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/api/document"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+
+	request, err := document.DecodeRequest([]byte(`{"_uid":"1","collection":"users","scope":"write","operation":"delete","query":{"name":"Foo"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, document.Write, request.Scope)
+	assert.Equal(t, document.Delete, request.Operation)
+	assert.Equal(t, "Foo", request.Query["name"])
+
+	// Null operations are absent
+	request, err = document.DecodeRequest([]byte(`{"_uid":"2","collection":"users","scope":"find","operation":null}`))
+	assert.Nil(t, err)
+	assert.Equal(t, document.Find, request.Scope)
+
+	// Channel requests do not need a collection
+	_, err = document.DecodeRequest([]byte(`{"_uid":"3","channel":"lobby","scope":"join"}`))
+	assert.Nil(t, err)
+
+	// Unwatching only needs the uid of the watch
+	request, err = document.DecodeRequest([]byte(`{"_uid":"4","scope":"unwatch"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, document.Unwatch, request.Scope)
+}
+
+func TestDecodeInvalidRequest(t *testing.T) {
+
+	fields := func(data string) (string, []document.FieldError) {
+		request, err := document.DecodeRequest([]byte(data))
+		assert.NotNil(t, err)
+		de := err.(*document.DocumentError)
+		assert.Equal(t, document.InvalidRequest, de.Code)
+		return request.Uid, de.Fields
+	}
+
+	uid, errors := fields(`{"_uid":"1","collection":"users","scope":"write","operation":"delte"}`)
+	assert.Equal(t, "1", uid)
+	assert.Equal(t, []document.FieldError{{Field: "operation", Message: "unknown value 'delte'"}}, errors)
+
+	_, errors = fields(`{"_uid":"1","collection":"users","scope":"fnd","colour":"red"}`)
+	assert.Equal(t, []document.FieldError{
+		{Field: "colour", Message: "unknown field"},
+		{Field: "scope", Message: "unknown value 'fnd'"},
+	}, errors)
+
+	_, errors = fields(`{"_uid":"1"}`)
+	assert.Equal(t, []document.FieldError{{Field: "scope", Message: "is required"}}, errors)
+
+	_, errors = fields(`{"_uid":"1","scope":"write"}`)
+	assert.Equal(t, []document.FieldError{
+		{Field: "collection", Message: "is required"},
+		{Field: "operation", Message: "is required"},
+	}, errors)
+
+	_, errors = fields(`{"_uid":"1","scope":"publish","collection":"users"}`)
+	assert.Equal(t, []document.FieldError{{Field: "channel", Message: "is required"}}, errors)
+
+	_, errors = fields(`{"scope":"unwatch"}`)
+	assert.Equal(t, []document.FieldError{{Field: "_uid", Message: "is required"}}, errors)
+
+	_, err := document.DecodeRequest([]byte(`[1]`))
+	assert.NotNil(t, err)
+}
@@ -16,6 +16,18 @@ const (
 	Write
 	// Subscribe Request
 	Watch
+	// Presence Join Request
+	Join
+	// Presence Leave Request
+	Leave
+	// Ephemeral Channel Subscribe Request
+	Subscribe
+	// Ephemeral Channel Unsubscribe Request
+	Unsubscribe
+	// Ephemeral Channel Publish Request
+	Publish
+	// Watch Cancel Request
+	Unwatch
 )
 
 func (scope DocumentScope) String() string {
@@ -27,6 +39,14 @@ var scopeValue = map[DocumentScope]string{
 	FindOne: "findOne",
 	Write:   "write",
 	Watch:   "watch",
+	Join:    "join",
+	Leave:   "leave",
+
+	Subscribe:   "subscribe",
+	Unsubscribe: "unsubscribe",
+	Publish:     "publish",
+
+	Unwatch: "unwatch",
 }
 
 var scopeID = map[string]DocumentScope{
@@ -34,6 +54,14 @@ var scopeID = map[string]DocumentScope{
 	"findOne": FindOne,
 	"write":   Write,
 	"watch":   Watch,
+	"join":    Join,
+	"leave":   Leave,
+
+	"subscribe":   Subscribe,
+	"unsubscribe": Unsubscribe,
+	"publish":     Publish,
+
+	"unwatch": Unwatch,
 }
 
 // MarshalJSON marshals the enum as a quoted json string
@@ -46,11 +74,18 @@ func (scope DocumentScope) MarshalJSON() ([]byte, error) {
 
 // UnmarshalJSON unmashals a quoted json string to the enum value
 func (scope *DocumentScope) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
 	var j string
 	err := json.Unmarshal(b, &j)
 	if err != nil {
 		return err
 	}
-	*scope = scopeID[j]
+	id, ok := scopeID[j]
+	if !ok {
+		return &EnumError{Field: "scope", Value: j}
+	}
+	*scope = id
 	return nil
 }
@@ -0,0 +1,217 @@
+package document
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sentinel keys a client can place in a document value to have the server generate the field value
+const (
+	// Resolves to the server time of the write, e.g. {"$serverTimestamp": true}
+	ServerTimestamp = "$serverTimestamp"
+	// Increments a numeric field by the given amount, e.g. {"$increment": 1}
+	Increment = "$increment"
+	// Resolves to a random (version 4) UUID string, e.g. {"$uuid": true}. Unlike the extended json
+	// {"$uuid": "<hex>"} binary, the sentinel is resolved while the request value is decoded.
+	UUID = "$uuid"
+)
+
+// Principal is implemented by request senders that carry an authenticated identity
+type Principal interface {
+	Principal() string
+}
+
+// Resolves all server generated field values inside the request value before the write.
+// Inserts and replacements resolve increments to their starting value, while updates move
+// incremented fields into an $inc operator.
+func (request *DocumentRequest) ResolveSentinels(now time.Time) error {
+	if request.Value == nil {
+		return nil
+	}
+
+	if request.Operation != Update {
+		_, err := resolve(request.Value, "", now, nil)
+		return err
+	}
+
+	increments := map[string]interface{}{}
+	for k, v := range request.Value {
+		m, ok := v.(map[string]interface{})
+		if !ok || !strings.HasPrefix(k, "$") {
+			continue
+		}
+		if _, err := resolve(m, "", now, increments); err != nil {
+			return err
+		}
+		if len(m) == 0 {
+			delete(request.Value, k)
+		}
+	}
+
+	if len(increments) > 0 {
+		inc, _ := request.Value["$inc"].(map[string]interface{})
+		if inc == nil {
+			inc = map[string]interface{}{}
+		}
+		for k, v := range increments {
+			inc[k] = v
+		}
+		request.Value["$inc"] = inc
+	}
+	return nil
+}
+
+// Stamps the created and updated timestamp fields and the author field of the request value.
+// Empty field names are skipped. The stamped fields sent by the client are removed first, so the
+// author is removed (or unset by updates) when the principal is empty. Replacements drop the
+// created field, which the caller preserves from the replaced document.
+func (request *DocumentRequest) Stamp(created, updated, author, principal string, now time.Time) {
+	if request.Value == nil {
+		request.Value = map[string]interface{}{}
+	}
+
+	var stamped []string
+	for _, field := range []string{created, updated, author} {
+		if field != "" {
+			stamped = append(stamped, field)
+		}
+	}
+	fields := map[string]interface{}{}
+	if updated != "" {
+		fields[updated] = now
+	}
+	if author != "" && principal != "" {
+		fields[author] = principal
+	}
+
+	switch request.Operation {
+	case Insert, Replace:
+		for _, field := range stamped {
+			delete(request.Value, field)
+		}
+		if created != "" && request.Operation == Insert {
+			fields[created] = now
+		}
+		for k, v := range fields {
+			request.Value[k] = v
+		}
+	case Update:
+		// Updates are never upserts, the created field is left as is
+		for op, v := range request.Value {
+			m, ok := v.(map[string]interface{})
+			if !ok || !strings.HasPrefix(op, "$") {
+				continue
+			}
+			for path := range m {
+				for _, field := range stamped {
+					if path == field || strings.HasPrefix(path, field+".") {
+						delete(m, path)
+					}
+				}
+			}
+			if len(m) == 0 {
+				delete(request.Value, op)
+			}
+		}
+
+		set, _ := request.Value["$set"].(map[string]interface{})
+		if set == nil {
+			set = map[string]interface{}{}
+		}
+		for k, v := range fields {
+			set[k] = v
+		}
+		if len(set) > 0 {
+			request.Value["$set"] = set
+		}
+		if author != "" && principal == "" {
+			unset, _ := request.Value["$unset"].(map[string]interface{})
+			if unset == nil {
+				unset = map[string]interface{}{}
+			}
+			unset[author] = ""
+			request.Value["$unset"] = unset
+		}
+	}
+}
+
+// Walks the value replacing sentinels in place. When increments is non-nil, incremented fields
+// are removed from the value and collected by their dotted path instead.
+func resolve(value map[string]interface{}, path string, now time.Time, increments map[string]interface{}) (interface{}, error) {
+
+	if key, arg, ok := sentinel(value); ok {
+		switch key {
+		case ServerTimestamp:
+			return now, nil
+		case UUID:
+			if arg != true {
+				return nil, fmt.Errorf("%s at '%s' must be true", UUID, path)
+			}
+			return uuid()
+		case Increment:
+			switch arg.(type) {
+			case float64, float32, int, int32, int64:
+			default:
+				return nil, fmt.Errorf("%s at '%s' must be a number", Increment, path)
+			}
+			if increments != nil {
+				increments[path] = arg
+				return nil, nil
+			}
+			return arg, nil
+		}
+	}
+
+	for k, v := range value {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		size := len(m)
+		resolved, err := resolve(m, join(path, k), now, increments)
+		if err != nil {
+			return nil, err
+		}
+		if resolved == nil || (size > 0 && len(m) == 0) {
+			// Drop incremented fields and any documents they leave empty
+			delete(value, k)
+		} else if _, ok := resolved.(map[string]interface{}); !ok {
+			value[k] = resolved
+		}
+	}
+	return value, nil
+}
+
+// Returns the sentinel key and argument if the value is a sentinel
+func sentinel(value map[string]interface{}) (string, interface{}, bool) {
+	if len(value) != 1 {
+		return "", nil, false
+	}
+	for k, v := range value {
+		switch k {
+		case ServerTimestamp, Increment, UUID:
+			return k, v, true
+		}
+	}
+	return "", nil, false
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Generates a random (version 4) UUID string
+func uuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
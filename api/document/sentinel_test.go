@@ -0,0 +1,102 @@
+package document_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/api/document"
+	"testing"
+	"time"
+)
+
+func TestResolveSentinels(t *testing.T) {
+
+	now := time.Now()
+	request := document.DocumentRequest{
+		Operation: document.Insert,
+		Value: map[string]interface{}{
+			"name":      "Foo",
+			"createdAt": map[string]interface{}{"$serverTimestamp": true},
+			"ref":       map[string]interface{}{"$uuid": true},
+			"stats": map[string]interface{}{
+				"views": map[string]interface{}{"$increment": float64(1)},
+			},
+		},
+	}
+
+	assert.Nil(t, request.ResolveSentinels(now))
+	assert.Equal(t, "Foo", request.Value["name"])
+	assert.Equal(t, now, request.Value["createdAt"])
+	assert.Len(t, request.Value["ref"], 36)
+	assert.Equal(t, float64(1), request.Value["stats"].(map[string]interface{})["views"])
+
+	// Only true sentinels generate values
+	request.Value = map[string]interface{}{"ref": map[string]interface{}{"$uuid": false}}
+	assert.NotNil(t, request.ResolveSentinels(now))
+}
+
+func TestResolveUpdateSentinels(t *testing.T) {
+
+	now := time.Now()
+	request := document.DocumentRequest{
+		Operation: document.Update,
+		Value: map[string]interface{}{
+			"$set": map[string]interface{}{
+				"name":     "Bar",
+				"editedAt": map[string]interface{}{"$serverTimestamp": true},
+				"stats": map[string]interface{}{
+					"views": map[string]interface{}{"$increment": float64(2)},
+				},
+			},
+		},
+	}
+
+	assert.Nil(t, request.ResolveSentinels(now))
+	set := request.Value["$set"].(map[string]interface{})
+	assert.Equal(t, now, set["editedAt"])
+	assert.NotContains(t, set, "stats")
+	assert.Equal(t, float64(2), request.Value["$inc"].(map[string]interface{})["stats.views"])
+
+	request.Value = map[string]interface{}{
+		"$set": map[string]interface{}{
+			"count": map[string]interface{}{"$increment": "one"},
+		},
+	}
+	assert.NotNil(t, request.ResolveSentinels(now))
+}
+
+func TestStamp(t *testing.T) {
+
+	now := time.Now()
+	request := document.DocumentRequest{
+		Operation: document.Update,
+		Value: map[string]interface{}{
+			"$set":   map[string]interface{}{"createdAt": now, "author.name": "admin"},
+			"$unset": map[string]interface{}{"updatedAt": ""},
+			"$inc":   map[string]interface{}{"count": 1},
+		},
+	}
+
+	// Updates drop the stamped fields sent by the client, and never stamp the created field
+	request.Stamp("createdAt", "updatedAt", "author", "alice", now)
+	assert.Equal(t, map[string]interface{}{
+		"$set": map[string]interface{}{"updatedAt": now, "author": "alice"},
+		"$inc": map[string]interface{}{"count": 1},
+	}, map[string]interface{}(request.Value))
+
+	request = document.DocumentRequest{Operation: document.Update, Value: map[string]interface{}{
+		"$set": map[string]interface{}{"author": "admin"},
+	}}
+	request.Stamp("createdAt", "updatedAt", "author", "", now)
+	assert.Equal(t, map[string]interface{}{"updatedAt": now}, request.Value["$set"])
+	assert.Equal(t, map[string]interface{}{"author": ""}, request.Value["$unset"])
+
+	// Inserts stamp every field, anonymous writers leaving no author
+	request = document.DocumentRequest{Operation: document.Insert, Value: map[string]interface{}{"author": "admin", "createdAt": "yesterday"}}
+	request.Stamp("createdAt", "updatedAt", "author", "", now)
+	assert.Equal(t, now, request.Value["createdAt"])
+	assert.NotContains(t, request.Value, "author")
+
+	// Replacements drop the created field, preserved from the replaced document by the caller
+	request = document.DocumentRequest{Operation: document.Replace, Value: map[string]interface{}{"createdAt": "yesterday", "name": "Foo"}}
+	request.Stamp("createdAt", "updatedAt", "author", "alice", now)
+	assert.Equal(t, map[string]interface{}{"name": "Foo", "updatedAt": now, "author": "alice"}, map[string]interface{}(request.Value))
+}
@@ -5,4 +5,7 @@ type DocumentSnapshot struct {
 
 	// The document value (optional)
 	Value map[string]interface{}
+
+	// The W3C trace context of the request the snapshot answers (optional)
+	Traceparent string
 }
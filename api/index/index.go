@@ -0,0 +1,227 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// A single indexed field
+type Key struct {
+
+	// The field name
+	Field string `json:"field"`
+
+	// The sort order (1 or -1) or index type ("text", "2dsphere", "hashed")
+	Order interface{} `json:"order"`
+}
+
+// Declares an index on a collection
+type Spec struct {
+
+	// The index name (defaults to the generated mongo name, e.g. "email_1")
+	Name string `json:"name,omitempty"`
+
+	// The indexed fields in order
+	Keys []Key `json:"keys"`
+
+	// Flag indicating if the index enforces unique values
+	Unique bool `json:"unique,omitempty"`
+
+	// The number of seconds after which documents expire (TTL indexes only)
+	ExpireAfterSeconds *int32 `json:"expireAfterSeconds,omitempty"`
+
+	// Restricts the index to the documents matching the filter (optional)
+	PartialFilter map[string]interface{} `json:"partialFilter,omitempty"`
+
+	// The relative weights of the text fields, which default to 1 (text indexes only)
+	Weights map[string]int32 `json:"weights,omitempty"`
+}
+
+// Loads the index specs of every collection from a json file keyed by collection name
+func Load(file string) (map[string][]Spec, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var specs map[string][]Spec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for collection, list := range specs {
+		for _, spec := range list {
+			if err := spec.Validate(); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", file, collection, err)
+			}
+		}
+	}
+	return specs, nil
+}
+
+// Returns an error if the spec cannot be created
+func (s Spec) Validate() error {
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("index '%s' has no keys", s.Name)
+	}
+	for _, k := range s.Keys {
+		if k.Field == "" {
+			return fmt.Errorf("index '%s' has a key without a field", s.Name)
+		}
+		switch o := k.Order.(type) {
+		case float64:
+			if o != 1 && o != -1 {
+				return fmt.Errorf("index '%s' has an invalid order %v for '%s'", s.Name, o, k.Field)
+			}
+		case string:
+			switch o {
+			case "text", "2d", "2dsphere", "hashed":
+			default:
+				return fmt.Errorf("index '%s' has an invalid type '%s' for '%s'", s.Name, o, k.Field)
+			}
+		default:
+			return fmt.Errorf("index '%s' has an invalid order for '%s'", s.Name, k.Field)
+		}
+	}
+	text := s.textWeights()
+	for field, weight := range s.Weights {
+		if _, ok := text[field]; !ok {
+			return fmt.Errorf("index '%s' has a weight for '%s' which is not a text field", s.Name, field)
+		}
+		if weight < 1 || weight > 99999 {
+			return fmt.Errorf("index '%s' has an invalid weight %d for '%s'", s.Name, weight, field)
+		}
+	}
+	return nil
+}
+
+// Returns the name of the index, generating the default mongo name if none was declared
+func (s Spec) IndexName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	parts := make([]string, 0, len(s.Keys)*2)
+	for _, k := range s.Keys {
+		parts = append(parts, k.Field, fmt.Sprint(k.Order))
+	}
+	return strings.Join(parts, "_")
+}
+
+// Returns the ordered key document of the index
+func (s Spec) KeyDocument() bson.D {
+	keys := bson.D{}
+	for _, k := range s.Keys {
+		value := k.Order
+		if f, ok := value.(float64); ok {
+			value = int32(f)
+		}
+		keys = append(keys, bson.E{Key: k.Field, Value: value})
+	}
+	return keys
+}
+
+// Returns the mongo model used to create the index
+func (s Spec) Model() mongo.IndexModel {
+	opts := options.Index().SetName(s.IndexName())
+	if s.Unique {
+		opts.SetUnique(true)
+	}
+	if s.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(*s.ExpireAfterSeconds)
+	}
+	if s.PartialFilter != nil {
+		opts.SetPartialFilterExpression(s.PartialFilter)
+	}
+	if s.Weights != nil {
+		opts.SetWeights(s.Weights)
+	}
+	return mongo.IndexModel{Keys: s.KeyDocument(), Options: opts}
+}
+
+// Returns the key document as listed by mongo, which indexes the text fields together under _fts
+// and _ftsx in place of the first one
+func (s Spec) listedKey() bson.D {
+	keys := bson.D{}
+	text := false
+	for _, e := range s.KeyDocument() {
+		if e.Value != "text" {
+			keys = append(keys, e)
+		} else if !text {
+			keys = append(keys, bson.E{Key: "_fts", Value: "text"}, bson.E{Key: "_ftsx", Value: int32(1)})
+			text = true
+		}
+	}
+	return keys
+}
+
+// Returns the weight of every text field
+func (s Spec) textWeights() map[string]int32 {
+	weights := make(map[string]int32)
+	for _, k := range s.Keys {
+		if k.Order == "text" {
+			weights[k.Field] = 1
+			if w, ok := s.Weights[k.Field]; ok {
+				weights[k.Field] = w
+			}
+		}
+	}
+	return weights
+}
+
+// Returns true if an existing index (as returned by listIndexes, with its key as an ordered
+// document) matches the spec
+func (s Spec) Matches(existing bson.M) bool {
+	key, _ := existing["key"].(bson.D)
+	expected := s.listedKey()
+	if len(key) != len(expected) {
+		return false
+	}
+	for i, e := range expected {
+		if key[i].Key != e.Key || fmt.Sprint(key[i].Value) != fmt.Sprint(e.Value) {
+			return false
+		}
+	}
+
+	weights, _ := existing["weights"].(bson.M)
+	text := s.textWeights()
+	if len(weights) != len(text) {
+		return false
+	}
+	for field, weight := range text {
+		if fmt.Sprint(weights[field]) != fmt.Sprint(weight) {
+			return false
+		}
+	}
+
+	unique, _ := existing["unique"].(bool)
+	if unique != s.Unique {
+		return false
+	}
+
+	expire, hasExpire := existing["expireAfterSeconds"]
+	if hasExpire != (s.ExpireAfterSeconds != nil) {
+		return false
+	}
+	if hasExpire && fmt.Sprint(expire) != fmt.Sprint(*s.ExpireAfterSeconds) {
+		return false
+	}
+
+	filter, hasFilter := existing["partialFilterExpression"]
+	if hasFilter != (s.PartialFilter != nil) {
+		return false
+	}
+	if hasFilter {
+		// Compare through extended json since mongo returns its own numeric types
+		a, _ := bson.MarshalExtJSON(filter, false, false)
+		b, _ := bson.MarshalExtJSON(s.PartialFilter, false, false)
+		var x, y interface{}
+		json.Unmarshal(a, &x)
+		json.Unmarshal(b, &y)
+		return reflect.DeepEqual(x, y)
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package index_test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/index"
+	"testing"
+)
+
+func TestSpec(t *testing.T) {
+
+	var spec index.Spec
+	err := json.Unmarshal([]byte(`{"keys": [{"field": "email", "order": 1}, {"field": "createdAt", "order": -1}], "unique": true}`), &spec)
+	assert.Nil(t, err)
+	assert.Nil(t, spec.Validate())
+	assert.Equal(t, "email_1_createdAt_-1", spec.IndexName())
+
+	assert.True(t, spec.Matches(bson.M{"name": "email_1_createdAt_-1", "key": bson.D{{Key: "email", Value: int32(1)}, {Key: "createdAt", Value: int32(-1)}}, "unique": true}))
+	assert.False(t, spec.Matches(bson.M{"name": "email_1_createdAt_-1", "key": bson.D{{Key: "email", Value: int32(1)}, {Key: "createdAt", Value: int32(-1)}}}))
+
+	expire := int32(3600)
+	ttl := index.Spec{Name: "ttl", Keys: []index.Key{{Field: "createdAt", Order: float64(1)}}, ExpireAfterSeconds: &expire}
+	assert.True(t, ttl.Matches(bson.M{"name": "ttl", "key": bson.D{{Key: "createdAt", Value: int32(1)}}, "expireAfterSeconds": int32(3600)}))
+	assert.False(t, ttl.Matches(bson.M{"name": "ttl", "key": bson.D{{Key: "createdAt", Value: int32(1)}}, "expireAfterSeconds": int32(60)}))
+
+	// The key order matters
+	assert.False(t, spec.Matches(bson.M{"name": "email_1_createdAt_-1", "key": bson.D{{Key: "createdAt", Value: int32(-1)}, {Key: "email", Value: int32(1)}}, "unique": true}))
+
+	// Text fields are listed together, with their weights
+	text := index.Spec{Keys: []index.Key{{Field: "owner", Order: float64(1)}, {Field: "title", Order: "text"}, {Field: "body", Order: "text"}}, Weights: map[string]int32{"title": 10}}
+	assert.Nil(t, text.Validate())
+	assert.Equal(t, "owner_1_title_text_body_text", text.IndexName())
+	listed := bson.D{{Key: "owner", Value: int32(1)}, {Key: "_fts", Value: "text"}, {Key: "_ftsx", Value: int32(1)}}
+	assert.True(t, text.Matches(bson.M{"key": listed, "weights": bson.M{"title": int32(10), "body": int32(1)}}))
+	assert.False(t, text.Matches(bson.M{"key": listed, "weights": bson.M{"title": int32(1), "body": int32(1)}}))
+	assert.False(t, text.Matches(bson.M{"key": listed, "weights": bson.M{"title": int32(10)}}))
+
+	invalid := index.Spec{Keys: []index.Key{{Field: "name", Order: float64(2)}}}
+	assert.NotNil(t, invalid.Validate())
+	invalid = index.Spec{Keys: []index.Key{{Field: "title", Order: float64(1)}}, Weights: map[string]int32{"title": 2}}
+	assert.NotNil(t, invalid.Validate())
+}
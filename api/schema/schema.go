@@ -0,0 +1,527 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.springy.io/api/document"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of JSON Schema enforced on document writes.
+//
+// Besides the standard JSON types, the non-standard "date" and "objectId" types match the
+// corresponding extended json values.
+type Schema struct {
+
+	// The allowed type or types of the value
+	Type Types `json:"type,omitempty"`
+
+	// The schemas of the object properties
+	Properties map[string]*Schema `json:"properties,omitempty"`
+
+	// The required object properties
+	Required []string `json:"required,omitempty"`
+
+	// Flag indicating if properties not listed in Properties are allowed (defaults to true)
+	AdditionalProperties *bool `json:"additionalProperties,omitempty"`
+
+	// The schema of the array items
+	Items *Schema `json:"items,omitempty"`
+
+	// The allowed values
+	Enum []interface{} `json:"enum,omitempty"`
+
+	// The numeric bounds (inclusive)
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+
+	// The string length bounds
+	MinLength *int `json:"minLength,omitempty"`
+	MaxLength *int `json:"maxLength,omitempty"`
+
+	// The regular expression strings must match
+	Pattern string `json:"pattern,omitempty"`
+
+	// The array length bounds
+	MinItems *int `json:"minItems,omitempty"`
+	MaxItems *int `json:"maxItems,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Types holds one or more type names and unmarshals from either a string or an array of strings
+type Types []string
+
+// UnmarshalJSON unmarshals a single type name or an array of type names
+func (t *Types) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = Types{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return err
+	}
+	*t = names
+	return nil
+}
+
+// Parses a schema from its json representation
+func Parse(b []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(""); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Loads every <collection>.json schema inside the directory keyed by collection name
+func Load(dir string) (map[string]*Schema, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	schemas := make(map[string]*Schema, len(files))
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		s, err := Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		schemas[strings.TrimSuffix(filepath.Base(file), ".json")] = s
+	}
+	return schemas, nil
+}
+
+// Compiles the patterns of the schema and its sub schemas
+func (s *Schema) compile(path string) error {
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null", "date", "objectId":
+		default:
+			return fmt.Errorf("%s: unknown type '%s'", name(path), t)
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name(path), err)
+		}
+		s.pattern = re
+	}
+	for k, p := range s.Properties {
+		if err := p.compile(join(path, k)); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+// Validates a complete document
+func (s *Schema) Validate(doc map[string]interface{}) []document.FieldError {
+	var errors []document.FieldError
+	s.validate("", doc, &errors)
+	return errors
+}
+
+// Validates an update document. Only the fields written by the update operators are validated,
+// required fields may not be unset nor renamed, and the operators which are not validated are
+// rejected.
+func (s *Schema) ValidateUpdate(update map[string]interface{}) []document.FieldError {
+	var errors []document.FieldError
+	fail := func(path, message string) {
+		errors = append(errors, document.FieldError{Field: path, Message: message})
+	}
+	for op, v := range update {
+		if !strings.HasPrefix(op, "$") {
+			// A replacement style update, validate the field as is
+			if p := s.lookup(op); p != nil {
+				p.validate(op, v, &errors)
+			}
+			continue
+		}
+		fields, ok := object(v)
+		if !ok {
+			fail(op, "must be a document")
+			continue
+		}
+		for path, value := range fields {
+			p := s.lookup(path)
+			switch op {
+			case "$set", "$setOnInsert", "$min", "$max":
+				// The value is written as is (when it wins the comparison for $min and $max)
+				s.validateWrite(p, path, value, &errors)
+			case "$unset":
+				if s.requires(path) {
+					fail(path, "is required")
+				}
+			case "$inc", "$mul":
+				if !s.allows(path) {
+					fail(path, "is not allowed")
+				} else if p != nil && len(p.Type) > 0 && !p.Type.has("number") && !p.Type.has("integer") {
+					fail(path, "is not a number")
+				} else if _, ok := number(value); !ok {
+					fail(path, "must be incremented by a number")
+				}
+			case "$currentDate":
+				if !s.allows(path) {
+					fail(path, "is not allowed")
+				} else if p != nil && len(p.Type) > 0 && !p.Type.has("date") {
+					fail(path, "is not a date")
+				} else if spec, _ := object(value); value != true && (spec == nil || spec["$type"] != "date") {
+					// Timestamps are not dates
+					fail(path, "must be true or {$type: 'date'}")
+				}
+			case "$rename":
+				target, ok := value.(string)
+				switch {
+				case !ok:
+					fail(path, "must be renamed to a field name")
+				case s.requires(path):
+					fail(path, "is required")
+				case !s.allows(target):
+					fail(target, "is not allowed")
+				case s.lookup(target) != nil && !reflect.DeepEqual(s.lookup(target), p):
+					// The value of the renamed field is not known, so it may not take a declared field
+					fail(target, "cannot be renamed from '"+path+"'")
+				}
+			case "$push", "$addToSet":
+				if !s.allows(path) {
+					fail(path, "is not allowed")
+					continue
+				}
+				if p == nil {
+					continue
+				}
+				if len(p.Type) > 0 && !p.Type.has("array") {
+					fail(path, "is not an array")
+					continue
+				}
+				items := []interface{}{value}
+				if modifiers, ok := object(value); ok {
+					if each, ok := array(modifiers["$each"]); ok {
+						items = each
+					}
+				}
+				if p.Items != nil {
+					for i, item := range items {
+						p.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, &errors)
+					}
+				}
+			case "$pop", "$pull", "$pullAll":
+				if p != nil && len(p.Type) > 0 && !p.Type.has("array") {
+					fail(path, "is not an array")
+				}
+			default:
+				fail(op, "operator is not allowed on collections with a schema")
+			}
+		}
+	}
+	return errors
+}
+
+// Validates a value written to the field at the dotted path
+func (s *Schema) validateWrite(p *Schema, path string, value interface{}, errors *[]document.FieldError) {
+	if p != nil {
+		p.validate(path, value, errors)
+	} else if !s.allows(path) {
+		*errors = append(*errors, document.FieldError{Field: path, Message: "is not allowed"})
+	}
+}
+
+func (s *Schema) validate(path string, value interface{}, errors *[]document.FieldError) {
+
+	fail := func(format string, args ...interface{}) {
+		*errors = append(*errors, document.FieldError{Field: name(path), Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(value) {
+		fail("must be of type %s", strings.Join(s.Type, " or "))
+		return
+	}
+
+	if len(s.Enum) > 0 && !s.enumerates(value) {
+		fail("must be one of %v", s.Enum)
+	}
+
+	if items, ok := array(value); ok {
+		value = items
+	} else if fields, ok := object(value); ok {
+		value = fields
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := v[r]; !ok {
+				*errors = append(*errors, document.FieldError{Field: join(path, r), Message: "is required"})
+			}
+		}
+		for k, field := range v {
+			if p, ok := s.Properties[k]; ok {
+				p.validate(join(path, k), field, errors)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties && k != "_id" {
+				*errors = append(*errors, document.FieldError{Field: join(path, k), Message: "is not allowed"})
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errors)
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match '%s'", s.Pattern)
+		}
+	default:
+		if n, ok := number(value); ok {
+			if s.Minimum != nil && n < *s.Minimum {
+				fail("must be at least %v", *s.Minimum)
+			}
+			if s.Maximum != nil && n > *s.Maximum {
+				fail("must be at most %v", *s.Maximum)
+			}
+		}
+	}
+}
+
+// Returns the schema of the field at the dotted path
+func (s *Schema) lookup(path string) *Schema {
+	current := s
+	for _, k := range strings.Split(path, ".") {
+		if current.Items != nil && (isIndex(k) || strings.HasPrefix(k, "$")) {
+			// An index, or a positional operator ($, $[] or $[identifier])
+			current = current.Items
+			continue
+		}
+		p, ok := current.Properties[k]
+		if !ok {
+			return nil
+		}
+		current = p
+	}
+	return current
+}
+
+// Returns true if the (unknown) field at the dotted path is allowed
+func (s *Schema) allows(path string) bool {
+	current := s
+	for _, k := range strings.Split(path, ".") {
+		if current.AdditionalProperties != nil && !*current.AdditionalProperties && k != "_id" {
+			if _, ok := current.Properties[k]; !ok {
+				return false
+			}
+		}
+		p, ok := current.Properties[k]
+		if !ok {
+			return true
+		}
+		current = p
+	}
+	return true
+}
+
+// Returns true if the field at the dotted path is required
+func (s *Schema) requires(path string) bool {
+	i := strings.LastIndex(path, ".")
+	parent, field := s, path
+	if i >= 0 {
+		parent, field = s.lookup(path[:i]), path[i+1:]
+	}
+	if parent == nil {
+		return false
+	}
+	for _, r := range parent.Required {
+		if r == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) enumerates(value interface{}) bool {
+	value = normalize(value)
+	for _, e := range s.Enum {
+		if reflect.DeepEqual(normalize(e), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the value with its bson documents and arrays converted to plain maps and slices and
+// its numbers converted to float64, so that json and bson decoded values compare equal
+func normalize(value interface{}) interface{} {
+	if n, ok := number(value); ok {
+		return n
+	}
+	if items, ok := array(value); ok {
+		normalized := make([]interface{}, len(items))
+		for i, item := range items {
+			normalized[i] = normalize(item)
+		}
+		return normalized
+	}
+	if fields, ok := object(value); ok {
+		normalized := make(map[string]interface{}, len(fields))
+		for k, field := range fields {
+			normalized[k] = normalize(field)
+		}
+		return normalized
+	}
+	return value
+}
+
+func (t Types) has(name string) bool {
+	for _, n := range t {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the value matches any of the types
+func (t Types) matches(value interface{}) bool {
+	for _, name := range t {
+		switch name {
+		case "object":
+			if _, ok := object(value); ok {
+				return true
+			}
+		case "array":
+			if _, ok := array(value); ok {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "null":
+			if value == nil {
+				return true
+			}
+		case "number":
+			if _, ok := number(value); ok {
+				return true
+			}
+		case "integer":
+			if n, ok := number(value); ok && n == math.Trunc(n) {
+				return true
+			}
+		case "date":
+			switch value.(type) {
+			case time.Time, primitive.DateTime:
+				return true
+			}
+		case "objectId":
+			if _, ok := value.(primitive.ObjectID); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func array(value interface{}) ([]interface{}, bool) {
+	switch a := value.(type) {
+	case []interface{}:
+		return a, true
+	case primitive.A:
+		return a, true
+	}
+	return nil, false
+}
+
+func object(value interface{}) (map[string]interface{}, bool) {
+	switch o := value.(type) {
+	case map[string]interface{}:
+		return o, true
+	case primitive.M:
+		return o, true
+	case primitive.D:
+		return o.Map(), true
+	}
+	return nil, false
+}
+
+func number(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		return f, err == nil
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func isIndex(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func name(path string) string {
+	if path == "" {
+		return "(document)"
+	}
+	return path
+}
@@ -0,0 +1,177 @@
+package schema_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.springy.io/api/schema"
+	"testing"
+)
+
+var users = []byte(`{
+	"type": "object",
+	"required": ["name"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": 8},
+		"age": {"type": "integer", "minimum": 0},
+		"role": {"enum": ["admin", "member"]},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+		"createdAt": {"type": "date"}
+	}
+}`)
+
+func TestValidate(t *testing.T) {
+
+	s, err := schema.Parse(users)
+	assert.Nil(t, err)
+
+	errors := s.Validate(map[string]interface{}{
+		"name": "Foo",
+		"age":  float64(42),
+		"role": "admin",
+		"tags": []interface{}{"a", "b"},
+	})
+	assert.Empty(t, errors)
+
+	errors = s.Validate(map[string]interface{}{
+		"age":   1.5,
+		"role":  "owner",
+		"tags":  []interface{}{"a", float64(2), "c"},
+		"email": "foo@springy.io",
+	})
+	fields := map[string]string{}
+	for _, e := range errors {
+		fields[e.Field] = e.Message
+	}
+	assert.Equal(t, "is required", fields["name"])
+	assert.Equal(t, "must be of type integer", fields["age"])
+	assert.Contains(t, fields, "role")
+	assert.Contains(t, fields, "tags")
+	assert.Equal(t, "must be of type string", fields["tags[1]"])
+	assert.Equal(t, "is not allowed", fields["email"])
+}
+
+func TestValidateUpdate(t *testing.T) {
+
+	s, err := schema.Parse(users)
+	assert.Nil(t, err)
+
+	assert.Empty(t, s.ValidateUpdate(map[string]interface{}{
+		"$set": map[string]interface{}{"age": float64(7)},
+		"$inc": map[string]interface{}{"age": float64(1)},
+	}))
+
+	errors := s.ValidateUpdate(map[string]interface{}{
+		"$set":   map[string]interface{}{"name": "", "email": "foo@springy.io"},
+		"$unset": map[string]interface{}{"name": ""},
+	})
+	assert.Len(t, errors, 3)
+}
+
+func TestJSONSchema(t *testing.T) {
+
+	s, err := schema.Parse(users)
+	assert.Nil(t, err)
+
+	doc := s.JSONSchema()
+	assert.Equal(t, "object", doc["bsonType"])
+	properties := doc["properties"].(bson.M)
+	assert.Contains(t, properties, "_id")
+	assert.Equal(t, bson.A{"int", "long", "double", "decimal"}, properties["age"].(bson.M)["bsonType"])
+
+	_, err = schema.Parse([]byte(`{"type": "text"}`))
+	assert.NotNil(t, err)
+}
+
+func TestValidateUpdateOperators(t *testing.T) {
+
+	s, err := schema.Parse(users)
+	assert.Nil(t, err)
+	fields := func(update map[string]interface{}) map[string]string {
+		fields := map[string]string{}
+		for _, e := range s.ValidateUpdate(update) {
+			fields[e.Field] = e.Message
+		}
+		return fields
+	}
+
+	// Array items are validated, one at a time or with $each
+	assert.Empty(t, fields(map[string]interface{}{
+		"$push":     map[string]interface{}{"tags": "go"},
+		"$addToSet": map[string]interface{}{"tags": map[string]interface{}{"$each": bson.A{"a", "b"}}},
+		"$pull":     map[string]interface{}{"tags": "c"},
+	}))
+	assert.Equal(t, map[string]string{"tags[0]": "must be of type string", "tags[1]": "must be of type string"}, fields(map[string]interface{}{
+		"$push": map[string]interface{}{"tags": map[string]interface{}{"$each": bson.A{int32(1), true}}},
+	}))
+	assert.Equal(t, map[string]string{"name": "is not an array"}, fields(map[string]interface{}{
+		"$push": map[string]interface{}{"name": "x"},
+	}))
+
+	// Required fields may not be renamed away, nor fields renamed into declared or unknown ones
+	assert.Equal(t, map[string]string{"name": "is required"}, fields(map[string]interface{}{
+		"$rename": map[string]interface{}{"name": "nickname"},
+	}))
+	assert.Equal(t, map[string]string{"age": "cannot be renamed from 'role'", "email": "is not allowed"}, fields(map[string]interface{}{
+		"$rename": map[string]interface{}{"role": "age", "tags": "email"},
+	}))
+
+	// Written values are validated, as are the numbers and dates of the other operators
+	assert.Equal(t, map[string]string{"age": "must be at least 0", "createdAt": "must be true or {$type: 'date'}", "name": "is not a number"}, fields(map[string]interface{}{
+		"$min":         map[string]interface{}{"age": int32(-1)},
+		"$currentDate": map[string]interface{}{"createdAt": map[string]interface{}{"$type": "timestamp"}},
+		"$inc":         map[string]interface{}{"name": int32(1)},
+	}))
+	decimal, _ := primitive.ParseDecimal128("-2.5")
+	assert.Equal(t, map[string]string{"age": "must be of type integer"}, fields(map[string]interface{}{
+		"$max": map[string]interface{}{"age": decimal},
+	}))
+
+	// Operators which are not validated are rejected
+	assert.Equal(t, map[string]string{"$bit": "operator is not allowed on collections with a schema"}, fields(map[string]interface{}{
+		"$bit": map[string]interface{}{"age": map[string]interface{}{"and": int32(1)}},
+	}))
+}
+
+func TestValidateBSON(t *testing.T) {
+
+	s, err := schema.Parse([]byte(`{
+		"type": "object",
+		"properties": {
+			"address": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}}
+		}
+	}`))
+	assert.Nil(t, err)
+
+	// Documents decoded as bson are objects and are validated
+	assert.Empty(t, s.Validate(map[string]interface{}{"address": primitive.M{"city": "Paris"}}))
+	assert.Empty(t, s.Validate(map[string]interface{}{"address": primitive.D{{Key: "city", Value: "Paris"}}}))
+	errors := s.Validate(map[string]interface{}{"address": primitive.M{"city": int32(1)}})
+	assert.Len(t, errors, 1)
+	assert.Equal(t, "address.city", errors[0].Field)
+	errors = s.Validate(map[string]interface{}{"address": primitive.D{}})
+	assert.Len(t, errors, 1)
+	assert.Equal(t, "address.city", errors[0].Field)
+}
+
+func TestValidateEnum(t *testing.T) {
+
+	s, err := schema.Parse([]byte(`{
+		"type": "object",
+		"properties": {
+			"tags": {"enum": [{"a": 1}, ["x", 2]]},
+			"role": {"enum": ["admin", 3]}
+		}
+	}`))
+	assert.Nil(t, err)
+
+	// Objects and arrays are compared by value, whichever way they were decoded
+	assert.Empty(t, s.Validate(map[string]interface{}{"tags": map[string]interface{}{"a": float64(1)}}))
+	assert.Empty(t, s.Validate(map[string]interface{}{"tags": primitive.M{"a": int32(1)}}))
+	assert.Empty(t, s.Validate(map[string]interface{}{"tags": primitive.A{"x", int64(2)}}))
+	assert.Empty(t, s.Validate(map[string]interface{}{"role": int32(3)}))
+	assert.Len(t, s.Validate(map[string]interface{}{"tags": primitive.M{"a": int32(2)}}), 1)
+	assert.Len(t, s.Validate(map[string]interface{}{"tags": []interface{}{"x"}}), 1)
+	assert.Len(t, s.Validate(map[string]interface{}{"role": "member"}), 1)
+}
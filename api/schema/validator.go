@@ -0,0 +1,91 @@
+package schema
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The MongoDB bson types matching each schema type. Integral doubles and decimals are integers to
+// Springy, so the validator accepts them too and leaves rejecting fractions to Springy.
+var bsonTypes = map[string][]string{
+	"object":   {"object"},
+	"array":    {"array"},
+	"string":   {"string"},
+	"number":   {"number"},
+	"integer":  {"int", "long", "double", "decimal"},
+	"boolean":  {"bool"},
+	"null":     {"null"},
+	"date":     {"date"},
+	"objectId": {"objectId"},
+}
+
+// Converts the schema into a MongoDB $jsonSchema document, which uses bsonType in place of type
+func (s *Schema) JSONSchema() bson.M {
+	doc := bson.M{}
+
+	if len(s.Type) > 0 {
+		var types bson.A
+		for _, t := range s.Type {
+			for _, b := range bsonTypes[t] {
+				types = append(types, b)
+			}
+		}
+		if len(types) == 1 {
+			doc["bsonType"] = types[0]
+		} else {
+			doc["bsonType"] = types
+		}
+	}
+
+	if len(s.Properties) > 0 {
+		properties := bson.M{}
+		for k, p := range s.Properties {
+			properties[k] = p.JSONSchema()
+		}
+		doc["properties"] = properties
+	}
+	if len(s.Required) > 0 {
+		doc["required"] = s.Required
+	}
+	if s.AdditionalProperties != nil {
+		doc["additionalProperties"] = *s.AdditionalProperties
+		if !*s.AdditionalProperties {
+			// The document key is always present in mongo
+			if _, ok := s.Properties["_id"]; !ok {
+				properties, _ := doc["properties"].(bson.M)
+				if properties == nil {
+					properties = bson.M{}
+				}
+				properties["_id"] = bson.M{}
+				doc["properties"] = properties
+			}
+		}
+	}
+	if s.Items != nil {
+		doc["items"] = s.Items.JSONSchema()
+	}
+	if len(s.Enum) > 0 {
+		doc["enum"] = s.Enum
+	}
+	if s.Minimum != nil {
+		doc["minimum"] = *s.Minimum
+	}
+	if s.Maximum != nil {
+		doc["maximum"] = *s.Maximum
+	}
+	if s.MinLength != nil {
+		doc["minLength"] = *s.MinLength
+	}
+	if s.MaxLength != nil {
+		doc["maxLength"] = *s.MaxLength
+	}
+	if s.Pattern != "" {
+		doc["pattern"] = s.Pattern
+	}
+	if s.MinItems != nil {
+		doc["minItems"] = *s.MinItems
+	}
+	if s.MaxItems != nil {
+		doc["maxItems"] = *s.MaxItems
+	}
+	return doc
+}
@@ -0,0 +1,168 @@
+package event
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/document"
+	"log/slog"
+	"sync"
+)
+
+// The transported form of an event
+type envelope[T any] struct {
+
+	// The node that published the event
+	Node string `bson:"node"`
+
+	// The sender of the event, addressed by node and connection
+	Sender *RemoteSender `bson:"sender,omitempty"`
+
+	// The event data
+	Data T `bson:"data"`
+}
+
+// identified is implemented by senders with a connection identifier
+type identified interface {
+	ID() string
+}
+
+// Bridge forwards the events of a bus to the other nodes of a cluster through a transport, and
+// publishes the events received from them. Senders cross the transport as RemoteSender values,
+// and the topics are prefixed with the name of the bus on the transport.
+type Bridge[T any] struct {
+	bus           *Bus[T]
+	transport     Transport
+	node          string
+	name          string
+	subscriptions []*Subscription[T]
+
+	// The imported events, published by their own goroutine so that slow subscribers never hold
+	// back the transport. Events are dropped when it is full.
+	imports chan Event[T]
+	done    chan struct{}
+	closed  sync.Once
+}
+
+// Creates a bridge between the named bus of the node and the transport
+func NewBridge[T any](bus *Bus[T], transport Transport, node, name string) *Bridge[T] {
+	b := &Bridge[T]{
+		bus:       bus,
+		transport: transport,
+		node:      node,
+		name:      name,
+		imports:   make(chan Event[T], bus.options.Buffer),
+		done:      make(chan struct{}),
+	}
+	go b.publish()
+	return b
+}
+
+// Forwards the events published in this process to the topics matching the pattern
+func (b *Bridge[T]) Export(pattern Topic) {
+	s := b.bus.Subscribe(pattern)
+	b.subscriptions = append(b.subscriptions, s)
+	go func() {
+		for e := range s.C() {
+			if e.Origin != "" {
+				// Received from another node
+				continue
+			}
+			payload, err := bson.Marshal(envelope[T]{Node: b.node, Sender: remote(b.node, e.Sender), Data: e.Data})
+			if err != nil {
+				Logger(e.Sender).Error("unable to encode event", "topic", e.Topic, "error", err)
+				continue
+			}
+			if err := b.transport.Publish(Topic(b.name)+"."+e.Topic, payload); err != nil {
+				Logger(e.Sender).Error("unable to forward event", "topic", e.Topic, "error", err)
+			}
+		}
+	}()
+}
+
+// Publishes the events received from the other nodes on the topics matching the pattern
+func (b *Bridge[T]) Import(pattern Topic) error {
+	prefix := Topic(b.name) + "."
+	return b.transport.Subscribe(prefix+pattern, func(topic Topic, payload []byte) {
+		var env envelope[T]
+		if err := bson.Unmarshal(payload, &env); err != nil {
+			slog.Error("unable to decode event", "topic", topic, "error", err)
+			return
+		}
+		if env.Node == b.node {
+			return
+		}
+		e := Event[T]{Topic: topic[len(prefix):], Data: env.Data, Origin: env.Node}
+		if env.Sender != nil {
+			e.Sender = *env.Sender
+		}
+		select {
+		case b.imports <- e:
+		case <-b.done:
+		default:
+			slog.Warn("imported event dropped, subscribers too slow", "topic", e.Topic, "origin", e.Origin)
+		}
+	})
+}
+
+// Publishes the imported events until the bridge is closed
+func (b *Bridge[T]) publish() {
+	for {
+		select {
+		case e := <-b.imports:
+			b.bus.publish(e)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Stops forwarding events
+func (b *Bridge[T]) Close() {
+	for _, s := range b.subscriptions {
+		s.Unsubscribe()
+	}
+	b.subscriptions = nil
+	b.closed.Do(func() { close(b.done) })
+}
+
+// Returns the transported form of a sender
+func remote(node string, sender interface{}) *RemoteSender {
+	switch s := sender.(type) {
+	case RemoteSender:
+		return &s
+	case identified:
+		r := &RemoteSender{Node: node, Connection: s.ID()}
+		if p, ok := sender.(document.Principal); ok {
+			r.Identity = p.Principal()
+		}
+		return r
+	}
+	return nil
+}
+
+// Bridges the buses to the transport, exporting and importing the events on the topics matching
+// the patterns. Returns a function closing the bridges.
+func (buses *Buses) Bridge(transport Transport, exports, imports []Topic) (func(), error) {
+	requests := NewBridge(buses.Requests, transport, buses.Node, "requests")
+	snapshots := NewBridge(buses.Snapshots, transport, buses.Node, "snapshots")
+	connections := NewBridge(buses.Connections, transport, buses.Node, "connections")
+	closeAll := func() {
+		requests.Close()
+		snapshots.Close()
+		connections.Close()
+	}
+
+	for _, pattern := range exports {
+		requests.Export(pattern)
+		snapshots.Export(pattern)
+		connections.Export(pattern)
+	}
+	for _, pattern := range imports {
+		for _, err := range []error{requests.Import(pattern), snapshots.Import(pattern), connections.Import(pattern)} {
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+	}
+	return closeAll, nil
+}
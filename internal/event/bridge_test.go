@@ -0,0 +1,111 @@
+package event_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/event"
+	"testing"
+	"time"
+)
+
+type TestClient struct {
+	id string
+}
+
+func (c *TestClient) ID() string {
+	return c.id
+}
+
+func receive[T any](t *testing.T, s *event.Subscription[T]) event.Event[T] {
+	select {
+	case e := <-s.C():
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return event.Event[T]{}
+}
+
+// Two nodes exchanging requests and snapshots through the embedded broker
+func TestBridge(t *testing.T) {
+
+	broker, err := event.NewBroker("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer broker.Close()
+
+	a := event.NewBuses("a", event.Options{Buffer: 8})
+	b := event.NewBuses("b", event.Options{Buffer: 8})
+
+	ta, err := event.Dial(broker.Addr())
+	assert.Nil(t, err)
+	defer ta.Close()
+	tb, err := event.Dial(broker.Addr())
+	assert.Nil(t, err)
+	defer tb.Close()
+
+	closeA, err := a.Bridge(ta, []event.Topic{"request.>"}, []event.Topic{event.Snapshot})
+	assert.Nil(t, err)
+	defer closeA()
+	closeB, err := b.Bridge(tb, []event.Topic{event.Snapshot}, []event.Topic{"request.>"})
+	assert.Nil(t, err)
+	defer closeB()
+
+	requests := b.Requests.Subscribe(event.MongoRequest)
+	snapshots := a.Snapshots.Subscribe(event.Snapshot)
+	local := a.Requests.Subscribe(event.MongoRequest)
+
+	// Wait for the subscriptions to reach the broker
+	time.Sleep(100 * time.Millisecond)
+
+	request := document.DocumentRequest{
+		Uid:        "1",
+		Collection: "users",
+		Scope:      document.Write,
+		Operation:  document.Update,
+		Query:      document.Document{"name": "Foo"},
+		Value:      document.Document{"$set": map[string]interface{}{"count": int32(2)}},
+	}
+	a.Requests.Publish(event.MongoRequest, &TestClient{id: "c1"}, request)
+
+	// Delivered locally and to the other node
+	assert.Equal(t, "", receive(t, local).Origin)
+	e := receive(t, requests)
+	assert.Equal(t, "a", e.Origin)
+	assert.Equal(t, event.MongoRequest, e.Topic)
+	assert.Equal(t, event.RemoteSender{Node: "a", Connection: "c1"}, e.Sender)
+	assert.Equal(t, request.Scope, e.Data.Scope)
+	assert.Equal(t, request.Operation, e.Data.Operation)
+	assert.Equal(t, request.Query, e.Data.Query)
+	assert.Equal(t, document.Document{"$set": document.Document{"count": int32(2)}}, e.Data.Value)
+
+	// Replies are addressed back to the sender on its node
+	b.Snapshots.Publish(event.Snapshot, e.Sender, document.DocumentSnapshot{Value: map[string]interface{}{"_uid": "1"}})
+	s := receive(t, snapshots)
+	assert.Equal(t, "b", s.Origin)
+	assert.Equal(t, event.RemoteSender{Node: "a", Connection: "c1"}, s.Sender)
+	assert.Equal(t, "1", s.Data.Value["_uid"])
+}
+
+func TestLocalTransport(t *testing.T) {
+
+	network := event.NewLocalNetwork()
+	a := network.Transport()
+	b := network.Transport()
+
+	var received []string
+	assert.Nil(t, a.Subscribe("numbers.*", func(topic event.Topic, payload []byte) {
+		received = append(received, "a:"+string(payload))
+	}))
+	assert.Nil(t, b.Subscribe("numbers.*", func(topic event.Topic, payload []byte) {
+		received = append(received, "b:"+string(payload))
+	}))
+
+	assert.Nil(t, a.Publish("numbers.one", []byte("1")))
+	assert.Nil(t, b.Publish("letters.a", []byte("a")))
+	assert.Equal(t, []string{"b:1"}, received)
+
+	b.Close()
+	assert.Nil(t, a.Publish("numbers.two", []byte("2")))
+	assert.Equal(t, []string{"b:1"}, received)
+	assert.Equal(t, event.ErrClosed, b.Subscribe("numbers.*", nil))
+}
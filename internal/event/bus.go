@@ -1,55 +1,235 @@
 package event
 
 import (
-	"log"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	bus  *Bus
-	once sync.Once
+// Represents what happens when an event is published to a subscriber whose buffer is full
+type Overflow int
+
+const (
+	// Block the publisher until there is room or the timeout expires, then drop the event
+	Block Overflow = iota
+	// Drop the oldest buffered event to make room
+	DropOldest
+	// Drop the published event
+	DropNewest
 )
 
+var overflowID = map[string]Overflow{
+	"block":       Block,
+	"drop_oldest": DropOldest,
+	"drop_newest": DropNewest,
+}
+
+// Parses an overflow policy name (block, drop_oldest or drop_newest)
+func ParseOverflow(name string) (Overflow, error) {
+	if overflow, ok := overflowID[name]; ok {
+		return overflow, nil
+	}
+	return Block, fmt.Errorf("unknown overflow policy '%s'", name)
+}
+
+// Configures the subscriptions of a bus
+type Options struct {
+
+	// The number of events buffered per subscriber
+	Buffer int
+
+	// What happens when a subscriber's buffer is full
+	Overflow Overflow
+
+	// How long a publisher blocks on a full buffer (Block only, zero waits forever)
+	Timeout time.Duration
+}
+
+// Bus is a typed publish/subscribe event bus with hierarchical topics.
 // See: https://levelup.gitconnected.com/lets-write-a-simple-event-bus-in-go-79b9480d8997
-type Bus struct {
-	// Registered clients.
-	subscribers map[Topic][]Channel
-	mutex       sync.RWMutex
+type Bus[T any] struct {
+	options       Options
+	subscriptions map[*Subscription[T]]struct{}
+	mutex         sync.RWMutex
 }
 
-func init() {
-	log.Println("Initializing Event Bus")
-	once.Do(func() {
-		bus = &Bus{
-			subscribers: make(map[Topic][]Channel),
-		}
-	})
+// Subscription is a subscriber's bounded queue of events published to the topics matching its pattern
+type Subscription[T any] struct {
+	bus     *Bus[T]
+	pattern Topic
+	events  chan Event[T]
+	dropped atomic.Uint64
+	closed  bool
+	mutex   sync.Mutex
+
+	// Closed on unsubscribe, releasing the publishers blocked on a full buffer
+	done chan struct{}
+
+	// The offers in flight, which must end before the events channel is closed
+	offers sync.WaitGroup
 }
 
-// Subscribes to events
-func Subscribe(topic Topic, c Channel) {
+// Creates a new bus
+func NewBus[T any](options Options) *Bus[T] {
+	if options.Buffer <= 0 {
+		options.Buffer = 1
+	}
+	return &Bus[T]{
+		options:       options,
+		subscriptions: make(map[*Subscription[T]]struct{}),
+	}
+}
+
+// Subscribes to the events published to the topics matching the pattern
+func (bus *Bus[T]) Subscribe(pattern Topic) *Subscription[T] {
+	s := &Subscription[T]{
+		bus:     bus,
+		pattern: pattern,
+		events:  make(chan Event[T], bus.options.Buffer),
+		done:    make(chan struct{}),
+	}
 	bus.mutex.Lock()
 	defer bus.mutex.Unlock()
-	if channels, found := bus.subscribers[topic]; found {
-		bus.subscribers[topic] = append(channels, c)
-	} else {
-		bus.subscribers[topic] = append([]Channel{}, c)
+	bus.subscriptions[s] = struct{}{}
+	return s
+}
+
+// Removes the subscription and closes its channel, once the publishers blocked on it gave up
+func (bus *Bus[T]) Unsubscribe(s *Subscription[T]) {
+	bus.mutex.Lock()
+	delete(bus.subscriptions, s)
+	bus.mutex.Unlock()
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.mutex.Unlock()
+
+	s.offers.Wait()
+	close(s.events)
+}
+
+// Publishes an event to every subscription matching the topic, returning the number of
+// subscriptions it was delivered to
+func (bus *Bus[T]) Publish(topic Topic, sender interface{}, data T) int {
+	return bus.publish(Event[T]{Topic: topic, Sender: sender, Data: data})
+}
+
+func (bus *Bus[T]) publish(e Event[T]) int {
+	bus.mutex.RLock()
+	var matching []*Subscription[T]
+	for s := range bus.subscriptions {
+		if s.pattern.Matches(e.Topic) {
+			matching = append(matching, s)
+		}
 	}
+	bus.mutex.RUnlock()
 
+	delivered := 0
+	for _, s := range matching {
+		if s.offer(e, bus.options) {
+			delivered++
+		}
+	}
+	return delivered
 }
 
-// Publishes events
-func Publish(topic Topic, sender interface{}, data interface{}) {
+// Returns the number of events buffered across all subscriptions
+func (bus *Bus[T]) Backlog() int {
 	bus.mutex.RLock()
 	defer bus.mutex.RUnlock()
-	if chs, found := bus.subscribers[topic]; found {
-		// Create a new slice to preserve locking
-		channels := append([]Channel{}, chs...)
-		// Send an event to subscribed channels
-		go func(e Event, channels []Channel) {
-			for _, value := range channels {
-				value <- e
-			}
-		}(Event{Topic: topic, Sender: sender, Data: data}, channels)
+	backlog := 0
+	for s := range bus.subscriptions {
+		backlog += len(s.events)
+	}
+	return backlog
+}
+
+// Returns the channel the subscription's events are delivered on, closed when unsubscribed
+func (s *Subscription[T]) C() <-chan Event[T] {
+	return s.events
+}
+
+// Removes the subscription from its bus
+func (s *Subscription[T]) Unsubscribe() {
+	s.bus.Unsubscribe(s)
+}
+
+// Returns the number of events dropped because the buffer was full
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Enqueues the event according to the overflow policy, returning false if it was dropped. The
+// lock is not held while blocking, so that unsubscribing releases the blocked publishers.
+func (s *Subscription[T]) offer(e Event[T], options Options) bool {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return false
+	}
+	s.offers.Add(1)
+	s.mutex.Unlock()
+	defer s.offers.Done()
+
+	select {
+	case s.events <- e:
+		return true
+	default:
+	}
+
+	switch options.Overflow {
+	case DropOldest:
+		select {
+		case <-s.events:
+			s.dropped.Add(1)
+		default:
+		}
+		select {
+		case s.events <- e:
+			return true
+		default:
+		}
+	case Block:
+		var timeout <-chan time.Time
+		if options.Timeout > 0 {
+			timer := time.NewTimer(options.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case s.events <- e:
+			return true
+		case <-timeout:
+		case <-s.done:
+			return false
+		}
+	}
+	s.dropped.Add(1)
+	return false
+}
+
+// Returns true if the topic matches the pattern. Patterns are dot separated, where "*" matches a
+// single segment and a trailing ">" matches one or more remaining segments.
+func (pattern Topic) Matches(topic Topic) bool {
+	if pattern == topic {
+		return true
+	}
+	p := strings.Split(string(pattern), ".")
+	t := strings.Split(string(topic), ".")
+	for i, segment := range p {
+		if segment == ">" && i == len(p)-1 {
+			return len(t) > i
+		}
+		if i >= len(t) || (segment != "*" && segment != t[i]) {
+			return false
+		}
 	}
+	return len(p) == len(t)
 }
@@ -5,6 +5,7 @@ import (
 	"go.springy.io/internal/event"
 	"sync"
 	"testing"
+	"time"
 )
 
 type TestSender struct {
@@ -32,8 +33,8 @@ func TestBus(t *testing.T) {
 
 	var wg sync.WaitGroup
 
-	s := make(chan event.Event)
-	event.Subscribe(event.Mongo, s)
+	bus := event.NewBus[TestMessage](event.Options{Buffer: 1})
+	s := bus.Subscribe("request.mongo")
 	go subscribe(t, s, &wg)
 
 	for i, m := range messages {
@@ -43,25 +44,90 @@ func TestBus(t *testing.T) {
 		}
 		// Block until Done is called
 		wg.Add(1)
-		event.Publish(event.Mongo, sender, m)
+		bus.Publish("request.mongo", sender, m)
 	}
 	wg.Wait()
+
+	s.Unsubscribe()
+	assert.Equal(t, 0, bus.Publish("request.mongo", nil, messages[0]))
 }
 
-func subscribe(t *testing.T, s chan event.Event, wg *sync.WaitGroup) {
-	for {
-		select {
-		case e := <-s:
-			if sender, ok := e.Sender.(TestSender); ok {
-				if data, ok := e.Data.(TestMessage); ok {
-					t.Log("Received event: ", e)
-					msg := messages[sender.index]
-					assert.Equal(t, data.count, msg.count)
-					assert.Equal(t, data.name, msg.name)
-					wg.Done()
-				}
-			}
+func subscribe(t *testing.T, s *event.Subscription[TestMessage], wg *sync.WaitGroup) {
+	for e := range s.C() {
+		if sender, ok := e.Sender.(TestSender); ok {
+			t.Log("Received event: ", e)
+			msg := messages[sender.index]
+			assert.Equal(t, e.Data.count, msg.count)
+			assert.Equal(t, e.Data.name, msg.name)
+			wg.Done()
 		}
 	}
+}
+
+func TestTopicMatches(t *testing.T) {
+
+	assert.True(t, event.Topic("request.mongo").Matches("request.mongo"))
+	assert.True(t, event.Topic("request.*").Matches("request.mongo"))
+	assert.False(t, event.Topic("request.*").Matches("request.mongo.find"))
+	assert.True(t, event.Topic("request.>").Matches("request.mongo.find"))
+	assert.False(t, event.Topic("request.>").Matches("request"))
+	assert.False(t, event.Topic("snapshot").Matches("request.mongo"))
+}
+
+func TestOverflow(t *testing.T) {
+
+	newest := event.NewBus[int](event.Options{Buffer: 2, Overflow: event.DropNewest})
+	s := newest.Subscribe("numbers")
+	for i := 1; i <= 3; i++ {
+		newest.Publish("numbers", nil, i)
+	}
+	assert.Equal(t, uint64(1), s.Dropped())
+	assert.Equal(t, 1, (<-s.C()).Data)
+	assert.Equal(t, 2, (<-s.C()).Data)
+
+	oldest := event.NewBus[int](event.Options{Buffer: 2, Overflow: event.DropOldest})
+	s = oldest.Subscribe("numbers")
+	for i := 1; i <= 3; i++ {
+		oldest.Publish("numbers", nil, i)
+	}
+	assert.Equal(t, uint64(1), s.Dropped())
+	assert.Equal(t, 2, oldest.Backlog())
+	assert.Equal(t, 2, (<-s.C()).Data)
+	assert.Equal(t, 3, (<-s.C()).Data)
+
+	blocking := event.NewBus[int](event.Options{Buffer: 1, Overflow: event.Block, Timeout: 10 * time.Millisecond})
+	s = blocking.Subscribe("numbers")
+	assert.Equal(t, 1, blocking.Publish("numbers", nil, 1))
+	assert.Equal(t, 0, blocking.Publish("numbers", nil, 2))
+	assert.Equal(t, uint64(1), s.Dropped())
+}
+
+func TestUnsubscribeBlocked(t *testing.T) {
+
+	// Publishers blocked on a full buffer without a timeout are released by unsubscribing
+	bus := event.NewBus[int](event.Options{Buffer: 1, Overflow: event.Block})
+	s := bus.Subscribe("numbers")
+	bus.Publish("numbers", nil, 1)
+	published := make(chan int)
+	go func() {
+		published <- bus.Publish("numbers", nil, 2)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		s.Unsubscribe()
+		close(unsubscribed)
+	}()
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("unsubscribe blocked behind the publisher")
+	}
+	assert.Equal(t, 0, <-published)
 
+	// The buffered events are still read before the channel is closed
+	assert.Equal(t, 1, (<-s.C()).Data)
+	_, ok := <-s.C()
+	assert.False(t, ok)
 }
@@ -1,10 +1,73 @@
 package event
 
-type Event struct {
+import (
+	"go.springy.io/api/document"
+)
+
+// Event is a typed event published on a topic
+type Event[T any] struct {
 	Topic  Topic
 	Sender interface{}
-	Data   interface{}
+	Data   T
+
+	// The node the event was received from (empty for events published in this process)
+	Origin string
+}
+
+// Returns true if the event was received from another node. The requests of a sender are owned by
+// the node it is connected to, the other nodes only update what their own clients see.
+func (e Event[T]) Remote() bool {
+	return e.Origin != ""
+}
+
+// RemoteSender stands in for a sender connected to another node
+type RemoteSender struct {
+
+	// The node the sender is connected to
+	Node string `bson:"node"`
+
+	// The connection identifier of the sender
+	Connection string `bson:"connection"`
+
+	// The authenticated principal of the sender (if any)
+	Identity string `bson:"identity,omitempty"`
+}
+
+// Returns the connection identifier of the remote sender
+func (s RemoteSender) ID() string {
+	return s.Connection
 }
 
-// Channel is a channel which can accept an Event
-type Channel chan Event
+// Returns the authenticated principal of the remote sender
+func (s RemoteSender) Principal() string {
+	return s.Identity
+}
+
+// Disconnect is published when a sender goes away
+type Disconnect struct{}
+
+// Buses holds the typed buses connecting the Springy subsystems
+type Buses struct {
+
+	// The identifier of this node
+	Node string
+
+	// Document, presence and pub/sub requests sent by clients
+	Requests *Bus[document.DocumentRequest]
+
+	// Snapshots addressed to clients
+	Snapshots *Bus[document.DocumentSnapshot]
+
+	// Connection lifecycle events
+	Connections *Bus[Disconnect]
+}
+
+// Creates the buses of the node with the same subscription options
+func NewBuses(node string, options Options) *Buses {
+	return &Buses{
+		Node:        node,
+		Requests:    NewBus[document.DocumentRequest](options),
+		Snapshots:   NewBus[document.DocumentSnapshot](options),
+		Connections: NewBus[Disconnect](options),
+	}
+}
@@ -0,0 +1,27 @@
+package event
+
+import (
+	"go.springy.io/api/document"
+	"log/slog"
+)
+
+// Returns the default logger with the attributes identifying the sender: its connection, the node
+// it is connected to (when remote) and its authenticated principal
+func Logger(sender interface{}) *slog.Logger {
+	var attrs []any
+	if s, ok := sender.(identified); ok {
+		attrs = append(attrs, "connection", s.ID())
+	}
+	if s, ok := sender.(RemoteSender); ok {
+		attrs = append(attrs, "node", s.Node)
+	}
+	if p, ok := sender.(document.Principal); ok && p.Principal() != "" {
+		attrs = append(attrs, "principal", p.Principal())
+	}
+	return slog.Default().With(attrs...)
+}
+
+// Returns the logger of an event, identifying its sender and request
+func RequestLogger(e Event[document.DocumentRequest]) *slog.Logger {
+	return Logger(e.Sender).With(e.Data.LogAttrs()...)
+}
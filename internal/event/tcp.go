@@ -0,0 +1,354 @@
+package event
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The embedded broker speaks a line based protocol over TCP, where payloads follow their header:
+//
+//	SUB <pattern>\n
+//	PUB <topic> <size>\n<payload>
+//	MSG <topic> <size>\n<payload>
+//
+// Clients send SUB and PUB frames and the broker forwards each PUB to the other clients with a
+// matching pattern as a MSG frame.
+const (
+	subFrame = "SUB"
+	pubFrame = "PUB"
+	msgFrame = "MSG"
+
+	// The largest payload accepted in a frame
+	maxPayload = 16 << 20
+
+	// Time allowed to write a frame before the peer is considered gone
+	frameWait = 5 * time.Second
+
+	// The frames queued for a peer of the broker, which is disconnected when it falls further behind
+	peerQueue = 256
+
+	// Delay between attempts to reconnect to the broker
+	redialWait = time.Second
+)
+
+// Writes a frame to the peer
+func writeFrame(w io.Writer, verb string, topic Topic, payload []byte) error {
+	if strings.ContainsAny(string(topic), " \n") {
+		return fmt.Errorf("invalid topic '%s'", topic)
+	}
+	var header string
+	if verb == subFrame {
+		header = fmt.Sprintf("%s %s\n", verb, topic)
+	} else {
+		header = fmt.Sprintf("%s %s %d\n", verb, topic, len(payload))
+	}
+	frame := append([]byte(header), payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Reads the next frame sent by the peer
+func readFrame(r *bufio.Reader) (verb string, topic Topic, payload []byte, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == subFrame:
+		return fields[0], Topic(fields[1]), nil, nil
+	case len(fields) == 3 && (fields[0] == pubFrame || fields[0] == msgFrame):
+		size, convErr := strconv.Atoi(fields[2])
+		if convErr != nil || size < 0 || size > maxPayload {
+			return "", "", nil, fmt.Errorf("invalid payload size '%s'", fields[2])
+		}
+		payload = make([]byte, size)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return "", "", nil, err
+		}
+		return fields[0], Topic(fields[1]), payload, nil
+	}
+	return "", "", nil, fmt.Errorf("invalid frame '%s'", strings.TrimSpace(line))
+}
+
+// Broker is an embedded message broker, letting several nodes exchange events without external
+// infrastructure (or on a single machine in tests).
+type Broker struct {
+	listener net.Listener
+	peers    map[*peer]struct{}
+	mutex    sync.RWMutex
+}
+
+// A client connected to the broker, written to by its own goroutine so that slow peers never
+// hold back the others
+type peer struct {
+	conn     net.Conn
+	patterns []Topic
+	frames   chan frame
+	done     chan struct{}
+}
+
+// A message frame queued for a peer
+type frame struct {
+	topic   Topic
+	payload []byte
+}
+
+// Starts a broker listening on the address (use ":0" for any free port)
+func NewBroker(address string) (*Broker, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	broker := &Broker{listener: listener, peers: make(map[*peer]struct{})}
+	go broker.accept()
+	return broker, nil
+}
+
+// Returns the address the broker is listening on
+func (broker *Broker) Addr() string {
+	return broker.listener.Addr().String()
+}
+
+// Stops the broker and disconnects its clients
+func (broker *Broker) Close() error {
+	err := broker.listener.Close()
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	for p := range broker.peers {
+		p.conn.Close()
+		delete(broker.peers, p)
+	}
+	return err
+}
+
+func (broker *Broker) accept() {
+	for {
+		conn, err := broker.listener.Accept()
+		if err != nil {
+			return
+		}
+		p := &peer{conn: conn, frames: make(chan frame, peerQueue), done: make(chan struct{})}
+		broker.mutex.Lock()
+		broker.peers[p] = struct{}{}
+		broker.mutex.Unlock()
+		go broker.serve(p)
+		go p.write()
+	}
+}
+
+// Reads the frames sent by the peer until it disconnects
+func (broker *Broker) serve(p *peer) {
+	defer func() {
+		broker.mutex.Lock()
+		delete(broker.peers, p)
+		broker.mutex.Unlock()
+		close(p.done)
+		p.conn.Close()
+	}()
+
+	r := bufio.NewReader(p.conn)
+	for {
+		verb, topic, payload, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				slog.Warn("broker peer error", "peer", p.conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		switch verb {
+		case subFrame:
+			broker.mutex.Lock()
+			p.patterns = append(p.patterns, topic)
+			broker.mutex.Unlock()
+		case pubFrame:
+			broker.forward(p, topic, payload)
+		}
+	}
+}
+
+// Forwards a published payload to the other peers subscribed to the topic
+func (broker *Broker) forward(sender *peer, topic Topic, payload []byte) {
+	broker.mutex.RLock()
+	var recipients []*peer
+	for p := range broker.peers {
+		if p == sender {
+			continue
+		}
+		for _, pattern := range p.patterns {
+			if pattern.Matches(topic) {
+				recipients = append(recipients, p)
+				break
+			}
+		}
+	}
+	broker.mutex.RUnlock()
+
+	for _, p := range recipients {
+		select {
+		case p.frames <- frame{topic, payload}:
+		default:
+			// Peers too slow to keep up are disconnected (their reader cleans up), and renew
+			// their subscriptions once reconnected
+			slog.Warn("broker peer too slow, disconnecting", "peer", p.conn.RemoteAddr().String(), "queued", peerQueue)
+			p.conn.Close()
+		}
+	}
+}
+
+// Writes the frames queued for the peer until it disconnects
+func (p *peer) write() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case f := <-p.frames:
+			p.conn.SetWriteDeadline(time.Now().Add(frameWait))
+			if err := writeFrame(p.conn, msgFrame, f.topic, f.payload); err != nil {
+				// Broken peers are disconnected, their reader cleans up
+				p.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// TCP is a transport connected to a broker speaking the embedded broker protocol. The connection
+// is re-established (and the subscriptions renewed) when it is lost; events published while
+// disconnected are lost.
+type TCP struct {
+	address     string
+	conn        net.Conn
+	subscribers []localSubscriber
+	closed      bool
+	mutex       sync.Mutex
+}
+
+// Connects to the broker at the address
+func Dial(address string) (*TCP, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	t := &TCP{address: address, conn: conn}
+	go t.read(conn)
+	return t, nil
+}
+
+// Publishes the payload to the topic
+func (t *TCP) Publish(topic Topic, payload []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	if t.conn == nil {
+		return fmt.Errorf("not connected to broker %s", t.address)
+	}
+	t.conn.SetWriteDeadline(time.Now().Add(frameWait))
+	return writeFrame(t.conn, pubFrame, topic, payload)
+}
+
+// Subscribes the handler to the topics matching the pattern
+func (t *TCP) Subscribe(pattern Topic, handler Handler) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	t.subscribers = append(t.subscribers, localSubscriber{pattern, handler})
+	if t.conn == nil {
+		// Subscribed once reconnected
+		return nil
+	}
+	t.conn.SetWriteDeadline(time.Now().Add(frameWait))
+	return writeFrame(t.conn, subFrame, pattern, nil)
+}
+
+// Disconnects from the broker
+func (t *TCP) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	if t.conn != nil {
+		return t.conn.Close()
+	}
+	return nil
+}
+
+// Dispatches the payloads received from the broker until the connection is lost, then reconnects
+func (t *TCP) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		verb, topic, payload, err := readFrame(r)
+		if err != nil {
+			break
+		}
+		if verb != msgFrame {
+			continue
+		}
+		t.mutex.Lock()
+		var handlers []Handler
+		for _, s := range t.subscribers {
+			if s.pattern.Matches(topic) {
+				handlers = append(handlers, s.handler)
+			}
+		}
+		t.mutex.Unlock()
+		for _, handler := range handlers {
+			handler(topic, payload)
+		}
+	}
+
+	conn.Close()
+	t.mutex.Lock()
+	t.conn = nil
+	closed := t.closed
+	t.mutex.Unlock()
+	if !closed {
+		slog.Warn("lost connection to broker", "broker", t.address)
+		go t.redial()
+	}
+}
+
+// Reconnects to the broker and renews the subscriptions, until the transport is closed
+func (t *TCP) redial() {
+	for {
+		time.Sleep(redialWait)
+		t.mutex.Lock()
+		closed := t.closed
+		t.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		conn, err := net.Dial("tcp", t.address)
+		if err != nil {
+			continue
+		}
+
+		t.mutex.Lock()
+		if t.closed {
+			t.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		for _, s := range t.subscribers {
+			conn.SetWriteDeadline(time.Now().Add(frameWait))
+			writeFrame(conn, subFrame, s.pattern, nil)
+		}
+		t.conn = conn
+		t.mutex.Unlock()
+
+		slog.Info("reconnected to broker", "broker", t.address)
+		go t.read(conn)
+		return
+	}
+}
@@ -0,0 +1,123 @@
+package event_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/event"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Publishes the payload until the subscriber receives it, as subscriptions reach the broker asynchronously
+func deliver(t *testing.T, publisher *event.TCP, received <-chan []byte, payload []byte) {
+	deadline := time.After(5 * time.Second)
+	for {
+		publisher.Publish("numbers.one", payload)
+		select {
+		case got := <-received:
+			if bytes.Equal(payload, got) {
+				return
+			}
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("payload never delivered")
+		}
+	}
+}
+
+func TestTCPReconnect(t *testing.T) {
+
+	broker, err := event.NewBroker("127.0.0.1:0")
+	assert.Nil(t, err)
+	address := broker.Addr()
+
+	a, err := event.Dial(address)
+	assert.Nil(t, err)
+	defer a.Close()
+	b, err := event.Dial(address)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	received := make(chan []byte, 16)
+	assert.Nil(t, b.Subscribe("numbers.*", func(topic event.Topic, payload []byte) {
+		received <- payload
+	}))
+	deliver(t, a, received, []byte("1"))
+
+	// The connections are re-established once the broker is back, and the subscriptions renewed
+	broker.Close()
+	broker, err = event.NewBroker(address)
+	assert.Nil(t, err)
+	defer broker.Close()
+	deliver(t, a, received, []byte("2"))
+}
+
+func TestTCPCloseWhileDisconnected(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := listener.Addr().String()
+
+	transport, err := event.Dial(address)
+	assert.Nil(t, err)
+	conn, err := listener.Accept()
+	assert.Nil(t, err)
+
+	// The broker goes away, and the transport is closed while redialing it
+	listener.Close()
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, transport.Close())
+
+	// The transport no longer dials the broker once it is back
+	time.Sleep(1500 * time.Millisecond)
+	listener, err = net.Listen("tcp", address)
+	assert.Nil(t, err)
+	defer listener.Close()
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = listener.Accept()
+	assert.NotNil(t, err)
+}
+
+func TestBrokerSlowPeer(t *testing.T) {
+
+	broker, err := event.NewBroker("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer broker.Close()
+
+	// A peer subscribing without ever reading
+	slow, err := net.Dial("tcp", broker.Addr())
+	assert.Nil(t, err)
+	defer slow.Close()
+	slow.Write([]byte("SUB numbers.*\n"))
+
+	a, err := event.Dial(broker.Addr())
+	assert.Nil(t, err)
+	defer a.Close()
+	b, err := event.Dial(broker.Addr())
+	assert.Nil(t, err)
+	defer b.Close()
+	received := make(chan []byte, 1024)
+	assert.Nil(t, b.Subscribe("numbers.*", func(topic event.Topic, payload []byte) {
+		received <- payload
+	}))
+	deliver(t, a, received, []byte("0"))
+
+	// The other peers keep receiving while the slow peer falls behind
+	payload := bytes.Repeat([]byte("x"), 32<<10)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, a.Publish("numbers.one", payload))
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("publish %d held back by the slow peer", i)
+		}
+	}
+
+	// Then it is disconnected
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.Copy(io.Discard, slow)
+	assert.Nil(t, err)
+}
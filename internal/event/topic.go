@@ -1,12 +1,25 @@
 package event
 
-type Topic int
+// Topic is a hierarchical, dot separated event topic such as "request.mongo"
+type Topic string
 
 const (
 
-	// Mongo Events
-	Mongo Topic = iota
+	// Document requests processed by mongo
+	MongoRequest Topic = "request.mongo"
 
-	// Websocket Events
-	Websocket
+	// Presence requests
+	PresenceRequest Topic = "request.presence"
+
+	// Ephemeral pub/sub requests
+	PubSubRequest Topic = "request.pubsub"
+
+	// Cancellations of watch requests
+	CancelRequest Topic = "request.cancel"
+
+	// Snapshots written to websocket clients
+	Snapshot Topic = "snapshot"
+
+	// Connection lifecycle events
+	Disconnected Topic = "connection.disconnect"
 )
@@ -0,0 +1,100 @@
+package event
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when using a closed transport
+var ErrClosed = errors.New("transport is closed")
+
+// Handler receives the encoded events delivered by a transport
+type Handler func(topic Topic, payload []byte)
+
+// Transport carries encoded events between the nodes of a cluster (NATS, Redis, Kafka or the
+// embedded broker). Delivery is at most once and a node does not receive its own events.
+type Transport interface {
+
+	// Publishes the payload to the topic
+	Publish(topic Topic, payload []byte) error
+
+	// Calls the handler with the payloads published to the topics matching the pattern
+	Subscribe(pattern Topic, handler Handler) error
+
+	// Closes the transport
+	Close() error
+}
+
+// Local is an in-process transport connecting the nodes created by the same network, which is
+// the behavior of a single node.
+type Local struct {
+	network *LocalNetwork
+	closed  bool
+}
+
+// LocalNetwork connects local transports
+type LocalNetwork struct {
+	subscribers map[*Local][]localSubscriber
+	mutex       sync.RWMutex
+}
+
+type localSubscriber struct {
+	pattern Topic
+	handler Handler
+}
+
+// Creates a new in-process network
+func NewLocalNetwork() *LocalNetwork {
+	return &LocalNetwork{subscribers: make(map[*Local][]localSubscriber)}
+}
+
+// Creates a transport attached to the network
+func (network *LocalNetwork) Transport() *Local {
+	local := &Local{network: network}
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.subscribers[local] = nil
+	return local
+}
+
+// Publishes the payload to the subscribers of the other transports
+func (local *Local) Publish(topic Topic, payload []byte) error {
+	local.network.mutex.RLock()
+	var handlers []Handler
+	for transport, subscribers := range local.network.subscribers {
+		if transport == local {
+			continue
+		}
+		for _, s := range subscribers {
+			if s.pattern.Matches(topic) {
+				handlers = append(handlers, s.handler)
+			}
+		}
+	}
+	local.network.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+	return nil
+}
+
+// Subscribes the handler to the topics matching the pattern
+func (local *Local) Subscribe(pattern Topic, handler Handler) error {
+	local.network.mutex.Lock()
+	defer local.network.mutex.Unlock()
+	if local.closed {
+		return ErrClosed
+	}
+	local.network.subscribers[local] = append(local.network.subscribers[local], localSubscriber{pattern, handler})
+	return nil
+}
+
+// Detaches the transport from the network
+func (local *Local) Close() error {
+	local.network.mutex.Lock()
+	defer local.network.mutex.Unlock()
+	local.closed = true
+	delete(local.network.subscribers, local)
+	return nil
+}
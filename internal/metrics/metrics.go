@@ -0,0 +1,374 @@
+// Package metrics implements counters, gauges and histograms exposed in the Prometheus text
+// exposition format (https://prometheus.io/docs/instrumenting/exposition_formats/).
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The kinds of metric families
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+// DefaultBuckets are the default histogram buckets, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families in registration order
+type Registry struct {
+	families []writer
+	names    map[string]bool
+	mutex    sync.Mutex
+}
+
+type writer interface {
+	write(w io.Writer)
+}
+
+// Default is the registry exposed by Handler
+var Default = NewRegistry()
+
+// Creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, family writer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.families = append(r.families, family)
+}
+
+// Writes every family in the text exposition format
+func (r *Registry) Write(w io.Writer) {
+	r.mutex.Lock()
+	families := append([]writer(nil), r.families...)
+	r.mutex.Unlock()
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+// Returns a handler serving the default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.Write(w)
+	})
+}
+
+// The name, help and label names shared by the series of a family
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f *family) header(w io.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, help, f.name, f.kind)
+}
+
+// Formats the labels of a series, with an optional extra label (such as a bucket bound)
+func (f *family) format(values []string, extra ...string) string {
+	var pairs []string
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, name := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape.Replace(values[i])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[0], extra[1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// A float64 updated atomically
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) Set(f float64) {
+	v.bits.Store(math.Float64bits(f))
+}
+
+func (v *value) Get() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+// The series of a family keyed by label values
+type series[T any] struct {
+	family
+	values map[string][]string
+	series map[string]*T
+	create func() *T
+	mutex  sync.RWMutex
+}
+
+func newSeries[T any](kind, name, help string, labels []string, create func() *T) *series[T] {
+	return &series[T]{
+		family: family{name: name, help: help, kind: kind, labels: labels},
+		values: make(map[string][]string),
+		series: make(map[string]*T),
+		create: create,
+	}
+}
+
+// Returns the series with the label values, creating it on first use
+func (s *series[T]) with(values []string) *T {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", s.name, len(s.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s.mutex.RLock()
+	t, ok := s.series[key]
+	s.mutex.RUnlock()
+	if ok {
+		return t
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if t, ok = s.series[key]; !ok {
+		t = s.create()
+		s.series[key] = t
+		s.values[key] = append([]string(nil), values...)
+	}
+	return t
+}
+
+// Calls f with the series sorted by label values
+func (s *series[T]) each(f func(values []string, t *T)) {
+	s.mutex.RLock()
+	keys := make([]string, 0, len(s.series))
+	for k := range s.series {
+		keys = append(keys, k)
+	}
+	s.mutex.RUnlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s.mutex.RLock()
+		values, t := s.values[k], s.series[k]
+		s.mutex.RUnlock()
+		f(values, t)
+	}
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	value
+}
+
+// Increments the counter
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	*series[Counter]
+}
+
+// Registers a family of counters partitioned by the label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newSeries(counter, name, help, labels, func() *Counter { return &Counter{} })}
+	r.register(name, v)
+	return v
+}
+
+// Returns the counter with the label values
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(values []string, c *Counter) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.format(values), formatFloat(c.Get()))
+	})
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	value
+}
+
+// GaugeVec is a family of gauges partitioned by labels
+type GaugeVec struct {
+	*series[Gauge]
+}
+
+// Registers a family of gauges partitioned by the label names
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newSeries(gauge, name, help, labels, func() *Gauge { return &Gauge{} })}
+	r.register(name, v)
+	return v
+}
+
+// Returns the gauge with the label values
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+
+func (v *GaugeVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(values []string, g *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.format(values), formatFloat(g.Get()))
+	})
+}
+
+// FuncVec is a family of counters or gauges whose values are read when exposed, partitioned by labels
+type FuncVec struct {
+	*series[atomic.Value]
+}
+
+// Registers a family of counters read when exposed
+func (r *Registry) NewCounterFunc(name, help string, labels ...string) *FuncVec {
+	v := &FuncVec{newSeries(counter, name, help, labels, func() *atomic.Value { return &atomic.Value{} })}
+	r.register(name, v)
+	return v
+}
+
+// Registers a family of gauges read when exposed
+func (r *Registry) NewGaugeFunc(name, help string, labels ...string) *FuncVec {
+	v := &FuncVec{newSeries(gauge, name, help, labels, func() *atomic.Value { return &atomic.Value{} })}
+	r.register(name, v)
+	return v
+}
+
+// Sets the function reading the value with the label values
+func (v *FuncVec) Set(f func() float64, values ...string) {
+	v.with(values).Store(f)
+}
+
+func (v *FuncVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(values []string, f *atomic.Value) {
+		if read, ok := f.Load().(func() float64); ok {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, v.format(values), formatFloat(read()))
+		}
+	})
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    value
+}
+
+// Records an observation
+func (h *Histogram) Observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(v)
+}
+
+// HistogramVec is a family of histograms partitioned by labels
+type HistogramVec struct {
+	*series[Histogram]
+}
+
+// Registers a family of histograms with the bucket upper bounds (DefaultBuckets when nil)
+// partitioned by the label names
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	v := &HistogramVec{newSeries(histogram, name, help, labels, func() *Histogram {
+		return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}
+	})}
+	r.register(name, v)
+	return v
+}
+
+// Returns the histogram with the label values
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(values []string, h *Histogram) {
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.format(values, "le", formatFloat(bound)), cumulative)
+		}
+		// Observations racing the exposition may be counted in a bucket but not yet in the total
+		count := max(h.count.Load(), cumulative)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.format(values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.format(values), formatFloat(h.sum.Get()))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.format(values), count)
+	})
+}
+
+// Registers a family of counters in the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// Registers a family of gauges in the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+// Registers a family of counters read when exposed in the default registry
+func NewCounterFunc(name, help string, labels ...string) *FuncVec {
+	return Default.NewCounterFunc(name, help, labels...)
+}
+
+// Registers a family of gauges read when exposed in the default registry
+func NewGaugeFunc(name, help string, labels ...string) *FuncVec {
+	return Default.NewGaugeFunc(name, help, labels...)
+}
+
+// Registers a family of histograms in the default registry
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
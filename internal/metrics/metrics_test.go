@@ -0,0 +1,52 @@
+package metrics_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/metrics"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+
+	r := metrics.NewRegistry()
+	messages := r.NewCounterVec("messages_total", "Messages received", "scope")
+	messages.With("write").Inc()
+	messages.With("find").Add(2)
+	messages.With("write").Inc()
+
+	clients := r.NewGaugeVec("clients", "Connected clients")
+	clients.With().Set(3)
+
+	backlog := r.NewGaugeFunc("backlog", "Buffered events", "bus")
+	backlog.Set(func() float64 { return 7 }, `say "hi"`)
+
+	latency := r.NewHistogramVec("latency_seconds", "Request latency", []float64{1, 0.1}, "collection")
+	latency.With("users").Observe(0.05)
+	latency.With("users").Observe(0.5)
+	latency.With("users").Observe(5)
+
+	var b bytes.Buffer
+	r.Write(&b)
+	assert.Equal(t, `# HELP messages_total Messages received
+# TYPE messages_total counter
+messages_total{scope="find"} 2
+messages_total{scope="write"} 2
+# HELP clients Connected clients
+# TYPE clients gauge
+clients 3
+# HELP backlog Buffered events
+# TYPE backlog gauge
+backlog{bus="say \"hi\""} 7
+# HELP latency_seconds Request latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{collection="users",le="0.1"} 1
+latency_seconds_bucket{collection="users",le="1"} 2
+latency_seconds_bucket{collection="users",le="+Inf"} 3
+latency_seconds_sum{collection="users"} 5.55
+latency_seconds_count{collection="users"} 3
+`, b.String())
+
+	assert.Panics(t, func() { r.NewGaugeVec("clients", "Duplicate") })
+	assert.Panics(t, func() { messages.With() })
+}
@@ -0,0 +1,92 @@
+package mongo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+)
+
+// The number of documents written to the database at once by Import
+const importBatch = 1000
+
+// Writes the documents of the collection matching the filter as extended json lines (canonical
+// unless relaxed), returning the number of documents written
+func Export(ctx context.Context, collection string, filter bson.M, relaxed bool, w io.Writer) (int, error) {
+	if filter == nil {
+		filter = bson.M{}
+	}
+	cursor, err := database.Collection(collection).Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	out := bufio.NewWriter(w)
+	count := 0
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, !relaxed, false)
+		if err != nil {
+			return count, err
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
+
+// Inserts the documents read as extended json lines (canonical or relaxed) into the collection,
+// replacing the documents with the same _id when upserting. Returns the number of documents written.
+func Import(ctx context.Context, collection string, r io.Reader, upsert bool) (int, error) {
+	c := database.Collection(collection)
+	var models []mongo.WriteModel
+	count := 0
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(true))
+		if err != nil {
+			return err
+		}
+		count += len(models)
+		models = models[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+		id, ok := doc.Map()["_id"]
+		if upsert && ok {
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": id}).SetReplacement(doc).SetUpsert(true))
+		} else {
+			models = append(models, mongo.NewInsertOneModel().SetDocument(doc))
+		}
+		if len(models) == importBatch {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	return count, flush()
+}
@@ -0,0 +1,21 @@
+package mongo
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Pings the primary
+func Ping(ctx context.Context) error {
+	return database.Client().Ping(ctx, readpref.Primary())
+}
+
+// Verifies change streams can be opened, which requires a replica set or sharded cluster
+func CheckChangeStreams(ctx context.Context) error {
+	changeStream, err := database.Watch(ctx, mongo.Pipeline{})
+	if err != nil {
+		return err
+	}
+	return changeStream.Close(ctx)
+}
@@ -0,0 +1,120 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/index"
+	"log/slog"
+)
+
+// Reconciles the declared indexes with the database. Missing indexes are created and indexes whose
+// options changed are recreated, while undeclared indexes are left untouched. An index which cannot
+// be recreated is restored as it was, the other indexes are still synced and the errors returned.
+func SyncIndexes(ctx context.Context, specs map[string][]index.Spec) error {
+	var errs []error
+	for collection, declared := range specs {
+		existing, err := listOrderedIndexes(ctx, collection)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", collection, err))
+			continue
+		}
+		byName := make(map[string]bson.M, len(existing))
+		for _, e := range existing {
+			if name, ok := e["name"].(string); ok {
+				byName[name] = e
+			}
+		}
+
+		for _, spec := range declared {
+			name := spec.IndexName()
+			e, ok := byName[name]
+			if ok && spec.Matches(e) {
+				continue
+			}
+			if ok {
+				slog.Info("recreating index", "collection", collection, "index", name)
+				if err := DropIndex(ctx, collection, name); err != nil {
+					slog.Error("unable to drop index", "collection", collection, "index", name, "error", err)
+					errs = append(errs, fmt.Errorf("%s: %s: %w", collection, name, err))
+					continue
+				}
+			} else {
+				slog.Info("creating index", "collection", collection, "index", name)
+			}
+			if _, err := CreateIndex(ctx, collection, spec); err != nil {
+				slog.Error("unable to create index", "collection", collection, "index", name, "error", err)
+				errs = append(errs, fmt.Errorf("%s: %s: %w", collection, name, err))
+				if ok {
+					if err := restoreIndex(ctx, collection, e); err != nil {
+						slog.Error("unable to restore index", "collection", collection, "index", name, "error", err)
+					}
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Lists the indexes of a collection with their keys as ordered documents, which bson.M loses
+func listOrderedIndexes(ctx context.Context, collection string) ([]bson.M, error) {
+	cursor, err := database.Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var raws []bson.Raw
+	if err := cursor.All(ctx, &raws); err != nil {
+		return nil, err
+	}
+	indexes := make([]bson.M, 0, len(raws))
+	for _, raw := range raws {
+		var i bson.M
+		if err := bson.Unmarshal(raw, &i); err != nil {
+			return nil, err
+		}
+		var key bson.D
+		if err := raw.Lookup("key").Unmarshal(&key); err != nil {
+			return nil, err
+		}
+		i["key"] = key
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// Recreates an index dropped by the sync from its listed definition
+func restoreIndex(ctx context.Context, collection string, existing bson.M) error {
+	definition := bson.M{}
+	for k, v := range existing {
+		if k != "ns" {
+			definition[k] = v
+		}
+	}
+	command := bson.D{{Key: "createIndexes", Value: collection}, {Key: "indexes", Value: bson.A{definition}}}
+	return database.RunCommand(ctx, command).Err()
+}
+
+// Lists the indexes of a collection
+func ListIndexes(ctx context.Context, collection string) ([]bson.M, error) {
+	cursor, err := database.Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []bson.M
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+// Creates an index on a collection, returning its name
+func CreateIndex(ctx context.Context, collection string, spec index.Spec) (string, error) {
+	return database.Collection(collection).Indexes().CreateOne(ctx, spec.Model())
+}
+
+// Drops the named index of a collection
+func DropIndex(ctx context.Context, collection string, name string) error {
+	_, err := database.Collection(collection).Indexes().DropOne(ctx, name)
+	return err
+}
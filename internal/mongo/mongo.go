@@ -2,123 +2,442 @@ package mongo
 
 import (
 	"context"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.springy.io/api/document"
+	"go.springy.io/api/index"
+	"go.springy.io/api/schema"
 	"go.springy.io/internal/event"
+	"go.springy.io/internal/metrics"
+	"go.springy.io/internal/trace"
 	"go.springy.io/pkg/util"
-	"log"
+	"log/slog"
 	"time"
 )
 
 var (
 	database *mongo.Database
 	env      *util.Environment
+	schemas  map[string]*schema.Schema
+	buses    *event.Buses
+
+	// The collections declared by the schemas and indexes, labelling the metrics on their own
+	declared = map[string]bool{}
+)
+
+// The metrics label shared by the collections which are not declared, named by clients
+const otherCollections = "other"
+
+var (
+	requestDuration = metrics.NewHistogramVec("springy_request_duration_seconds", "Time taken to process document requests.", nil, "collection", "scope")
+	databaseErrors  = metrics.NewCounterVec("springy_mongo_errors_total", "Requests failed by the database.", "collection", "scope")
+	changeStreams   = metrics.NewGaugeFunc("springy_change_streams_active", "Open change streams.")
 )
 
-func init() {
-	log.Println("🌱 [Initializing MongoDB] 🌱")
+// Connects to the database, then loads the collection schemas and reconciles the declared indexes
+func Connect() error {
+	if err := Open(); err != nil {
+		return err
+	}
+	if err := loadSchemas(); err != nil {
+		return err
+	}
+	return loadIndexes()
+}
+
+// Connects to the database of util.Env, without loading the schemas or indexes
+func Open() error {
 	env = util.Env()
+	return connect()
+}
+
+// Disconnects from the database
+func Close(ctx context.Context) error {
+	return database.Client().Disconnect(ctx)
+}
+
+// Connects to the database
+func connect() error {
+	slog.Info("initializing mongo", "host", env.Database.Address(), "db", env.Database.Db)
 
 	// https://github.com/mongodb/mongo-go-driver/blob/master/mongo/client_examples_test.go
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	credential := options.Credential{
-		AuthSource: env.Database.Db,
-		Username:   env.Database.Username,
-		Password:   env.Database.Password,
+	client, err := mongo.Connect(ctx, clientOptions(env.Database))
+	if err != nil {
+		return fmt.Errorf("unable to connect to mongo: %w", err)
 	}
 
-	uri := env.Database.GetURI()
+	err = client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return fmt.Errorf("unable to ping mongo: %w", err)
+	}
 
-	clientOptions := options.Client().
-		SetHosts([]string{uri}).
-		SetDirect(true).
-		SetAppName(env.Database.Db).
-		SetAuth(credential).
-		SetReplicaSet(env.Database.ReplicaSet).
-		SetReadPreference(readpref.Primary())
+	database = client.Database(env.Database.Db)
+	databases, err := client.ListDatabaseNames(ctx, bson.M{})
+	if err != nil {
+		return fmt.Errorf("unable to list mongo databases: %w", err)
+	}
+	slog.Info("connected to mongo", "databases", databases)
+	return nil
+}
 
-	client, err := mongo.Connect(ctx, clientOptions)
+// Returns the client options of the database settings. The user and password apply to the host
+// settings, or to a URI without credentials of its own.
+func clientOptions(database util.DatabaseEnv) *options.ClientOptions {
+	clientOptions := options.Client()
+	if database.URI != "" {
+		clientOptions.ApplyURI(database.URI)
+	} else {
+		clientOptions.SetHosts([]string{database.GetURI()})
+		if database.ReplicaSet != "" {
+			clientOptions.SetReplicaSet(database.ReplicaSet)
+		} else {
+			// A single server, which is not discovered as part of a replica set
+			clientOptions.SetDirect(true)
+		}
+	}
+	if database.Username != "" && clientOptions.Auth == nil {
+		clientOptions.SetAuth(options.Credential{
+			AuthSource: database.Db,
+			Username:   database.Username,
+			Password:   database.Password,
+		})
+	}
+	return clientOptions.
+		SetAppName(database.Db).
+		SetReadPreference(readpref.Primary())
+}
 
+// Loads the declared indexes and reconciles them with the database
+func loadIndexes() error {
+	if env.Database.IndexFile == "" {
+		return nil
+	}
+	specs, err := index.Load(env.Database.IndexFile)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("unable to load indexes from %s: %w", env.Database.IndexFile, err)
+	}
+	for collection := range specs {
+		declared[collection] = true
+	}
+	if err := SyncIndexes(context.Background(), specs); err != nil {
+		return fmt.Errorf("unable to sync indexes: %w", err)
 	}
+	return nil
+}
 
-	err = client.Ping(ctx, readpref.Primary())
+// Loads the collection schemas and optionally pushes them to mongo as validators
+func loadSchemas() error {
+	if env.Schema.Dir == "" {
+		return nil
+	}
+
+	var err error
+	schemas, err = schema.Load(env.Schema.Dir)
 	if err != nil {
-		log.Fatal("💩 [Unable to ping mongo]: ", err)
+		return fmt.Errorf("unable to load schemas from %s: %w", env.Schema.Dir, err)
+	}
+	slog.Info("loaded schemas", "count", len(schemas))
+	for collection := range schemas {
+		declared[collection] = true
 	}
 
-	database = client.Database(env.Database.Db)
-	databases, err := client.ListDatabaseNames(context.TODO(), bson.M{})
+	if !env.Schema.Push {
+		return nil
+	}
+
+	ctx := context.Background()
+	names, err := database.ListCollectionNames(ctx, bson.M{})
 	if err != nil {
-		log.Fatal("💩 [Unable to list mongo databases]: ", err)
+		return fmt.Errorf("unable to list collections: %w", err)
 	}
-	log.Println("🌱", databases, "🌱")
+	existing := map[string]bool{}
+	for _, name := range names {
+		existing[name] = true
+	}
+
+	for collection, s := range schemas {
+		validator := bson.M{"$jsonSchema": s.JSONSchema()}
+		var command bson.D
+		if existing[collection] {
+			command = bson.D{{Key: "collMod", Value: collection}, {Key: "validator", Value: validator}}
+		} else {
+			command = bson.D{{Key: "create", Value: collection}, {Key: "validator", Value: validator}}
+		}
+		if err := database.RunCommand(ctx, command).Err(); err != nil {
+			slog.Error("unable to push schema validator", "collection", collection, "error", err)
+		}
+	}
+	return nil
 }
 
-func Run() {
-	subscriber := make(chan event.Event)
-	event.Subscribe(event.Mongo, subscriber)
+// Processes the document requests published on the buses, at most LIMIT_MAX_REQUESTS at once
+func Run(b *event.Buses) {
+	buses = b
+	changeStreams.Set(func() float64 { return float64(streams.count()) })
+	requests := buses.Requests.Subscribe(event.MongoRequest)
+	cancels := buses.Requests.Subscribe(event.CancelRequest)
+	disconnects := buses.Connections.Subscribe(event.Disconnected)
+
+	// The requests wait for a slot, buffered by their subscription meanwhile, while cancels and
+	// disconnects are still processed
+	go func() {
+		var slots chan struct{}
+		if env.Limit.MaxRequests > 0 {
+			slots = make(chan struct{}, env.Limit.MaxRequests)
+		}
+		for e := range requests.C() {
+			if e.Remote() {
+				// Processed by the node the sender is connected to
+				continue
+			}
+			if slots == nil {
+				go handle(e)
+				continue
+			}
+			slots <- struct{}{}
+			go func() {
+				defer func() { <-slots }()
+				handle(e)
+			}()
+		}
+	}()
+
 	for {
 		select {
-		case e := <-subscriber:
-			go handle(e)
+		case e := <-cancels.C():
+			if e.Remote() {
+				continue
+			}
+			// Release the change stream of a single watch
+			streams.cancel(e.Sender, e.Data.Uid)
+		case e := <-disconnects.C():
+			if e.Remote() {
+				continue
+			}
+			// Release the change streams of the departed sender
+			streams.unwatch(e.Sender)
 		}
 	}
 }
 
 // Processes a document request event
-func handle(e event.Event) {
-	// Make sure we are dealing with an API request
-	if request, ok := e.Data.(document.DocumentRequest); ok {
-		switch request.Scope {
-		case document.Find:
-			_find(e.Sender, request)
+func handle(e event.Event[document.DocumentRequest]) {
+	request := e.Data
+	start := time.Now()
+	span := trace.Continue(trace.Parse(request.Traceparent), "mongo.handle", trace.Consumer, request.LogAttrs()...)
+	request.Traceparent = span.Traceparent(request.Traceparent)
+
+	// Rejected requests are answered without being timed
+	rejected := false
+	reject := func(err *document.DocumentError) {
+		rejected = true
+		publishError(e.Sender, request, err)
+	}
+	defer func() {
+		elapsed := time.Since(start)
+		if !rejected {
+			requestDuration.With(collectionLabel(request.Collection), request.Scope.String()).Observe(elapsed.Seconds())
+		}
+		event.RequestLogger(e).Debug("request handled", "duration", elapsed)
+		span.End()
+	}()
+	// The filter is built from the parsed query, so only validated clauses reach the database
+	var filter bson.M
+	if filters(request) {
+		// The limits in effect may be changed by a reload
+		env := util.Env().Query
+		limits := document.QueryLimits{MaxDepth: env.MaxDepth, MaxClauses: env.MaxClauses}
+		query, err := request.ParseQuery(limits)
+		if err != nil {
+			reject(document.NewDocumentError(document.InvalidRequest, err))
+			return
+		}
+		filter = query.Filter()
+	}
+	switch request.Scope {
+	case document.Find:
+		_find(e.Sender, request, filter)
+		break
+	case document.FindOne:
+		_findOne(e.Sender, request, filter)
+	case document.Write:
+		if err := prepare(e.Sender, &request); err != nil {
+			reject(document.NewDocumentError(document.InvalidRequest, err))
+			return
+		}
+		if err := preserveCreated(&request, filter); err != nil {
+			databaseError(e.Sender, request, err)
+			return
+		}
+		if err := validate(request); err != nil {
+			reject(err)
+			return
+		}
+		// Performs a single CRUD operation
+		switch request.Operation {
+		case document.Insert:
+			_insert(e.Sender, request)
 			break
-		case document.FindOne:
-			_findOne(e.Sender, request)
-		case document.Write:
-			// Performs a single CRUD operation
-			switch request.Operation {
-			case document.Insert:
-				_insert(e.Sender, request)
-				break
-			case document.Update:
-				_update(e.Sender, request)
-				break
-			case document.Delete:
-				_delete(e.Sender, request)
-				break
-			case document.Replace:
-				_replace(e.Sender, request)
-				break
-			}
+		case document.Update:
+			_update(e.Sender, request, filter)
 			break
-		case document.Watch:
-			// Performs a change stream watch
-			_watch(e.Sender, request)
+		case document.Delete:
+			_delete(e.Sender, request, filter)
 			break
+		case document.Replace:
+			_replace(e.Sender, request, filter)
+			break
+		}
+		break
+	case document.Watch:
+		// Performs a change stream watch
+		_watch(e.Sender, request)
+		break
+	}
+}
+
+// Returns the metrics label of a collection, grouping the collections which are not declared so
+// that clients cannot create unbounded series
+func collectionLabel(collection string) string {
+	if declared[collection] {
+		return collection
+	}
+	return otherCollections
+}
+
+// Returns true if the request queries documents with its filter
+func filters(request document.DocumentRequest) bool {
+	switch request.Scope {
+	case document.Find, document.FindOne:
+		return true
+	case document.Write:
+		return request.Operation != document.Insert
+	}
+	return false
+}
+
+// Resolves server generated values and stamps the request value before a write
+func prepare(sender interface{}, request *document.DocumentRequest) error {
+	now := time.Now()
+	if request.Operation == document.Delete {
+		return nil
+	}
+	if err := request.ResolveSentinels(now); err != nil {
+		return err
+	}
+	if stamp := util.Env().Stamp; stamp.Stamps(request.Collection) {
+		var principal string
+		if p, ok := sender.(document.Principal); ok {
+			principal = p.Principal()
 		}
+		request.Stamp(stamp.CreatedField, stamp.UpdatedField, stamp.AuthorField, principal, now)
+	}
+	return nil
+}
+
+// Copies the created field of the replaced document into the replacement of a stamped collection,
+// as replacements drop the created field sent by clients
+func preserveCreated(request *document.DocumentRequest, filter bson.M) error {
+	stamp := util.Env().Stamp
+	if request.Operation != document.Replace || stamp.CreatedField == "" || !stamp.Stamps(request.Collection) {
+		return nil
+	}
+	span := call(*request, "findOne")
+	defer span.End()
+	opts := options.FindOne().SetProjection(bson.M{stamp.CreatedField: 1})
+	var existing bson.M
+	err := database.Collection(request.Collection).FindOne(context.Background(), filter, opts).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		// Nothing is replaced
+		return nil
+	}
+	if err != nil {
+		span.Fail(err)
+		return err
+	}
+	if created, ok := existing[stamp.CreatedField]; ok {
+		request.Value[stamp.CreatedField] = created
+	}
+	return nil
+}
+
+// Validates the request value against the collection schema (if any)
+func validate(request document.DocumentRequest) *document.DocumentError {
+	s, ok := schemas[request.Collection]
+	if !ok {
+		return nil
+	}
+
+	var errors []document.FieldError
+	switch request.Operation {
+	case document.Insert, document.Replace:
+		errors = s.Validate(request.Value)
+	case document.Update:
+		errors = s.ValidateUpdate(request.Value)
+	}
+
+	if len(errors) == 0 {
+		return nil
+	}
+	return &document.DocumentError{
+		Code:    document.ValidationFailed,
+		Message: "document failed validation for collection '" + request.Collection + "'",
+		Fields:  errors,
+	}
+}
+
+// Publishes an error back to the sender in place of a snapshot
+func publishError(sender interface{}, request document.DocumentRequest, err *document.DocumentError) {
+	event.Logger(sender).Debug("request failed", append(request.LogAttrs(), "code", err.Code, "error", err.Message)...)
+	if request.OnDisconnect {
+		return
+	}
+	snapshot := bson.M{
+		"_uid":       request.Uid,
+		"_operation": request.Operation,
+		"error":      err,
 	}
+	publish(sender, request.Traceparent, snapshot)
+}
+
+// Starts the span of a database call made for the request
+func call(request document.DocumentRequest, operation string) *trace.Span {
+	return trace.Continue(trace.Parse(request.Traceparent), "mongo."+operation, trace.Client,
+		"db.system", "mongodb", "db.name", env.Database.Db, "db.mongodb.collection", request.Collection, "db.operation", operation)
+}
+
+// Answers a request the database failed
+func databaseError(sender interface{}, request document.DocumentRequest, err error) {
+	event.Logger(sender).Error("database error", append(request.LogAttrs(), "error", err)...)
+	databaseErrors.With(collectionLabel(request.Collection), request.Scope.String()).Inc()
+	publishError(sender, request, document.NewDocumentError(document.DatabaseError, err))
 }
 
-func publish(sender interface{}, doc bson.M) {
+// Publishes a snapshot to the sender, traced under the trace context (if any)
+func publish(sender interface{}, traceparent string, doc bson.M) {
 	snapshot := document.DocumentSnapshot{
-		Value: doc,
+		Value:       doc,
+		Traceparent: traceparent,
 	}
-	go event.Publish(event.Websocket, sender, snapshot)
+	buses.Snapshots.Publish(event.Snapshot, sender, snapshot)
 }
 
-func _findOne(sender interface{}, request document.DocumentRequest) {
+func _findOne(sender interface{}, request document.DocumentRequest, filter bson.M) {
 	context := context.Background()
 	collection := database.Collection(request.Collection)
-	result := collection.FindOne(context, request.Filter())
+	span := call(request, "findOne")
+	result := collection.FindOne(context, filter)
+	if result.Err() != mongo.ErrNoDocuments {
+		span.Fail(result.Err())
+	}
+	span.End()
 
 	doc := bson.M{}
 	if result.Err() == mongo.ErrNoDocuments {
@@ -129,7 +448,8 @@ func _findOne(sender interface{}, request document.DocumentRequest) {
 		}
 	} else {
 		if err := result.Decode(&doc); err != nil {
-			panic(err)
+			databaseError(sender, request, err)
+			return
 		}
 	}
 
@@ -138,20 +458,25 @@ func _findOne(sender interface{}, request document.DocumentRequest) {
 		"_operation": request.Operation,
 		"value":      doc,
 	}
-	publish(sender, snapshot)
+	publish(sender, request.Traceparent, snapshot)
 }
 
-func _find(sender interface{}, request document.DocumentRequest) {
+func _find(sender interface{}, request document.DocumentRequest, filter bson.M) {
 
 	context := context.Background()
 	collection := database.Collection(request.Collection)
-	cursor, err := collection.Find(context, bson.M{})
-	if err != nil {
-		log.Fatal("💩 [Unable to open collection]: ", err)
-	}
+	span := call(request, "find")
 	var results []bson.M
-	if err = cursor.All(context, &results); err != nil {
-		log.Fatal("💩 [Unable to open cursor]: ", err)
+	cursor, err := collection.Find(context, filter)
+	if err == nil {
+		err = cursor.All(context, &results)
+	}
+	span.Fail(err)
+	span.SetAttributes("db.documents", len(results))
+	span.End()
+	if err != nil {
+		databaseError(sender, request, err)
+		return
 	}
 
 	if request.OnDisconnect {
@@ -163,15 +488,19 @@ func _find(sender interface{}, request document.DocumentRequest) {
 		"_operation": request.Operation,
 		"value":      results,
 	}
-	publish(sender, snapshot)
+	publish(sender, request.Traceparent, snapshot)
 }
 
 func _insert(sender interface{}, request document.DocumentRequest) {
 	collection := database.Collection(request.Collection)
+	span := call(request, "insertOne")
 	result, err := collection.InsertOne(context.Background(), request.Value)
+	span.Fail(err)
+	span.End()
 
 	if err != nil {
-		log.Fatal("💩 [Unable to insert]: ", err)
+		databaseError(sender, request, err)
+		return
 	}
 
 	if request.OnDisconnect {
@@ -185,14 +514,18 @@ func _insert(sender interface{}, request document.DocumentRequest) {
 		"_operation": request.Operation,
 		"value":      request.Value,
 	}
-	publish(sender, snapshot)
+	publish(sender, request.Traceparent, snapshot)
 }
 
-func _update(sender interface{}, request document.DocumentRequest) {
+func _update(sender interface{}, request document.DocumentRequest, filter bson.M) {
 	collection := database.Collection(request.Collection)
-	result, err := collection.UpdateOne(context.Background(), request.Filter(), request.Value)
+	span := call(request, "updateOne")
+	result, err := collection.UpdateOne(context.Background(), filter, request.Value)
+	span.Fail(err)
+	span.End()
 	if err != nil {
-		log.Fatal("💩 [Unable to update]: ", err)
+		databaseError(sender, request, err)
+		return
 	}
 	if request.OnDisconnect {
 		return
@@ -204,15 +537,19 @@ func _update(sender interface{}, request document.DocumentRequest) {
 		"_operation": request.Operation,
 		"value":      request.Value,
 	}
-	publish(sender, snapshot)
+	publish(sender, request.Traceparent, snapshot)
 }
 
-func _delete(sender interface{}, request document.DocumentRequest) {
+func _delete(sender interface{}, request document.DocumentRequest, filter bson.M) {
 	collection := database.Collection(request.Collection)
-	_, err := collection.DeleteOne(context.Background(), request.Filter())
+	span := call(request, "deleteOne")
+	_, err := collection.DeleteOne(context.Background(), filter)
+	span.Fail(err)
+	span.End()
 
 	if err != nil {
-		log.Fatal("💩 [Unable to delete]: ", err)
+		databaseError(sender, request, err)
+		return
 	}
 
 	if request.OnDisconnect {
@@ -225,14 +562,18 @@ func _delete(sender interface{}, request document.DocumentRequest) {
 		"value":      request.Query,
 	}
 
-	publish(sender, snapshot)
+	publish(sender, request.Traceparent, snapshot)
 }
 
-func _replace(sender interface{}, request document.DocumentRequest) {
+func _replace(sender interface{}, request document.DocumentRequest, filter bson.M) {
 	collection := database.Collection(request.Collection)
-	result, err := collection.ReplaceOne(context.Background(), request.Filter(), request.Value)
+	span := call(request, "replaceOne")
+	result, err := collection.ReplaceOne(context.Background(), filter, request.Value)
+	span.Fail(err)
+	span.End()
 	if err != nil {
-		log.Fatal("💩 [Unable to replace]: ", err)
+		databaseError(sender, request, err)
+		return
 	}
 
 	if request.OnDisconnect {
@@ -246,62 +587,16 @@ func _replace(sender interface{}, request document.DocumentRequest) {
 		"_operation": request.Operation,
 		"value":      request.Value,
 	}
-	publish(sender, snapshot)
+	publish(sender, request.Traceparent, snapshot)
 }
 
-// Starts watching (observing) a change stream
+// Starts watching (observing) a change stream shared with every other watcher of the same events
 func _watch(sender interface{}, request document.DocumentRequest) {
-
-	var matchingPipeline = bson.D{
-		{
-			"$match", bson.D{
-			{"operationType", request.Operation.String()},
-		},
-		},
-	}
-	collection := database.Collection(request.Collection)
-	collectionStream, err := collection.Watch(context.TODO(), mongo.Pipeline{matchingPipeline})
-
+	span := call(request, "watch")
+	err := streams.watch(sender, request)
+	span.Fail(err)
+	span.End()
 	if err != nil {
-		log.Fatal("💩 [Unable to watch]: ", err)
-	}
-
-	streamContext, _ := context.WithCancel(context.Background())
-	go _watchChangeStream(sender, request, streamContext, collectionStream)
-}
-
-func _watchChangeStream(sender interface{}, request document.DocumentRequest, context context.Context, stream *mongo.ChangeStream) {
-	defer stream.Close(context)
-	for stream.Next(context) {
-		var data bson.M
-		if err := stream.Decode(&data); err != nil {
-			panic(err)
-		}
-
-		key, _ := data["documentKey"].(bson.M)
-		doc, _ := data["fullDocument"].(bson.M)
-
-		if doc == nil {
-			switch request.Operation {
-			case document.Update, document.Replace:
-				request.Query["_id"] = key["_id"].(primitive.ObjectID).Hex()
-				_findOne(sender, request)
-				return
-			case document.Delete:
-				doc = bson.M{
-					"_id": key["_id"],
-				}
-				break
-			default:
-				break
-			}
-		}
-
-		snapshot := bson.M{
-			"_uid":       request.Uid,
-			"_operation": request.Operation,
-			"value":      doc,
-		}
-		publish(sender, snapshot)
+		databaseError(sender, request, err)
 	}
 }
@@ -0,0 +1,39 @@
+package mongo
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.springy.io/internal/presence"
+)
+
+// Persists presence channel members to a collection, one document per channel member
+type presenceStore struct {
+	collection string
+}
+
+// Returns the presence store for the configured collection, or nil if presence is not persisted
+func PresenceStore() presence.Store {
+	if env.Database.PresenceCollection == "" {
+		return nil
+	}
+	return &presenceStore{collection: env.Database.PresenceCollection}
+}
+
+func (s *presenceStore) Save(channel string, member presence.Member) error {
+	doc := bson.M{
+		"_id":      channel + "/" + member.ID,
+		"channel":  channel,
+		"member":   member.ID,
+		"meta":     member.Meta,
+		"joinedAt": member.JoinedAt,
+	}
+	opts := options.Replace().SetUpsert(true)
+	_, err := database.Collection(s.collection).ReplaceOne(context.Background(), bson.M{"_id": doc["_id"]}, doc, opts)
+	return err
+}
+
+func (s *presenceStore) Remove(channel string, id string) error {
+	_, err := database.Collection(s.collection).DeleteOne(context.Background(), bson.M{"_id": channel + "/" + id})
+	return err
+}
@@ -0,0 +1,318 @@
+package mongo
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/trace"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var streams = newMultiplexer(openStream)
+
+// How long departed senders and early cancels are remembered, refusing the watches registered late
+const tombstoneTTL = time.Minute
+
+// Returns the number of open change streams
+func (m *multiplexer) count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.streams)
+}
+
+// Identifies a shared change stream
+type streamKey struct {
+	collection string
+	pipeline   string
+}
+
+// Identifies a single watch request of a sender
+type watcherKey struct {
+	sender interface{}
+	uid    string
+}
+
+// A change stream shared by every watcher of the same collection and pipeline
+type stream struct {
+	key      streamKey
+	cancel   context.CancelFunc
+	watchers map[watcherKey]document.DocumentRequest
+}
+
+// The change stream read by a stream, a *mongo.ChangeStream
+type changeStream interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// Opens the change stream of a collection filtered by the pipeline
+func openStream(collection string, pipeline mongo.Pipeline) (changeStream, error) {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	changeStream, err := database.Collection(collection).Watch(context.Background(), pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	return changeStream, nil
+}
+
+// Multiplexes change streams, opening one stream per (collection, pipeline) and fanning its
+// events out to every watcher. Streams are reference counted and closed when the last watcher leaves.
+type multiplexer struct {
+	mutex   sync.Mutex
+	streams map[streamKey]*stream
+
+	// Opens the change streams, without the lock held as it is a round trip to the database
+	open func(collection string, pipeline mongo.Pipeline) (changeStream, error)
+
+	// The senders which left, and the watches cancelled before they were registered. Watches are
+	// handled concurrently with disconnects and cancels, so their late registrations are refused.
+	departed  map[interface{}]time.Time
+	cancelled map[watcherKey]time.Time
+	swept     time.Time
+}
+
+func newMultiplexer(open func(collection string, pipeline mongo.Pipeline) (changeStream, error)) *multiplexer {
+	return &multiplexer{
+		streams:   make(map[streamKey]*stream),
+		open:      open,
+		departed:  make(map[interface{}]time.Time),
+		cancelled: make(map[watcherKey]time.Time),
+	}
+}
+
+// Adds a watcher, opening the change stream if it is the first watcher
+func (m *multiplexer) watch(sender interface{}, request document.DocumentRequest) error {
+	pipeline := mongo.Pipeline{
+		bson.D{
+			{Key: "$match", Value: bson.D{
+				{Key: "operationType", Value: request.Operation.String()},
+			}},
+		},
+	}
+	encoded, err := bson.MarshalExtJSON(bson.M{"pipeline": pipeline}, true, false)
+	if err != nil {
+		return err
+	}
+	key := streamKey{collection: request.Collection, pipeline: string(encoded)}
+
+	if m.join(key, sender, request) {
+		return nil
+	}
+	changeStream, err := m.open(request.Collection, pipeline)
+	if err != nil {
+		return err
+	}
+
+	// The sender may have left (or cancelled the watch) meanwhile, or another watcher may have
+	// opened the same stream, which is shared instead
+	m.mutex.Lock()
+	if m.refuses(watcherKey{sender, request.Uid}) {
+		m.mutex.Unlock()
+		changeStream.Close(context.Background())
+		return nil
+	}
+	m.replace(watcherKey{sender, request.Uid}, key)
+	if s, ok := m.streams[key]; ok {
+		s.watchers[watcherKey{sender, request.Uid}] = request
+		m.mutex.Unlock()
+		changeStream.Close(context.Background())
+		return nil
+	}
+	defer m.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &stream{
+		key:      key,
+		cancel:   cancel,
+		watchers: map[watcherKey]document.DocumentRequest{{sender, request.Uid}: request},
+	}
+	m.streams[key] = s
+	slog.Info("opened change stream", "collection", request.Collection, "operation", request.Operation.String())
+
+	go m.run(ctx, s, changeStream)
+	return nil
+}
+
+// Adds the watcher to the stream of the key, returning false if it is not open. Returns true
+// without adding it if the watch is refused.
+func (m *multiplexer) join(key streamKey, sender interface{}, request document.DocumentRequest) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.refuses(watcherKey{sender, request.Uid}) {
+		return true
+	}
+	s, ok := m.streams[key]
+	if ok {
+		m.replace(watcherKey{sender, request.Uid}, key)
+		s.watchers[watcherKey{sender, request.Uid}] = request
+	}
+	return ok
+}
+
+// Removes the watcher from the streams other than the stream of the key, as a watch replaces the
+// watch of the same uid. The caller must hold the lock.
+func (m *multiplexer) replace(k watcherKey, key streamKey) {
+	for other, s := range m.streams {
+		if _, ok := s.watchers[k]; ok && other != key {
+			delete(s.watchers, k)
+			m.release(s)
+		}
+	}
+}
+
+// Returns true if the watch is registered after its sender left or its cancellation, forgetting
+// the cancellation. The caller must hold the lock.
+func (m *multiplexer) refuses(k watcherKey) bool {
+	if _, ok := m.departed[k.sender]; ok {
+		slog.Debug("watch refused, the sender left", "uid", k.uid)
+		return true
+	}
+	if _, ok := m.cancelled[k]; ok {
+		delete(m.cancelled, k)
+		slog.Debug("watch refused, cancelled", "uid", k.uid)
+		return true
+	}
+	return false
+}
+
+// Forgets the departed senders and cancellations remembered long enough, at most once per
+// tombstone TTL. The caller must hold the lock.
+func (m *multiplexer) sweep(now time.Time) {
+	if now.Sub(m.swept) < tombstoneTTL {
+		return
+	}
+	m.swept = now
+	for sender, t := range m.departed {
+		if now.Sub(t) >= tombstoneTTL {
+			delete(m.departed, sender)
+		}
+	}
+	for k, t := range m.cancelled {
+		if now.Sub(t) >= tombstoneTTL {
+			delete(m.cancelled, k)
+		}
+	}
+}
+
+// Removes every watcher of the sender, closing streams left without watchers, and refuses the
+// watches of the sender registered later
+func (m *multiplexer) unwatch(sender interface{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+	m.departed[sender] = now
+
+	for _, s := range m.streams {
+		for k := range s.watchers {
+			if k.sender == sender {
+				delete(s.watchers, k)
+			}
+		}
+		m.release(s)
+	}
+}
+
+// Removes a single watcher, closing the stream if it was the last watcher. A watch which is not
+// registered yet is refused once it is.
+func (m *multiplexer) cancel(sender interface{}, uid string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+	k := watcherKey{sender, uid}
+	found := false
+	for _, s := range m.streams {
+		if _, ok := s.watchers[k]; ok {
+			delete(s.watchers, k)
+			m.release(s)
+			found = true
+		}
+	}
+	if !found {
+		m.cancelled[k] = now
+	}
+}
+
+// Closes the stream if it has no watchers left. The caller must hold the lock.
+func (m *multiplexer) release(s *stream) {
+	if len(s.watchers) > 0 {
+		return
+	}
+	delete(m.streams, s.key)
+	s.cancel()
+	slog.Info("closed change stream", "collection", s.key.collection)
+}
+
+// Returns the watchers of the stream
+func (m *multiplexer) watchers(s *stream) map[watcherKey]document.DocumentRequest {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	watchers := make(map[watcherKey]document.DocumentRequest, len(s.watchers))
+	for k, v := range s.watchers {
+		watchers[k] = v
+	}
+	return watchers
+}
+
+// Reads the change stream until it is cancelled, fanning each change out to the watchers
+func (m *multiplexer) run(ctx context.Context, s *stream, changeStream changeStream) {
+	defer changeStream.Close(context.Background())
+
+	for changeStream.Next(ctx) {
+		var data bson.M
+		if err := changeStream.Decode(&data); err != nil {
+			slog.Error("unable to decode change", "collection", s.key.collection, "error", err)
+			continue
+		}
+
+		key, _ := data["documentKey"].(bson.M)
+		doc, _ := data["fullDocument"].(bson.M)
+		if doc == nil {
+			// Deleted documents (or documents deleted before the update lookup)
+			doc = bson.M{
+				"_id": key["_id"],
+			}
+		}
+
+		// Each change is traced on its own, from the stream to every watcher
+		watchers := m.watchers(s)
+		span := trace.Start(trace.SpanContext{}, "mongo.change", trace.Consumer,
+			"db.mongodb.collection", s.key.collection, "watchers", len(watchers))
+		for k, request := range watchers {
+			snapshot := bson.M{
+				"_uid":       request.Uid,
+				"_operation": request.Operation,
+				"value":      doc,
+			}
+			publish(k.sender, span.Traceparent(""), snapshot)
+		}
+		span.End()
+	}
+
+	if err := changeStream.Err(); err != nil && ctx.Err() == nil {
+		slog.Error("change stream failed", "collection", s.key.collection, "error", err)
+		databaseErrors.With(collectionLabel(s.key.collection), document.Watch.String()).Inc()
+		// Drop the failed stream so the next watch reopens it, and let the watchers know
+		m.mutex.Lock()
+		if m.streams[s.key] == s {
+			delete(m.streams, s.key)
+		}
+		m.mutex.Unlock()
+		s.cancel()
+
+		for k, request := range m.watchers(s) {
+			publishError(k.sender, request, document.NewDocumentError(document.DatabaseError, err))
+		}
+	}
+}
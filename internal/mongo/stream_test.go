@@ -0,0 +1,187 @@
+package mongo
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.springy.io/api/document"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A change stream without changes, read until cancelled
+type fakeStream struct {
+	closed chan struct{}
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{closed: make(chan struct{})}
+}
+
+func (f *fakeStream) Next(ctx context.Context) bool {
+	<-ctx.Done()
+	return false
+}
+
+func (f *fakeStream) Decode(val interface{}) error {
+	return nil
+}
+
+func (f *fakeStream) Err() error {
+	return nil
+}
+
+func (f *fakeStream) Close(ctx context.Context) error {
+	close(f.closed)
+	return nil
+}
+
+// Waits for the stream to be closed
+func (f *fakeStream) wait(t *testing.T) {
+	select {
+	case <-f.closed:
+	case <-time.After(time.Second):
+		t.Fatal("stream not closed")
+	}
+}
+
+func TestMultiplexer(t *testing.T) {
+
+	var opened []*fakeStream
+	m := newMultiplexer(func(collection string, pipeline mongo.Pipeline) (changeStream, error) {
+		s := newFakeStream()
+		opened = append(opened, s)
+		return s, nil
+	})
+	insert := func(uid string) document.DocumentRequest {
+		return document.DocumentRequest{Uid: uid, Scope: document.Watch, Collection: "todos", Operation: document.Insert}
+	}
+
+	// Watchers of the same collection and operation share a stream
+	assert.Nil(t, m.watch("a", insert("1")))
+	assert.Nil(t, m.watch("b", insert("1")))
+	assert.Len(t, opened, 1)
+	assert.Equal(t, 1, m.count())
+
+	// The last watcher leaving closes the stream
+	m.cancel("a", "1")
+	assert.Equal(t, 1, m.count())
+	m.cancel("b", "1")
+	assert.Equal(t, 0, m.count())
+	opened[0].wait(t)
+
+	// So does the disconnection of the last sender
+	assert.Nil(t, m.watch("a", insert("1")))
+	assert.Nil(t, m.watch("a", insert("2")))
+	m.unwatch("a")
+	assert.Equal(t, 0, m.count())
+	opened[1].wait(t)
+
+	// A watch replaces the watch of the same uid
+	assert.Nil(t, m.watch("b", insert("1")))
+	update := insert("1")
+	update.Operation = document.Update
+	assert.Nil(t, m.watch("b", update))
+	assert.Equal(t, 1, m.count())
+	opened[2].wait(t)
+	m.unwatch("b")
+	assert.Equal(t, 0, m.count())
+}
+
+func TestMultiplexerOpen(t *testing.T) {
+
+	var opening sync.WaitGroup
+	opening.Add(2)
+	release := make(chan struct{})
+	var streams []*fakeStream
+	var mutex sync.Mutex
+	var opened atomic.Int32
+	m := newMultiplexer(func(collection string, pipeline mongo.Pipeline) (changeStream, error) {
+		s := newFakeStream()
+		mutex.Lock()
+		streams = append(streams, s)
+		mutex.Unlock()
+		opening.Done()
+		<-release
+		opened.Add(1)
+		return s, nil
+	})
+	request := document.DocumentRequest{Uid: "1", Scope: document.Watch, Collection: "todos", Operation: document.Insert}
+
+	// Both watchers open a stream concurrently, without holding the lock
+	var watching sync.WaitGroup
+	for _, sender := range []string{"a", "b"} {
+		watching.Add(1)
+		go func() {
+			defer watching.Done()
+			assert.Nil(t, m.watch(sender, request))
+		}()
+	}
+	opening.Wait()
+	m.cancel("c", "1")
+	assert.Equal(t, 0, m.count())
+
+	// One of the streams is closed, both watchers sharing the other
+	close(release)
+	watching.Wait()
+	assert.Equal(t, int32(2), opened.Load())
+	assert.Equal(t, 1, m.count())
+	closed := 0
+	for _, s := range streams {
+		select {
+		case <-s.closed:
+			closed++
+		default:
+		}
+	}
+	assert.Equal(t, 1, closed)
+
+	m.unwatch("a")
+	assert.Equal(t, 1, m.count())
+	m.unwatch("b")
+	assert.Equal(t, 0, m.count())
+}
+
+func TestMultiplexerLate(t *testing.T) {
+
+	opening := make(chan *fakeStream)
+	release := make(chan struct{})
+	m := newMultiplexer(func(collection string, pipeline mongo.Pipeline) (changeStream, error) {
+		s := newFakeStream()
+		opening <- s
+		<-release
+		return s, nil
+	})
+	request := document.DocumentRequest{Uid: "1", Scope: document.Watch, Collection: "todos", Operation: document.Insert}
+	late := func(sender string, leave func()) *fakeStream {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.Nil(t, m.watch(sender, request))
+		}()
+		s := <-opening
+		leave()
+		release <- struct{}{}
+		<-done
+		return s
+	}
+
+	// A watch still opening when its sender disconnects is refused, closing its stream
+	s := late("a", func() { m.unwatch("a") })
+	assert.Equal(t, 0, m.count())
+	s.wait(t)
+	assert.Nil(t, m.watch("a", request))
+	assert.Equal(t, 0, m.count())
+
+	// So is a watch cancelled while opening, only once
+	s = late("b", func() { m.cancel("b", "1") })
+	assert.Equal(t, 0, m.count())
+	s.wait(t)
+	go func() { <-opening; release <- struct{}{} }()
+	assert.Nil(t, m.watch("b", request))
+	assert.Equal(t, 1, m.count())
+	m.unwatch("b")
+	assert.Equal(t, 0, m.count())
+}
@@ -0,0 +1,317 @@
+// Package msgpack implements the subset of MessagePack (https://msgpack.org) needed to carry
+// json-like values: nil, booleans, numbers, strings, binary, arrays and maps with string keys.
+package msgpack
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// ErrShort is returned when the data ends in the middle of a value
+var ErrShort = errors.New("msgpack: unexpected end of data")
+
+// The largest length accepted for strings, binaries, arrays and maps
+const maxLength = 64 << 20
+
+// Marshal encodes a json-like value. Map keys are sorted so the output is deterministic.
+func Marshal(v interface{}) ([]byte, error) {
+	return appendValue(nil, v)
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return appendInt(b, int64(v)), nil
+	case int32:
+		return appendInt(b, int64(v)), nil
+	case int64:
+		return appendInt(b, v), nil
+	case uint64:
+		if v <= math.MaxInt64 {
+			return appendInt(b, int64(v)), nil
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), v), nil
+	case float32:
+		return binary.BigEndian.AppendUint32(append(b, 0xca), math.Float32bits(v)), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v)), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendInt(b, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendValue(b, f)
+	case string:
+		return append(appendLength(b, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb), v...), nil
+	case []byte:
+		return append(appendLength(b, len(v), 0, 0, 0xc4, 0xc5, 0xc6), v...), nil
+	case []interface{}:
+		b = appendLength(b, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		var err error
+		for _, item := range v {
+			if b, err = appendValue(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = appendLength(b, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		var err error
+		for _, k := range keys {
+			b, _ = appendValue(b, k)
+			if b, err = appendValue(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+// Appends an integer in its most compact form
+func appendInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 127:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+}
+
+// Appends a length header, using the fix format when the length is small enough and the 8 (when
+// defined), 16 or 32 bit formats otherwise
+func appendLength(b []byte, n int, fix byte, fixMax int, f8, f16, f32 byte) []byte {
+	switch {
+	case fix != 0 && n <= fixMax:
+		return append(b, fix|byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		return append(b, f8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, f16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, f32), uint32(n))
+}
+
+// Unmarshal decodes a single value. Integers decode as int64 (or uint64 when too large), floats as
+// float64, strings as string, binaries as []byte, arrays as []interface{} and maps as
+// map[string]interface{}.
+func Unmarshal(data []byte) (interface{}, error) {
+	d := decoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.offset != len(data) {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(data)-d.offset)
+	}
+	return v, nil
+}
+
+// The maximum nesting of arrays and maps
+const maxDepth = 100
+
+type decoder struct {
+	data   []byte
+	offset int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.offset < n {
+		return nil, ErrShort
+	}
+	b := d.data[d.offset : d.offset+n]
+	d.offset += n
+	return b, nil
+}
+
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *decoder) length(size int) (int, error) {
+	n, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > maxLength {
+		return 0, fmt.Errorf("msgpack: length %d is too large", n)
+	}
+	return int(n), nil
+}
+
+func (d *decoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("msgpack: maximum depth exceeded")
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xe0 == 0xa0:
+		return d.string(int(t & 0x1f))
+	case t&0xf0 == 0x90:
+		return d.array(int(t&0x0f), depth)
+	case t&0xf0 == 0x80:
+		return d.object(int(t&0x0f), depth)
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return u, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend from the encoded size
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.string(n)
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), bin...), nil
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(n, depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", t)
+}
+
+func (d *decoder) string(n int) (string, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *decoder) array(n int, depth int) ([]interface{}, error) {
+	if n > len(d.data)-d.offset {
+		return nil, ErrShort
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *decoder) object(n int, depth int) (map[string]interface{}, error) {
+	if n > len(d.data)-d.offset {
+		return nil, ErrShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case string:
+			m[k] = v
+		case int64:
+			m[strconv.FormatInt(k, 10)] = v
+		default:
+			return nil, fmt.Errorf("msgpack: unsupported map key %T", k)
+		}
+	}
+	return m, nil
+}
+
+// ArrayHeader returns the header of an array of n values, which are appended to it encoded
+func ArrayHeader(n int) []byte {
+	return appendLength(nil, n, 0x90, 15, 0, 0xdc, 0xdd)
+}
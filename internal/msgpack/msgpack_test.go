@@ -0,0 +1,81 @@
+package msgpack_test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/msgpack"
+	"math"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+
+	value := map[string]interface{}{
+		"nil":    nil,
+		"true":   true,
+		"false":  false,
+		"small":  int64(7),
+		"neg":    int64(-7),
+		"int8":   int64(-100),
+		"int16":  int64(1000),
+		"int32":  int64(-100000),
+		"int64":  int64(math.MaxInt64),
+		"uint64": uint64(math.MaxUint64),
+		"float":  3.25,
+		"string": "Foo",
+		"long":   string(make([]byte, 300)),
+		"bin":    []byte{1, 2, 3},
+		"array":  []interface{}{int64(1), "two", []interface{}{}},
+		"map":    map[string]interface{}{"a": map[string]interface{}{}},
+	}
+
+	b, err := msgpack.Marshal(value)
+	assert.Nil(t, err)
+	decoded, err := msgpack.Unmarshal(b)
+	assert.Nil(t, err)
+	assert.Equal(t, value, decoded)
+}
+
+func TestEncoding(t *testing.T) {
+
+	// Reference encodings from the specification
+	for _, c := range []struct {
+		value interface{}
+		bytes []byte
+	}{
+		{nil, []byte{0xc0}},
+		{int64(-1), []byte{0xff}},
+		{int64(128), []byte{0xd1, 0x00, 0x80}},
+		{"a", []byte{0xa1, 'a'}},
+		{json.Number("1.5"), []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{[]interface{}{true}, []byte{0x91, 0xc3}},
+		{map[string]interface{}{"b": int64(2), "a": int64(1)}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}},
+	} {
+		b, err := msgpack.Marshal(c.value)
+		assert.Nil(t, err)
+		assert.Equal(t, c.bytes, b)
+	}
+
+	// Unsigned formats and float32
+	v, err := msgpack.Unmarshal([]byte{0xcd, 0x01, 0x00})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(256), v)
+	v, err = msgpack.Unmarshal([]byte{0xca, 0x3f, 0xc0, 0x00, 0x00})
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, v)
+}
+
+func TestInvalid(t *testing.T) {
+
+	_, err := msgpack.Unmarshal([]byte{0x92, 0x01})
+	assert.Equal(t, msgpack.ErrShort, err)
+
+	_, err = msgpack.Unmarshal([]byte{0x01, 0x02})
+	assert.NotNil(t, err)
+
+	_, err = msgpack.Unmarshal([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})
+	assert.NotNil(t, err)
+
+	_, err = msgpack.Marshal(struct{}{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,135 @@
+package presence
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/event"
+	"go.springy.io/internal/rules"
+	"log/slog"
+	"time"
+)
+
+// Store persists channel members (optional)
+type Store interface {
+	Save(channel string, member Member) error
+	Remove(channel string, id string) error
+}
+
+// identified is implemented by senders with a connection identifier
+type identified interface {
+	ID() string
+}
+
+// Runs the presence subsystem, tracking channel members and pushing presence diffs to the other
+// members on joins, leaves and disconnects. Joins are authorized by the rules, and the store may be nil.
+//
+// The members connected to other nodes are tracked from the imported requests and disconnects,
+// so that every node pushes the diffs to its own clients. Only the node a member is connected to
+// answers its errors and persists it.
+func Run(buses *event.Buses, store Store, r rules.Authorizer) {
+	tracker := NewTracker()
+
+	requests := buses.Requests.Subscribe(event.PresenceRequest)
+	disconnects := buses.Connections.Subscribe(event.Disconnected)
+
+	for {
+		select {
+		case e := <-disconnects.C():
+			channels, diffs := tracker.Disconnect(e.Sender)
+			if sender, ok := e.Sender.(identified); ok && store != nil && !e.Remote() {
+				for _, channel := range channels {
+					remove(store, channel, sender.ID())
+				}
+			}
+			notify(buses, diffs)
+		case e := <-requests.C():
+			request := e.Data
+			sender, ok := e.Sender.(identified)
+			if !ok || request.Channel == "" {
+				continue
+			}
+
+			switch request.Scope {
+			case document.Join:
+				var principal string
+				if p, ok := e.Sender.(document.Principal); ok {
+					principal = p.Principal()
+				}
+				if !r.Allow(rules.Join, request.Channel, principal) {
+					if !e.Remote() {
+						event.RequestLogger(e).Info("join denied")
+						forbidden(buses, e.Sender, request)
+					}
+					continue
+				}
+				member, diffs := tracker.Join(e.Sender, sender.ID(), request.Uid, request.Channel, request.Value, time.Now())
+				if store != nil && !e.Remote() {
+					if err := store.Save(request.Channel, member); err != nil {
+						event.RequestLogger(e).Error("unable to save presence", "error", err)
+					}
+				}
+				notify(buses, diffs)
+			case document.Leave:
+				if _, diffs, ok := tracker.Leave(e.Sender, request.Channel); ok {
+					if store != nil && !e.Remote() {
+						remove(store, request.Channel, sender.ID())
+					}
+					notify(buses, diffs)
+				}
+			}
+		}
+	}
+}
+
+// Replies to a sender whose join was not allowed
+func forbidden(buses *event.Buses, sender interface{}, request document.DocumentRequest) {
+	snapshot := document.DocumentSnapshot{
+		Value: bson.M{
+			"_uid":     request.Uid,
+			"_channel": request.Channel,
+			"error": &document.DocumentError{
+				Code:    document.Forbidden,
+				Message: "join is not allowed on channel '" + request.Channel + "'",
+			},
+		},
+	}
+	buses.Snapshots.Publish(event.Snapshot, sender, snapshot)
+}
+
+func remove(store Store, channel, id string) {
+	if err := store.Remove(channel, id); err != nil {
+		slog.Error("unable to remove presence", "channel", channel, "connection", id, "error", err)
+	}
+}
+
+// Pushes the presence diffs to their recipients connected to this node
+func notify(buses *event.Buses, diffs []Diff) {
+	for _, diff := range diffs {
+		if _, remote := diff.Recipient.(event.RemoteSender); remote {
+			// Notified by their own node
+			continue
+		}
+		value := bson.M{}
+		if diff.Members != nil {
+			value["members"] = diff.Members
+		}
+		if diff.Joined != nil {
+			value["joined"] = diff.Joined
+		}
+		if diff.Updated != nil {
+			value["updated"] = diff.Updated
+		}
+		if diff.Left != nil {
+			value["left"] = diff.Left
+		}
+
+		snapshot := document.DocumentSnapshot{
+			Value: bson.M{
+				"_uid":     diff.Uid,
+				"_channel": diff.Channel,
+				"value":    value,
+			},
+		}
+		buses.Snapshots.Publish(event.Snapshot, diff.Recipient, snapshot)
+	}
+}
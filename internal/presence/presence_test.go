@@ -0,0 +1,79 @@
+package presence_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/event"
+	"go.springy.io/internal/presence"
+	"go.springy.io/internal/rules"
+	"testing"
+	"time"
+)
+
+func (c *TestClient) ID() string {
+	return c.id
+}
+
+// A diff pushed to a member
+type pushed struct {
+	recipient interface{}
+	value     bson.M
+}
+
+func TestRunNodes(t *testing.T) {
+
+	network := event.NewLocalNetwork()
+	topics := []event.Topic{event.PubSubRequest, event.PresenceRequest, event.Disconnected}
+	nodes := map[string]*event.Buses{}
+	snapshots := map[string]*event.Subscription[document.DocumentSnapshot]{}
+	for _, node := range []string{"a", "b"} {
+		buses := event.NewBuses(node, event.Options{Buffer: 16})
+		go presence.Run(buses, nil, rules.NewCurrent(nil))
+		// Wait for the subsystem to subscribe before bridging
+		for buses.Requests.Publish(event.PresenceRequest, nil, document.DocumentRequest{}) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		closeBridge, err := buses.Bridge(network.Transport(), topics, topics)
+		assert.Nil(t, err)
+		defer closeBridge()
+		nodes[node] = buses
+		snapshots[node] = buses.Snapshots.Subscribe(event.Snapshot)
+	}
+	receive := func(node string) []pushed {
+		var diffs []pushed
+		for {
+			select {
+			case e := <-snapshots[node].C():
+				diffs = append(diffs, pushed{e.Sender, e.Data.Value["value"].(bson.M)})
+			case <-time.After(50 * time.Millisecond):
+				return diffs
+			}
+		}
+	}
+	alice, bob := &TestClient{id: "a1"}, &TestClient{id: "b1"}
+
+	// Members learn of the members connected to the other nodes, from their own node only
+	nodes["a"].Requests.Publish(event.PresenceRequest, alice, document.DocumentRequest{Uid: "1", Scope: document.Join, Channel: "room"})
+	diffs := receive("a")
+	assert.Len(t, diffs, 1)
+	assert.Equal(t, alice, diffs[0].recipient)
+	assert.Empty(t, receive("b"))
+
+	nodes["b"].Requests.Publish(event.PresenceRequest, bob, document.DocumentRequest{Uid: "2", Scope: document.Join, Channel: "room"})
+	diffs = receive("b")
+	assert.Len(t, diffs, 1)
+	assert.Equal(t, bob, diffs[0].recipient)
+	assert.Len(t, diffs[0].value["members"], 2)
+	diffs = receive("a")
+	assert.Len(t, diffs, 1)
+	assert.Equal(t, alice, diffs[0].recipient)
+	assert.Equal(t, "b1", diffs[0].value["joined"].([]presence.Member)[0].ID)
+
+	// Departed members are removed by every node
+	nodes["b"].Connections.Publish(event.Disconnected, bob, event.Disconnect{})
+	diffs = receive("a")
+	assert.Len(t, diffs, 1)
+	assert.Equal(t, "b1", diffs[0].value["left"].([]presence.Member)[0].ID)
+	assert.Empty(t, receive("b"))
+}
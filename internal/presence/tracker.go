@@ -0,0 +1,141 @@
+package presence
+
+import (
+	"time"
+)
+
+// A member of a presence channel
+type Member struct {
+
+	// The connection identifier of the member
+	ID string `bson:"id"`
+
+	// The metadata the member announced itself with
+	Meta map[string]interface{} `bson:"meta"`
+
+	// The time the member joined the channel
+	JoinedAt time.Time `bson:"joinedAt"`
+}
+
+// Describes a change to the members of a channel, addressed to a single recipient
+type Diff struct {
+
+	// The sender to notify
+	Recipient interface{}
+
+	// The uid of the recipient's join request
+	Uid string
+
+	// The channel name
+	Channel string
+
+	// The full member list (sent to the member that joined)
+	Members []Member
+
+	// The members that joined, updated their metadata or left
+	Joined  []Member
+	Updated []Member
+	Left    []Member
+}
+
+type entry struct {
+	member Member
+	uid    string
+}
+
+// Tracker tracks the members of every presence channel, computing the diffs to push to the
+// other members on each change. It is not safe for concurrent use.
+type Tracker struct {
+	channels map[string]map[interface{}]*entry
+}
+
+// Creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{channels: make(map[string]map[interface{}]*entry)}
+}
+
+// Adds (or updates the metadata of) a member of the channel
+func (t *Tracker) Join(sender interface{}, id, uid, channel string, meta map[string]interface{}, now time.Time) (Member, []Diff) {
+	members, ok := t.channels[channel]
+	if !ok {
+		members = make(map[interface{}]*entry)
+		t.channels[channel] = members
+	}
+
+	var diffs []Diff
+	if e, ok := members[sender]; ok {
+		e.member.Meta = meta
+		e.uid = uid
+		for s, other := range members {
+			if s != sender {
+				diffs = append(diffs, Diff{Recipient: s, Uid: other.uid, Channel: channel, Updated: []Member{e.member}})
+			}
+		}
+		return e.member, append(diffs, t.snapshot(sender, channel))
+	}
+
+	member := Member{ID: id, Meta: meta, JoinedAt: now}
+	for s, other := range members {
+		diffs = append(diffs, Diff{Recipient: s, Uid: other.uid, Channel: channel, Joined: []Member{member}})
+	}
+	members[sender] = &entry{member: member, uid: uid}
+	return member, append(diffs, t.snapshot(sender, channel))
+}
+
+// Removes a member from the channel
+func (t *Tracker) Leave(sender interface{}, channel string) (Member, []Diff, bool) {
+	members, ok := t.channels[channel]
+	if !ok {
+		return Member{}, nil, false
+	}
+	e, ok := members[sender]
+	if !ok {
+		return Member{}, nil, false
+	}
+
+	delete(members, sender)
+	if len(members) == 0 {
+		delete(t.channels, channel)
+	}
+
+	var diffs []Diff
+	for s, other := range members {
+		diffs = append(diffs, Diff{Recipient: s, Uid: other.uid, Channel: channel, Left: []Member{e.member}})
+	}
+	// Acknowledge the leave to the departing member
+	diffs = append(diffs, Diff{Recipient: sender, Uid: e.uid, Channel: channel, Left: []Member{e.member}})
+	return e.member, diffs, true
+}
+
+// Removes a departed sender from every channel, returning the channels it left
+func (t *Tracker) Disconnect(sender interface{}) ([]string, []Diff) {
+	var channels []string
+	var diffs []Diff
+	for channel := range t.channels {
+		if _, d, ok := t.Leave(sender, channel); ok {
+			channels = append(channels, channel)
+			for _, diff := range d {
+				// Nobody is left to acknowledge
+				if diff.Recipient != sender {
+					diffs = append(diffs, diff)
+				}
+			}
+		}
+	}
+	return channels, diffs
+}
+
+// Returns the members of a channel
+func (t *Tracker) Members(channel string) []Member {
+	members := make([]Member, 0, len(t.channels[channel]))
+	for _, e := range t.channels[channel] {
+		members = append(members, e.member)
+	}
+	return members
+}
+
+// Returns the full member list of the channel addressed to the sender
+func (t *Tracker) snapshot(sender interface{}, channel string) Diff {
+	e := t.channels[channel][sender]
+	return Diff{Recipient: sender, Uid: e.uid, Channel: channel, Members: t.Members(channel)}
+}
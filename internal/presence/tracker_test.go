@@ -0,0 +1,47 @@
+package presence_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/presence"
+	"testing"
+	"time"
+)
+
+type TestClient struct {
+	id string
+}
+
+func TestTracker(t *testing.T) {
+
+	now := time.Now()
+	alice, bob := &TestClient{id: "a"}, &TestClient{id: "b"}
+	tracker := presence.NewTracker()
+
+	_, diffs := tracker.Join(alice, alice.id, "1", "room", map[string]interface{}{"name": "Alice"}, now)
+	assert.Len(t, diffs, 1)
+	assert.Equal(t, alice, diffs[0].Recipient)
+	assert.Len(t, diffs[0].Members, 1)
+
+	_, diffs = tracker.Join(bob, bob.id, "2", "room", nil, now)
+	assert.Len(t, diffs, 2)
+	assert.Equal(t, alice, diffs[0].Recipient)
+	assert.Equal(t, "1", diffs[0].Uid)
+	assert.Equal(t, "b", diffs[0].Joined[0].ID)
+	assert.Len(t, diffs[1].Members, 2)
+
+	_, diffs = tracker.Join(bob, bob.id, "3", "room", map[string]interface{}{"typing": true}, now)
+	assert.Equal(t, "b", diffs[0].Updated[0].ID)
+	assert.Equal(t, now, diffs[0].Updated[0].JoinedAt)
+
+	channels, diffs := tracker.Disconnect(alice)
+	assert.Equal(t, []string{"room"}, channels)
+	assert.Len(t, diffs, 1)
+	assert.Equal(t, bob, diffs[0].Recipient)
+	assert.Equal(t, "3", diffs[0].Uid)
+	assert.Equal(t, "a", diffs[0].Left[0].ID)
+
+	_, diffs, ok := tracker.Leave(bob, "room")
+	assert.True(t, ok)
+	assert.Len(t, diffs, 1)
+	assert.Empty(t, tracker.Members("room"))
+}
@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/event"
+	"go.springy.io/internal/rules"
+)
+
+// identified is implemented by senders with a connection identifier
+type identified interface {
+	ID() string
+}
+
+// Runs the ephemeral pub/sub router, delivering messages published to a named channel to its
+// subscribers without touching storage. Subscribing and publishing are authorized by the rules.
+//
+// Each node routes the subscriptions of its own clients: the publishes imported from other nodes
+// are delivered to the local subscribers, and the other requests of remote senders are left to
+// the node they are connected to (which also answers their errors).
+func Run(buses *event.Buses, r rules.Authorizer) {
+	router := NewRouter()
+
+	requests := buses.Requests.Subscribe(event.PubSubRequest)
+	disconnects := buses.Connections.Subscribe(event.Disconnected)
+
+	for {
+		select {
+		case e := <-disconnects.C():
+			router.Disconnect(e.Sender)
+		case e := <-requests.C():
+			request := e.Data
+			if e.Remote() && request.Scope != document.Publish {
+				continue
+			}
+			if request.Channel == "" {
+				if !e.Remote() {
+					reply(buses, e.Sender, request, &document.DocumentError{Code: document.InvalidRequest, Message: "missing channel"})
+				}
+				continue
+			}
+
+			var principal string
+			if p, ok := e.Sender.(document.Principal); ok {
+				principal = p.Principal()
+			}
+
+			switch request.Scope {
+			case document.Subscribe:
+				if !r.Allow(rules.Subscribe, request.Channel, principal) {
+					reply(buses, e.Sender, request, forbidden(rules.Subscribe, request.Channel))
+					continue
+				}
+				router.Subscribe(e.Sender, request.Uid, request.Channel)
+			case document.Unsubscribe:
+				router.Unsubscribe(e.Sender, request.Uid, request.Channel)
+			case document.Publish:
+				if !r.Allow(rules.Publish, request.Channel, principal) {
+					if !e.Remote() {
+						reply(buses, e.Sender, request, forbidden(rules.Publish, request.Channel))
+					}
+					continue
+				}
+				var from string
+				if sender, ok := e.Sender.(identified); ok {
+					from = sender.ID()
+				}
+				for _, s := range router.Subscribers(request.Channel) {
+					deliver(buses, s.Sender, bson.M{
+						"_uid":     s.Uid,
+						"_channel": request.Channel,
+						"_from":    from,
+						"value":    request.Value,
+					})
+				}
+			}
+		}
+	}
+}
+
+func forbidden(action, channel string) *document.DocumentError {
+	return &document.DocumentError{Code: document.Forbidden, Message: action + " is not allowed on channel '" + channel + "'"}
+}
+
+// Replies to the sender with an error, naming the scope of the failed request as publishes may
+// share the uid of a subscription
+func reply(buses *event.Buses, sender interface{}, request document.DocumentRequest, err *document.DocumentError) {
+	deliver(buses, sender, bson.M{
+		"_uid":     request.Uid,
+		"_channel": request.Channel,
+		"_scope":   request.Scope.String(),
+		"error":    err,
+	})
+}
+
+func deliver(buses *event.Buses, recipient interface{}, value bson.M) {
+	buses.Snapshots.Publish(event.Snapshot, recipient, document.DocumentSnapshot{Value: value})
+}
@@ -0,0 +1,65 @@
+package pubsub
+
+// A subscriber of a channel
+type Subscriber struct {
+
+	// The subscribed sender
+	Sender interface{}
+
+	// The uid of the subscribe request, which messages are delivered under
+	Uid string
+}
+
+// Router tracks the subscribers of every ephemeral channel. It is not safe for concurrent use.
+type Router struct {
+	channels map[string]map[Subscriber]struct{}
+}
+
+// Creates an empty router
+func NewRouter() *Router {
+	return &Router{channels: make(map[string]map[Subscriber]struct{})}
+}
+
+// Subscribes the sender to the channel under the uid. A sender may subscribe to a channel under
+// several uids, each receiving the messages.
+func (r *Router) Subscribe(sender interface{}, uid, channel string) {
+	subscribers, ok := r.channels[channel]
+	if !ok {
+		subscribers = make(map[Subscriber]struct{})
+		r.channels[channel] = subscribers
+	}
+	subscribers[Subscriber{Sender: sender, Uid: uid}] = struct{}{}
+}
+
+// Cancels the subscription of the sender to the channel under the uid
+func (r *Router) Unsubscribe(sender interface{}, uid, channel string) {
+	if subscribers, ok := r.channels[channel]; ok {
+		delete(subscribers, Subscriber{Sender: sender, Uid: uid})
+		if len(subscribers) == 0 {
+			delete(r.channels, channel)
+		}
+	}
+}
+
+// Unsubscribes a departed sender from every channel
+func (r *Router) Disconnect(sender interface{}) {
+	for channel, subscribers := range r.channels {
+		for s := range subscribers {
+			if s.Sender == sender {
+				delete(subscribers, s)
+			}
+		}
+		if len(subscribers) == 0 {
+			delete(r.channels, channel)
+		}
+	}
+}
+
+// Returns the subscribers of the channel
+func (r *Router) Subscribers(channel string) []Subscriber {
+	subscribers := make([]Subscriber, 0, len(r.channels[channel]))
+	for s := range r.channels[channel] {
+		subscribers = append(subscribers, s)
+	}
+	return subscribers
+}
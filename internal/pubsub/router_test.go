@@ -0,0 +1,173 @@
+package pubsub_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/event"
+	"go.springy.io/internal/pubsub"
+	"go.springy.io/internal/rules"
+	"testing"
+	"time"
+)
+
+type TestClient struct {
+	id string
+}
+
+func (c *TestClient) ID() string {
+	return c.id
+}
+
+func (c *TestClient) Principal() string {
+	return c.id
+}
+
+func TestRouter(t *testing.T) {
+
+	alice, bob := &TestClient{id: "a"}, &TestClient{id: "b"}
+	router := pubsub.NewRouter()
+
+	// Messages fan out to every subscription, a sender subscribing under several uids
+	router.Subscribe(alice, "1", "cursors")
+	router.Subscribe(alice, "2", "cursors")
+	router.Subscribe(bob, "3", "cursors")
+	router.Subscribe(bob, "4", "typing")
+	assert.ElementsMatch(t, []pubsub.Subscriber{{Sender: alice, Uid: "1"}, {Sender: alice, Uid: "2"}, {Sender: bob, Uid: "3"}}, router.Subscribers("cursors"))
+
+	// Cancelling a subscription keeps the other subscriptions of the sender
+	router.Unsubscribe(alice, "1", "cursors")
+	assert.ElementsMatch(t, []pubsub.Subscriber{{Sender: alice, Uid: "2"}, {Sender: bob, Uid: "3"}}, router.Subscribers("cursors"))
+	router.Unsubscribe(alice, "3", "cursors")
+	assert.Len(t, router.Subscribers("cursors"), 2)
+
+	// Departed senders are unsubscribed from every channel
+	router.Disconnect(bob)
+	assert.Equal(t, []pubsub.Subscriber{{Sender: alice, Uid: "2"}}, router.Subscribers("cursors"))
+	assert.Empty(t, router.Subscribers("typing"))
+	router.Unsubscribe(alice, "2", "cursors")
+	assert.Empty(t, router.Subscribers("cursors"))
+}
+
+func TestRun(t *testing.T) {
+
+	buses := event.NewBuses("node", event.Options{Buffer: 16})
+	snapshots := buses.Snapshots.Subscribe(event.Snapshot)
+	r, err := rules.Parse([]byte(`{"channels": [
+		{"match": "cursors", "actions": ["subscribe", "publish"]},
+		{"match": "announcements", "actions": ["subscribe"]}
+	]}`))
+	assert.Nil(t, err)
+	go pubsub.Run(buses, r)
+
+	alice, bob, carol := &TestClient{id: "a"}, &TestClient{id: "b"}, &TestClient{id: "c"}
+	send := func(sender *TestClient, uid string, scope document.DocumentScope, channel string) {
+		request := document.DocumentRequest{Uid: uid, Scope: scope, Channel: channel, Value: document.Document{"x": 1}}
+		assert.Equal(t, 1, buses.Requests.Publish(event.PubSubRequest, sender, request))
+	}
+	receive := func() (interface{}, map[string]interface{}) {
+		select {
+		case e := <-snapshots.C():
+			return e.Sender, e.Data.Value
+		case <-time.After(time.Second):
+			t.Fatal("no message delivered")
+			return nil, nil
+		}
+	}
+
+	// The router subscribes once running, answering requests without a channel
+	for buses.Requests.Publish(event.PubSubRequest, alice, document.DocumentRequest{Uid: "0", Scope: document.Subscribe}) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, value := receive()
+	assert.Equal(t, document.InvalidRequest, value["error"].(*document.DocumentError).Code)
+
+	// Publishes fan out to every subscriber, including the sender when it is subscribed
+	send(alice, "1", document.Subscribe, "cursors")
+	send(bob, "2", document.Subscribe, "cursors")
+	send(alice, "1", document.Publish, "cursors")
+	recipients := map[interface{}]string{}
+	for i := 0; i < 2; i++ {
+		recipient, value := receive()
+		assert.Equal(t, "a", value["_from"])
+		recipients[recipient] = value["_uid"].(string)
+	}
+	assert.Equal(t, map[interface{}]string{alice: "1", bob: "2"}, recipients)
+
+	// Senders which are not subscribed only reach the subscribers
+	send(alice, "1", document.Unsubscribe, "cursors")
+	send(carol, "3", document.Publish, "cursors")
+	recipient, value := receive()
+	assert.Equal(t, bob, recipient)
+	assert.Equal(t, "c", value["_from"])
+
+	// Denied requests are answered with the scope, as publishes may share a subscription uid
+	send(bob, "2", document.Publish, "announcements")
+	recipient, value = receive()
+	assert.Equal(t, bob, recipient)
+	assert.Equal(t, "publish", value["_scope"])
+	assert.Equal(t, document.Forbidden, value["error"].(*document.DocumentError).Code)
+
+}
+
+// Waits for the router of the buses to subscribe, answering requests without a channel
+func started(t *testing.T, buses *event.Buses) {
+	sender := &TestClient{id: "probe"}
+	snapshots := buses.Snapshots.Subscribe(event.Snapshot)
+	defer snapshots.Unsubscribe()
+	for buses.Requests.Publish(event.PubSubRequest, sender, document.DocumentRequest{Uid: "0", Scope: document.Subscribe}) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	<-snapshots.C()
+}
+
+func TestRunNodes(t *testing.T) {
+
+	network := event.NewLocalNetwork()
+	topics := []event.Topic{event.PubSubRequest, event.PresenceRequest, event.Disconnected}
+	nodes := map[string]*event.Buses{}
+	snapshots := map[string]*event.Subscription[document.DocumentSnapshot]{}
+	for _, node := range []string{"a", "b"} {
+		buses := event.NewBuses(node, event.Options{Buffer: 16})
+		go pubsub.Run(buses, rules.NewCurrent(nil))
+		started(t, buses)
+		closeBridge, err := buses.Bridge(network.Transport(), topics, topics)
+		assert.Nil(t, err)
+		defer closeBridge()
+		nodes[node] = buses
+		snapshots[node] = buses.Snapshots.Subscribe(event.Snapshot)
+	}
+	alice, bob, carol := &TestClient{id: "a1"}, &TestClient{id: "b1"}, &TestClient{id: "a2"}
+	send := func(node string, sender *TestClient, uid string, scope document.DocumentScope) {
+		nodes[node].Requests.Publish(event.PubSubRequest, sender, document.DocumentRequest{Uid: uid, Scope: scope, Channel: "chat", Value: document.Document{"x": 1}})
+	}
+	receive := func(node string) []interface{} {
+		var recipients []interface{}
+		for {
+			select {
+			case e := <-snapshots[node].C():
+				recipients = append(recipients, e.Sender)
+			case <-time.After(50 * time.Millisecond):
+				return recipients
+			}
+		}
+	}
+
+	// Each node delivers the publishes of every node to its own subscribers, exactly once
+	send("a", alice, "1", document.Subscribe)
+	send("b", bob, "2", document.Subscribe)
+	time.Sleep(20 * time.Millisecond)
+	send("a", carol, "3", document.Publish)
+	assert.Equal(t, []interface{}{alice}, receive("a"))
+	assert.Equal(t, []interface{}{bob}, receive("b"))
+
+	send("b", bob, "2", document.Publish)
+	assert.Equal(t, []interface{}{alice}, receive("a"))
+	assert.Equal(t, []interface{}{bob}, receive("b"))
+
+	// Subscriptions are owned by their node, which is the only one cancelling them
+	send("b", bob, "2", document.Unsubscribe)
+	time.Sleep(20 * time.Millisecond)
+	send("a", carol, "3", document.Publish)
+	assert.Equal(t, []interface{}{alice}, receive("a"))
+	assert.Empty(t, receive("b"))
+}
@@ -0,0 +1,148 @@
+// Package ratelimit implements token buckets, keyed by connection, identity or collection
+package ratelimit
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the buckets left idle long enough to be full again are removed
+const sweepInterval = time.Minute
+
+// Rate is the refill rate of a token bucket and the burst of tokens it holds
+type Rate struct {
+
+	// The tokens added per second (unlimited when zero)
+	PerSecond float64
+
+	// The maximum number of tokens, taken at once after an idle period (at least one)
+	Burst float64
+}
+
+// Returns true if the rate does not limit anything
+func (r Rate) Unlimited() bool {
+	return r.PerSecond <= 0
+}
+
+// Returns the maximum number of tokens of the buckets
+func (r Rate) burst() float64 {
+	return math.Max(r.Burst, 1)
+}
+
+// A token bucket, starting full
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Refills the bucket at the rate since it was last used
+func (b *bucket) refill(rate Rate, now time.Time) {
+	b.tokens = math.Min(rate.burst(), b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond)
+	b.last = now
+}
+
+// Buckets are the token buckets of keys, sharing the rate passed when taking a token so that rate
+// changes apply at once. Buckets are created full, and removed once idle long enough to be full again.
+type Buckets struct {
+	buckets map[string]*bucket
+	swept   time.Time
+	mutex   sync.Mutex
+
+	// Orders the locks of the buckets taken together
+	order uint64
+}
+
+// The order of the next buckets created
+var order atomic.Uint64
+
+func NewBuckets() *Buckets {
+	return &Buckets{buckets: make(map[string]*bucket), order: order.Add(1)}
+}
+
+// Takes a token from the bucket of the key, returning false with the time until a token is
+// available if the bucket is empty
+func (b *Buckets) Take(key string, rate Rate, now time.Time) (bool, time.Duration) {
+	i, wait := TakeAll([]Token{{Buckets: b, Key: key, Rate: rate}}, now)
+	return i < 0, wait
+}
+
+// A token to take from the bucket of a key
+type Token struct {
+	Buckets *Buckets
+	Key     string
+	Rate    Rate
+}
+
+// Takes every token at once, or none of them if any bucket is empty. Returns the index of the first
+// empty bucket with the time until it holds a token, or -1 if the tokens were taken.
+func TakeAll(tokens []Token, now time.Time) (int, time.Duration) {
+	var locked []*Buckets
+	for _, t := range tokens {
+		if !t.Rate.Unlimited() && !contains(locked, t.Buckets) {
+			locked = append(locked, t.Buckets)
+		}
+	}
+
+	// The buckets are always locked in the same order, so concurrent takes never deadlock
+	sort.Slice(locked, func(i, j int) bool { return locked[i].order < locked[j].order })
+	for _, b := range locked {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+	}
+
+	taken := make([]*bucket, 0, len(tokens))
+	for i, t := range tokens {
+		if t.Rate.Unlimited() {
+			continue
+		}
+		t.Buckets.sweep(t.Rate, now)
+		k, ok := t.Buckets.buckets[t.Key]
+		if !ok {
+			k = &bucket{tokens: t.Rate.burst(), last: now}
+			t.Buckets.buckets[t.Key] = k
+		}
+		k.refill(t.Rate, now)
+		if k.tokens < 1 {
+			return i, time.Duration((1 - k.tokens) / t.Rate.PerSecond * float64(time.Second))
+		}
+		taken = append(taken, k)
+	}
+	for _, k := range taken {
+		k.tokens--
+	}
+	return -1, 0
+}
+
+// Returns true if the buckets are in the list
+func contains(list []*Buckets, b *Buckets) bool {
+	for _, l := range list {
+		if l == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number of buckets
+func (b *Buckets) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.buckets)
+}
+
+// Removes the full buckets, at most once per sweep interval. The caller must hold the lock.
+func (b *Buckets) sweep(rate Rate, now time.Time) {
+	if now.Sub(b.swept) < sweepInterval {
+		return
+	}
+	b.swept = now
+	for key, k := range b.buckets {
+		k.refill(rate, now)
+		if k.tokens >= rate.burst() {
+			delete(b.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package ratelimit_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/ratelimit"
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+
+	buckets := ratelimit.NewBuckets()
+	rate := ratelimit.Rate{PerSecond: 10, Burst: 2}
+	now := time.Now()
+
+	// Buckets start full, then refill at the rate
+	ok, _ := buckets.Take("alice", rate, now)
+	assert.True(t, ok)
+	ok, _ = buckets.Take("alice", rate, now)
+	assert.True(t, ok)
+	ok, wait := buckets.Take("alice", rate, now)
+	assert.False(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+	ok, _ = buckets.Take("alice", rate, now.Add(100*time.Millisecond))
+	assert.True(t, ok)
+
+	// Keys have their own buckets
+	ok, _ = buckets.Take("bob", rate, now)
+	assert.True(t, ok)
+
+	// Rate changes apply at once
+	ok, _ = buckets.Take("alice", ratelimit.Rate{}, now)
+	assert.True(t, ok)
+
+	// Idle buckets are removed once full again
+	assert.Equal(t, 2, buckets.Len())
+	buckets.Take("carol", rate, now.Add(2*time.Minute))
+	assert.Equal(t, 1, buckets.Len())
+}
+
+func TestTakeAll(t *testing.T) {
+
+	connections := ratelimit.NewBuckets()
+	collections := ratelimit.NewBuckets()
+	rate := ratelimit.Rate{PerSecond: 10, Burst: 1}
+	now := time.Now()
+	tokens := []ratelimit.Token{{Buckets: connections, Key: "1", Rate: ratelimit.Rate{PerSecond: 10, Burst: 2}}, {Buckets: collections, Key: "todos", Rate: rate}}
+
+	// The tokens are taken together
+	i, _ := ratelimit.TakeAll(tokens, now)
+	assert.Equal(t, -1, i)
+
+	// Or not at all, answering with the empty bucket
+	i, wait := ratelimit.TakeAll(tokens, now)
+	assert.Equal(t, 1, i)
+	assert.Equal(t, 100*time.Millisecond, wait)
+	ok, _ := connections.Take("1", rate, now)
+	assert.True(t, ok)
+	ok, _ = connections.Take("1", rate, now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,129 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+// The actions a rule can allow on a channel
+const (
+	Subscribe = "subscribe"
+	Publish   = "publish"
+	Join      = "join"
+)
+
+// Allows actions on the channels matching a pattern
+type Rule struct {
+
+	// The channel name pattern, e.g. "cursors/*" (see path.Match)
+	Match string `json:"match"`
+
+	// The allowed actions (subscribe, publish, join)
+	Actions []string `json:"actions"`
+
+	// The principals allowed, "*" allowing any authenticated principal (anyone when empty)
+	Identities []string `json:"identities,omitempty"`
+}
+
+// The authorization rules of a Springy server
+type Rules struct {
+
+	// The channel rules, evaluated in order
+	Channels []Rule `json:"channels"`
+}
+
+// Authorizer decides whether a principal may perform an action on a channel
+type Authorizer interface {
+	Allow(action, channel, principal string) bool
+}
+
+// Current holds the rules in effect, which may be replaced while they are evaluated
+type Current struct {
+	rules atomic.Pointer[Rules]
+}
+
+// Returns the holder of the rules (nil allowing everything)
+func NewCurrent(r *Rules) *Current {
+	c := &Current{}
+	c.rules.Store(r)
+	return c
+}
+
+// Replaces the rules in effect
+func (c *Current) Store(r *Rules) {
+	c.rules.Store(r)
+}
+
+// Returns true if the rules in effect allow the principal to perform the action on the channel
+func (c *Current) Allow(action, channel, principal string) bool {
+	return c.rules.Load().Allow(action, channel, principal)
+}
+
+// Loads the rules from a json file
+func Load(file string) (*Rules, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parses the json representation of the rules
+func Parse(b []byte) (*Rules, error) {
+	var r Rules
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	for i, rule := range r.Channels {
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return nil, fmt.Errorf("channel rule %d: invalid pattern '%s'", i, rule.Match)
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case Subscribe, Publish, Join:
+			default:
+				return nil, fmt.Errorf("channel rule %d: unknown action '%s'", i, action)
+			}
+		}
+	}
+	return &r, nil
+}
+
+// Returns true if the principal may perform the action on the channel. Every action is allowed when
+// no rules are configured (nil), otherwise the first rule matching the channel and action which
+// permits the principal allows it, and the action is denied when none does.
+func (r *Rules) Allow(action, channel, principal string) bool {
+	if r == nil {
+		return true
+	}
+	for _, rule := range r.Channels {
+		if matched, _ := path.Match(rule.Match, channel); matched && rule.allows(action) && rule.permits(principal) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule Rule) allows(action string) bool {
+	for _, a := range rule.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule Rule) permits(principal string) bool {
+	if len(rule.Identities) == 0 {
+		return true
+	}
+	for _, identity := range rule.Identities {
+		if identity == principal || (identity == "*" && principal != "") {
+			return true
+		}
+	}
+	return false
+}
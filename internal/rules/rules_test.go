@@ -0,0 +1,44 @@
+package rules_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/rules"
+	"testing"
+)
+
+func TestAllow(t *testing.T) {
+
+	r, err := rules.Parse([]byte(`{"channels": [
+		{"match": "cursors/*", "actions": ["subscribe", "publish"]},
+		{"match": "admin/*", "actions": ["subscribe"], "identities": ["ops"]},
+		{"match": "rooms/*", "actions": ["join", "subscribe"], "identities": ["*"]}
+	]}`))
+	assert.Nil(t, err)
+
+	assert.True(t, r.Allow(rules.Publish, "cursors/doc1", ""))
+	assert.False(t, r.Allow(rules.Join, "cursors/doc1", ""))
+	assert.True(t, r.Allow(rules.Subscribe, "admin/logs", "ops"))
+	assert.False(t, r.Allow(rules.Subscribe, "admin/logs", "alice"))
+	assert.False(t, r.Allow(rules.Publish, "admin/logs", "ops"))
+	assert.True(t, r.Allow(rules.Join, "rooms/lobby", "alice"))
+	assert.False(t, r.Allow(rules.Join, "rooms/lobby", ""))
+	assert.False(t, r.Allow(rules.Subscribe, "typing", ""))
+
+	var none *rules.Rules
+	assert.True(t, none.Allow(rules.Publish, "anything", ""))
+
+	_, err = rules.Parse([]byte(`{"channels": [{"match": "a", "actions": ["delete"]}]}`))
+	assert.NotNil(t, err)
+}
+
+func TestCurrent(t *testing.T) {
+
+	current := rules.NewCurrent(nil)
+	assert.True(t, current.Allow(rules.Publish, "cursors/doc1", ""))
+
+	r, err := rules.Parse([]byte(`{"channels": [{"match": "cursors/*", "actions": ["subscribe"]}]}`))
+	assert.Nil(t, err)
+	current.Store(r)
+	assert.False(t, current.Allow(rules.Publish, "cursors/doc1", ""))
+	assert.True(t, current.Allow(rules.Subscribe, "cursors/doc1", ""))
+}
@@ -0,0 +1,310 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The defaults of the tracer options left unset
+const (
+	defaultBatchSize     = 512
+	defaultQueueSize     = 4096
+	defaultFlushInterval = 5 * time.Second
+)
+
+// Exporter sends batches of ended spans to a collector
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+// Configures a tracer
+type Options struct {
+
+	// The service name the spans are exported under
+	Service string
+
+	// The fraction of new traces recorded, from 0 to 1 (traces continued from a parent follow its decision)
+	Ratio float64
+
+	// The maximum number of spans exported at once
+	BatchSize int
+
+	// The maximum number of ended spans waiting for export (spans are dropped past it)
+	QueueSize int
+
+	// How often the queued spans are exported
+	FlushInterval time.Duration
+}
+
+// Tracer batches ended spans and hands them to its exporter
+type Tracer struct {
+	exporter Exporter
+	service  string
+	ratio    float64
+	size     int
+	interval time.Duration
+
+	spans   chan *Span
+	flush   chan chan struct{}
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// The tracer spans are started with (nil when tracing is disabled)
+var current atomic.Pointer[Tracer]
+
+// Creates a tracer exporting the spans in the background
+func NewTracer(exporter Exporter, options Options) *Tracer {
+	if options.Service == "" {
+		options.Service = "springy"
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultQueueSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultFlushInterval
+	}
+	t := &Tracer{
+		exporter: exporter,
+		service:  options.Service,
+		ratio:    options.Ratio,
+		size:     options.BatchSize,
+		interval: options.FlushInterval,
+		spans:    make(chan *Span, options.QueueSize),
+		flush:    make(chan chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Starts the spans with the tracer, or disables tracing when it is nil
+func SetTracer(t *Tracer) {
+	current.Store(t)
+}
+
+// Returns the number of spans dropped because the queue was full
+func (t *Tracer) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+// Exports the queued spans, returning once they were handed to the exporter
+func (t *Tracer) Flush() {
+	done := make(chan struct{})
+	t.flush <- done
+	<-done
+}
+
+// Queues an ended span, dropping it if the queue is full
+func (t *Tracer) queue(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// Exports the queued spans whenever a batch is full, on every interval and when flushed
+func (t *Tracer) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.size)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(t.service, batch); err != nil {
+			slog.Warn("unable to export spans", "spans", len(batch), "error", err)
+		}
+		batch = make([]*Span, 0, t.size)
+	}
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= t.size {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flush:
+			for drained := false; !drained; {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					drained = true
+				}
+			}
+			export()
+			close(done)
+		}
+	}
+}
+
+// Writes each batch to a writer as a line of OTLP json
+type WriterExporter struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// Creates an exporter writing to w, such as os.Stdout
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+func (e *WriterExporter) Export(service string, spans []*Span) error {
+	b, err := Marshal(service, spans)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+// Posts each batch to an OTLP/HTTP collector in the json encoding
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// Creates an exporter posting to the traces endpoint of a collector, such as
+// http://localhost:4318/v1/traces
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (e *OTLPExporter) Export(service string, spans []*Span) error {
+	b, err := Marshal(service, spans)
+	if err != nil {
+		return err
+	}
+	response, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", response.Status)
+	}
+	return nil
+}
+
+// The OTLP json encoding of spans. See:
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// The OTLP status code of failed spans
+const statusError = 2
+
+// Encodes the spans of a service as an OTLP json export request
+func Marshal(service string, spans []*Span) ([]byte, error) {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mutex.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+		}
+		if s.Parent != (SpanID{}) {
+			span.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		for _, a := range s.Attributes {
+			span.Attributes = append(span.Attributes, attribute(a.Key, a.Value))
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: statusError, Message: s.Error}
+		}
+		s.mutex.Unlock()
+		encoded = append(encoded, span)
+	}
+
+	return json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: []otlpAttribute{attribute("service.name", service)}},
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "go.springy.io"}, Spans: encoded}},
+		}},
+	})
+}
+
+// Encodes an attribute with the OTLP value type of its go type
+func attribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	case fmt.Stringer:
+		v = map[string]interface{}{"stringValue": value.String()}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
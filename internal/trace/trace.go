@@ -0,0 +1,201 @@
+// Package trace records spans of the request path and exports them in the OpenTelemetry protocol
+// (OTLP) json encoding. Trace contexts are propagated as W3C traceparent strings
+// (https://www.w3.org/TR/trace-context/#traceparent-header).
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// SpanContext is the part of a span propagated to its children
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+
+	// Flag indicating if the trace is recorded
+	Sampled bool
+}
+
+// Returns true if the context identifies a span
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// Formats the context as a traceparent, or an empty string if it is not valid
+func (c SpanContext) Traceparent() string {
+	if !c.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(c.TraceID[:]), hex.EncodeToString(c.SpanID[:]), flags)
+}
+
+// Parses a traceparent, returning an invalid context if it is empty or malformed
+func Parse(traceparent string) SpanContext {
+	var c SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}
+	}
+	if decode(c.TraceID[:], parts[1]) != nil || decode(c.SpanID[:], parts[2]) != nil {
+		return SpanContext{}
+	}
+	var flags [1]byte
+	if decode(flags[:], parts[3]) != nil {
+		return SpanContext{}
+	}
+	c.Sampled = flags[0]&1 == 1
+	if !c.IsValid() {
+		return SpanContext{}
+	}
+	return c
+}
+
+// Decodes a lowercase hex string filling b exactly
+func decode(b []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(b)) || strings.ToLower(s) != s {
+		return fmt.Errorf("invalid hex '%s'", s)
+	}
+	_, err := hex.Decode(b, []byte(s))
+	return err
+}
+
+// Kind describes the relationship of a span to its parent and children
+type Kind int
+
+// The span kinds, numbered as in OTLP
+const (
+	Internal Kind = iota + 1
+	Server
+	Client
+	Producer
+	Consumer
+)
+
+// Attribute is a key value pair annotating a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a timed operation of a trace. A nil span is valid and records nothing.
+type Span struct {
+	Name      string
+	Kind      Kind
+	Context   SpanContext
+	Parent    SpanID
+	StartTime time.Time
+	EndTime   time.Time
+
+	Attributes []Attribute
+
+	// The error the operation failed with (empty on success)
+	Error string
+
+	tracer *Tracer
+	ended  atomic.Bool
+	mutex  sync.Mutex
+}
+
+// Starts a span, as a child of the parent when it is valid or as the root of a new trace.
+// Attributes are passed as alternating keys and values. The span is nil when tracing is disabled.
+func Start(parent SpanContext, name string, kind Kind, attrs ...any) *Span {
+	t := current.Load()
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{Name: name, Kind: kind, StartTime: time.Now(), tracer: t}
+	if parent.IsValid() {
+		s.Context = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+		s.Parent = parent.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = t.sample(s.Context.TraceID)
+	}
+	rand.Read(s.Context.SpanID[:])
+	s.SetAttributes(attrs...)
+	return s
+}
+
+// Starts a child span of the parent, or returns nil when the parent is not valid so operations
+// outside of a traced request do not start traces of their own
+func Continue(parent SpanContext, name string, kind Kind, attrs ...any) *Span {
+	if !parent.IsValid() {
+		return nil
+	}
+	return Start(parent, name, kind, attrs...)
+}
+
+// Returns the context propagated to the children of the span, or the parent when it is nil
+func (s *Span) SpanContext(parent SpanContext) SpanContext {
+	if s == nil {
+		return parent
+	}
+	return s.Context
+}
+
+// Returns the traceparent of the span, or the parent when it is nil
+func (s *Span) Traceparent(parent string) string {
+	if s == nil {
+		return parent
+	}
+	return s.Context.Traceparent()
+}
+
+// Annotates the span with alternating keys and values
+func (s *Span) SetAttributes(attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.Attributes = append(s.Attributes, Attribute{Key: fmt.Sprint(attrs[i]), Value: attrs[i+1]})
+	}
+}
+
+// Records the error the operation failed with, if any
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Error = err.Error()
+}
+
+// Ends the span, queuing it for export when the trace is sampled. Only the first call has effect.
+func (s *Span) End() {
+	if s == nil || s.ended.Swap(true) {
+		return
+	}
+	s.EndTime = time.Now()
+	if s.Context.Sampled {
+		s.tracer.queue(s)
+	}
+}
+
+// Samples the traceIDs below the sampling ratio, so every node takes the same decision
+func (t *Tracer) sample(id TraceID) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>11)/(1<<53) < t.ratio
+}
@@ -0,0 +1,93 @@
+package trace_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/trace"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c := trace.Parse(traceparent)
+	assert.True(t, c.IsValid())
+	assert.True(t, c.Sampled)
+	assert.Equal(t, traceparent, c.Traceparent())
+
+	assert.False(t, trace.Parse("").IsValid())
+	assert.False(t, trace.Parse("00-00000000000000000000000000000000-00f067aa0ba902b7-01").IsValid())
+	assert.False(t, trace.Parse("00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01").IsValid())
+	assert.False(t, trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra").IsValid())
+	assert.False(t, trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7").IsValid())
+}
+
+func TestSpans(t *testing.T) {
+
+	// Spans are nil and pass their parent through when tracing is disabled
+	parent := trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := trace.Start(parent, "disabled", trace.Internal)
+	assert.Nil(t, span)
+	assert.Equal(t, parent, span.SpanContext(parent))
+	span.End()
+
+	var out bytes.Buffer
+	tracer := trace.NewTracer(trace.NewWriterExporter(&out), trace.Options{Service: "test", Ratio: 1})
+	trace.SetTracer(tracer)
+	defer trace.SetTracer(nil)
+
+	// Children continue the trace of their parent
+	span = trace.Start(parent, "ws.read", trace.Server, "collection", "users", "bytes", 12)
+	assert.Equal(t, parent.TraceID, span.Context.TraceID)
+	assert.NotEqual(t, parent.SpanID, span.Context.SpanID)
+	child := trace.Continue(span.SpanContext(parent), "mongo.insertOne", trace.Client)
+	child.Fail(errors.New("duplicate key"))
+	child.End()
+	span.End()
+	span.End()
+
+	// Unsampled traces are not recorded, and untraced operations start no trace
+	trace.Start(trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"), "unsampled", trace.Internal).End()
+	assert.Nil(t, trace.Continue(trace.SpanContext{}, "untraced", trace.Internal))
+
+	tracer.Flush()
+
+	var exported struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Kind         int    `json:"kind"`
+					Attributes   []struct {
+						Key   string                 `json:"key"`
+						Value map[string]interface{} `json:"value"`
+					} `json:"attributes"`
+					Status struct {
+						Code    int    `json:"code"`
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &exported))
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+
+	assert.Equal(t, "mongo.insertOne", spans[0].Name)
+	assert.Equal(t, 2, spans[0].Status.Code)
+	assert.Equal(t, "duplicate key", spans[0].Status.Message)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+
+	assert.Equal(t, "ws.read", spans[1].Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[1].TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", spans[1].ParentSpanID)
+	assert.Equal(t, int(trace.Server), spans[1].Kind)
+	assert.Equal(t, "users", spans[1].Attributes[0].Value["stringValue"])
+	assert.Equal(t, "12", spans[1].Attributes[1].Value["intValue"])
+}
@@ -0,0 +1,168 @@
+package ws
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/event"
+	"sort"
+	"time"
+)
+
+// The errors of the admin operations
+var (
+	ErrUnknownClient       = errors.New("unknown client")
+	ErrUnknownSubscription = errors.New("unknown subscription")
+)
+
+// ClientInfo describes a connected client
+type ClientInfo struct {
+	ID             string             `json:"id"`
+	Remote         string             `json:"remote"`
+	Identity       string             `json:"identity,omitempty"`
+	Protocol       string             `json:"protocol"`
+	Connected      time.Time          `json:"connected"`
+	QueuedMessages int                `json:"queuedMessages"`
+	QueuedBytes    int                `json:"queuedBytes"`
+	Subscriptions  []SubscriptionInfo `json:"subscriptions"`
+}
+
+// SubscriptionInfo describes a streaming request of a client: a watch, a pub/sub subscription or a
+// presence channel membership
+type SubscriptionInfo struct {
+	Uid        string `json:"uid"`
+	Scope      string `json:"scope"`
+	Operation  string `json:"operation,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Channel    string `json:"channel,omitempty"`
+}
+
+// Returns true if the scope streams responses until cancelled
+func streaming(scope string) bool {
+	switch scope {
+	case document.Watch.String(), document.Subscribe.String(), document.Join.String():
+		return true
+	}
+	return false
+}
+
+// Lists the connected clients, oldest first
+func (hub *Hub) Clients() []ClientInfo {
+	hub.mutex.RLock()
+	clients := make([]*Client, 0, len(hub.ids))
+	for _, c := range hub.ids {
+		clients = append(clients, c)
+	}
+	hub.mutex.RUnlock()
+
+	infos := make([]ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Connected.Before(infos[j].Connected) })
+	return infos
+}
+
+// Describes a connected client
+func (hub *Hub) Client(id string) (ClientInfo, error) {
+	c, err := hub.client(id)
+	if err != nil {
+		return ClientInfo{}, err
+	}
+	return c.info(), nil
+}
+
+// Disconnects a client, telling it an administrator closed the connection
+func (hub *Hub) Disconnect(id string) error {
+	c, err := hub.client(id)
+	if err != nil {
+		return err
+	}
+	c.log().Info("disconnecting client on admin request")
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "disconnected by an administrator")
+	c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(hub.config().WriteWait))
+	c.conn.Close()
+	return nil
+}
+
+// Cancels a watch, pub/sub subscription or presence channel membership of a client, as if the
+// client had cancelled it, and tells the client with a cancelled error
+func (hub *Hub) Cancel(id string, uid string) error {
+	c, err := hub.client(id)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	r, ok := c.routes[uid]
+	if ok && streaming(r.scope) {
+		delete(c.routes, uid)
+	}
+	c.mutex.Unlock()
+	if !ok || !streaming(r.scope) {
+		return ErrUnknownSubscription
+	}
+
+	request := document.DocumentRequest{Uid: uid, Collection: r.collection, Channel: r.channel}
+	switch r.scope {
+	case document.Watch.String():
+		request.Scope = document.Watch
+		hub.buses.Requests.Publish(event.CancelRequest, c, request)
+	case document.Subscribe.String():
+		request.Scope = document.Unsubscribe
+		hub.buses.Requests.Publish(event.PubSubRequest, c, request)
+	case document.Join.String():
+		request.Scope = document.Leave
+		hub.buses.Requests.Publish(event.PresenceRequest, c, request)
+	}
+	c.log().Info("cancelled subscription on admin request", request.LogAttrs()...)
+
+	c.writeResponse(bson.M{
+		"_uid":  uid,
+		"error": &document.DocumentError{Code: document.Cancelled, Message: r.scope + " cancelled by an administrator"},
+	})
+	return nil
+}
+
+// Returns the connected client with the identifier
+func (hub *Hub) client(id string) (*Client, error) {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	c, ok := hub.ids[id]
+	if !ok {
+		return nil, ErrUnknownClient
+	}
+	return c, nil
+}
+
+// Describes the client
+func (c *Client) info() ClientInfo {
+	messages, bytes := c.queue.depth()
+	info := ClientInfo{
+		ID:             c.id,
+		Remote:         c.remote,
+		Identity:       c.identity,
+		Protocol:       c.protocol.String(),
+		Connected:      c.connected,
+		QueuedMessages: messages,
+		QueuedBytes:    bytes,
+		Subscriptions:  []SubscriptionInfo{},
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for uid, r := range c.routes {
+		if streaming(r.scope) {
+			info.Subscriptions = append(info.Subscriptions, SubscriptionInfo{
+				Uid:        uid,
+				Scope:      r.scope,
+				Operation:  r.operation,
+				Collection: r.collection,
+				Channel:    r.channel,
+			})
+		}
+	}
+	sort.Slice(info.Subscriptions, func(i, j int) bool { return info.Subscriptions[i].Uid < info.Subscriptions[j].Uid })
+	return info
+}
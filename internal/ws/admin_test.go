@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/event"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+
+	buses := event.NewBuses("node", event.Options{Buffer: 8})
+	watches := buses.Requests.Subscribe(event.MongoRequest)
+	cancels := buses.Requests.Subscribe(event.CancelRequest)
+
+	hub := NewHub(buses, Options{})
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(hub.Upgrade))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "w1", "scope": "watch", "collection": "users", "operation": "insert"}`))
+	<-watches.C()
+
+	clients := hub.Clients()
+	assert.Len(t, clients, 1)
+	id := clients[0].ID
+	assert.Equal(t, "springy.json.v1", clients[0].Protocol)
+	assert.Equal(t, []SubscriptionInfo{{Uid: "w1", Scope: "watch", Operation: "insert", Collection: "users"}}, clients[0].Subscriptions)
+
+	// Cancelling a watch releases it and tells the client
+	assert.Equal(t, ErrUnknownSubscription, hub.Cancel(id, "w2"))
+	assert.Nil(t, hub.Cancel(id, "w1"))
+	assert.Equal(t, "w1", (<-cancels.C()).Data.Uid)
+	_, data, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"code":"cancelled"`)
+	client, _ := hub.Client(id)
+	assert.Empty(t, client.Subscriptions)
+
+	// Disconnected clients are told why
+	assert.Equal(t, ErrUnknownClient, hub.Disconnect("unknown"))
+	assert.Nil(t, hub.Disconnect(id))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+}
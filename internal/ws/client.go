@@ -1,29 +1,35 @@
 package ws
 
 import (
-	"bytes"
-	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.springy.io/api/document"
 	"go.springy.io/internal/event"
-	"log"
+	"go.springy.io/internal/trace"
+	"log/slog"
+	"sync"
 	"time"
 )
 
+// The defaults of the connection options left unset
 const (
 	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+	defaultWriteWait = 10 * time.Second
 
 	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+	defaultPongWait = 60 * time.Second
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	defaultReadLimit = 1 << 20
+
+	// Size of the connection read and write buffers.
+	defaultBufferSize = 4096
 )
 
+// How long clients wait before retrying the requests the node was too busy to take
+const busyRetry = time.Second
+
 var (
 	openBracket  = []byte{'['}
 	closeBracket = []byte{']'}
@@ -33,17 +39,63 @@ var (
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 
+	// The unique connection identifier
+	id string
+
 	// The hub
 	hub *Hub
 
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// Bounded queue of outbound messages.
+	queue *queue
+
+	// Snapshots routed by the hub, waiting to be encoded and queued off the hub goroutine
+	snapshots chan snapshot
 
 	// Deferred requests to process onDisconnect
 	requests map[string]document.DocumentRequest
+
+	// The requests awaiting (or streaming) responses by uid
+	routes map[string]route
+	mutex  sync.Mutex
+
+	// Encodes the messages of the negotiated subprotocol
+	codec Codec
+
+	// The negotiated subprotocol
+	protocol Protocol
+
+	// The trace context of the upgrade request, parenting the requests sent without one
+	trace trace.SpanContext
+
+	// The remote address of the connection
+	remote string
+
+	// The time the client connected
+	connected time.Time
+
+	// The authenticated identity of the client (empty when anonymous)
+	identity string
+
+	// The rate limits of the connection by class of request
+	buckets buckets
+}
+
+// Returns the unique connection identifier
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Returns the authenticated identity of the client
+func (c *Client) Principal() string {
+	return c.identity
+}
+
+// Returns the logger identifying the client
+func (c *Client) log() *slog.Logger {
+	return event.Logger(c)
 }
 
 // read sends messages from the websocket connection to the hub.
@@ -59,33 +111,150 @@ func (c *Client) read() {
 		// Process our onDisconnect requests
 		for k, v := range c.requests {
 			// Publish event to mongo
-			go event.Publish(event.Mongo, c, v)
+			c.hub.buses.Requests.Publish(event.MongoRequest, c, v)
 			delete(c.requests, k)
 		}
+
+		// Let subscribers release anything held for this client
+		c.hub.buses.Connections.Publish(event.Disconnected, c, event.Disconnect{})
+		c.log().Info("client disconnected")
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	options := c.hub.config()
+	c.conn.SetReadLimit(options.ReadLimit)
+	c.conn.SetReadDeadline(time.Now().Add(options.PongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(options.PongWait)); return nil })
 
 	for {
 
 		// Parse the request and send it to Mongo
-		request := document.DocumentRequest{}
-		err := c.conn.ReadJSON(&request)
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
-			log.Printf("error: %v", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.log().Warn("unexpected close", "error", err)
+			}
 			break
 		}
+		request, err := c.codec.Decode(data)
+
+		// Requests are traced under their own trace context, or else the connection's
+		parent := c.trace
+		if p := trace.Parse(request.Traceparent); p.IsValid() {
+			parent = p
+		}
+		span := trace.Start(parent, "ws.read", trace.Server, append(request.LogAttrs(), "connection", c.id, "bytes", len(data))...)
+
+		if err != nil {
+			c.log().Info("invalid request", append(request.LogAttrs(), "error", err)...)
+			// Invalid requests are answered with the reason
+			c.send(map[string]interface{}{
+				"_uid":  request.Uid,
+				"error": document.NewDocumentError(document.InvalidRequest, err),
+			}, span.SpanContext(parent))
+			span.Fail(err)
+			span.End()
+			continue
+		}
+
+		c.log().Debug("request received", request.LogAttrs()...)
+		r := routeOf(request)
+		received.With(r.scope, r.operation).Inc()
 
-		if request.OnDisconnect {
+		// Requests over the limits are answered with the limit exceeded
+		if err := c.limit(request); err != nil {
+			c.log().Info("request limited", append(request.LogAttrs(), "code", err.Code, "error", err.Message)...)
+			c.send(map[string]interface{}{
+				"_uid":  request.Uid,
+				"error": err,
+			}, span.SpanContext(parent))
+			span.Fail(err)
+			span.End()
+			continue
+		}
+		if request.Scope == document.Unwatch {
+			c.unwatch(request, span.SpanContext(parent))
+			span.End()
+			continue
+		}
+		if !request.OnDisconnect {
+			c.mutex.Lock()
+			switch request.Scope {
+			case document.Leave:
+				c.forget(document.Join, request.Channel)
+			case document.Unsubscribe:
+				delete(c.routes, request.Uid)
+			case document.Publish:
+				// Publishes are only answered when they fail, and often reuse the uid of the
+				// subscription to the channel, so they are never routed
+			default:
+				c.routes[request.Uid] = r
+			}
+			c.mutex.Unlock()
+		}
+
+		switch {
+		case request.Scope == document.Join || request.Scope == document.Leave:
+			// Presence requests never touch the database directly
+			c.publish(event.PresenceRequest, request, span.SpanContext(parent))
+		case request.Scope == document.Subscribe || request.Scope == document.Unsubscribe || request.Scope == document.Publish:
+			// Ephemeral messages are routed without touching storage
+			c.publish(event.PubSubRequest, request, span.SpanContext(parent))
+		case request.OnDisconnect:
 			// Defer the request to process on disconnect
 			c.requests[request.Uid] = request
-		} else {
+		default:
 			// Immediately process the requests
-			go event.Publish(event.Mongo, c, request)
+			c.publish(event.MongoRequest, request, span.SpanContext(parent))
 		}
+		span.End()
+	}
+}
+
+// Cancels the watch opened under the uid of the request, freeing its route and its place in the
+// watches of the connection
+func (c *Client) unwatch(request document.DocumentRequest, parent trace.SpanContext) {
+	c.mutex.Lock()
+	r, ok := c.routes[request.Uid]
+	if ok && r.scope == document.Watch.String() {
+		delete(c.routes, request.Uid)
+	}
+	c.mutex.Unlock()
+	if !ok || r.scope != document.Watch.String() {
+		c.send(map[string]interface{}{
+			"_uid":  request.Uid,
+			"error": &document.DocumentError{Code: document.InvalidRequest, Message: fmt.Sprintf("uid '%s' is not an open watch", request.Uid)},
+		}, parent)
+		return
+	}
+	request.Collection = r.collection
+	c.publish(event.CancelRequest, request, parent)
+}
+
+// Publishes a request on the topic, passing the trace context of the publish on to its subscribers.
+// Requests no subscriber took in time, such as database requests waiting on busy request slots,
+// are answered with a rate limited error instead of being dropped silently.
+func (c *Client) publish(topic event.Topic, request document.DocumentRequest, parent trace.SpanContext) {
+	span := trace.Continue(parent, "event.publish", trace.Producer, "topic", topic)
+	defer span.End()
+
+	request.Traceparent = span.SpanContext(parent).Traceparent()
+	delivered := c.hub.buses.Requests.Publish(topic, c, request)
+	span.SetAttributes("delivered", delivered)
+	if delivered > 0 {
+		return
+	}
+
+	err := &document.DocumentError{
+		Code:       document.RateLimited,
+		Message:    "the server is busy, retry later",
+		RetryAfter: busyRetry.Milliseconds(),
 	}
+	c.log().Warn("request dropped", append(request.LogAttrs(), "topic", topic, "error", err.Message)...)
+	span.Fail(err)
+	c.send(map[string]interface{}{
+		"_uid":  request.Uid,
+		"error": err,
+	}, span.SpanContext(parent))
 }
 
 // write sends messages from the hub to the websocket connection.
@@ -94,42 +263,49 @@ func (c *Client) read() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) write() {
-	ticker := time.NewTicker(pingPeriod)
+	options := c.hub.config()
+	writeWait := options.WriteWait
+
+	// Send pings to peer with this period. Must be less than the pong wait.
+	ticker := time.NewTicker((options.PongWait * 9) / 10)
 
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+
+		// Discard what the client will never receive
+		c.queue.close()
+		messages, _, _, _ := c.queue.drain()
+		end(messages, errDropped)
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.queue.ready:
+			messages, dropped, closed, overflowed := c.queue.drain()
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Print("c.conn.NextWriter", err)
-				return
+			// Let the client know it fell behind ahead of the remaining messages
+			if dropped > 0 || overflowed {
+				messages = append([]message{{data: c.behind(dropped, overflowed)}}, messages...)
 			}
-
-			w.Write(openBracket)
-			w.Write(message)
-			n := len(c.send)
-
-			// Add queued messages to the array
-			for i := 0; i < n; i++ {
-				w.Write(comma)
-				w.Write(<-c.send)
+			if len(messages) > 0 {
+				err := c.writeBatch(messages)
+				end(messages, err)
+				if err != nil {
+					c.log().Warn("unable to write to client", "error", err)
+					return
+				}
 			}
 
-			w.Write(closeBracket)
-
-			if err := w.Close(); err != nil {
+			if closed {
+				if overflowed {
+					c.log().Warn("disconnecting slow client", "dropped", dropped)
+					c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer"))
+				} else {
+					// The hub closed the queue.
+					c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				}
 				return
 			}
 		case <-ticker.C:
@@ -141,13 +317,131 @@ func (c *Client) write() {
 	}
 }
 
+// Writes the queued messages as a single frame
+func (c *Client) writeBatch(messages []message) error {
+	data := make([][]byte, len(messages))
+	for i, m := range messages {
+		data[i] = m.data
+	}
+	return c.conn.WriteMessage(c.codec.MessageType(), c.codec.Batch(data))
+}
+
+// Returns the message notifying the client it fell behind
+func (c *Client) behind(dropped int, overflowed bool) []byte {
+	err := &document.DocumentError{
+		Code:    document.SlowConsumer,
+		Message: fmt.Sprintf("%d messages were dropped", dropped),
+	}
+	if overflowed {
+		err.Message = "disconnected for falling behind"
+	}
+	message, _ := c.codec.Encode(bson.M{"error": err, "dropped": dropped})
+	return message
+}
+
+// A snapshot routed by the hub to the client
+type snapshot struct {
+	data   map[string]interface{}
+	parent trace.SpanContext
+}
+
+// Hands a snapshot routed by the hub over to the encoder, counting it as dropped when the encoder
+// fell behind. Only the hub goroutine delivers snapshots, until it unregisters the client.
+func (c *Client) deliver(data map[string]interface{}, parent trace.SpanContext) {
+	select {
+	case c.snapshots <- snapshot{data: data, parent: parent}:
+	default:
+		c.queue.reject()
+	}
+}
+
+// encode queues the snapshots routed by the hub, keeping their encoding off the hub goroutine.
+//
+// A goroutine running encode is started for each connection, ending once the hub unregisters
+// the client.
+func (c *Client) encode() {
+	for s := range c.snapshots {
+		c.send(s.data, s.parent)
+	}
+}
+
+// Queues a response, dropping it if the client is gone
 func (c *Client) writeResponse(data map[string]interface{}) {
-	message, _ := json.Marshal(data)
-	buffer := new(bytes.Buffer)
-	error := json.Compact(buffer, message)
-	if error != nil {
-		log.Print("💩 Error compacting JSON: ", error)
+	c.send(data, trace.SpanContext{})
+}
+
+// Queues a response answering a request traced under the parent, tracing it until it is written
+func (c *Client) send(data map[string]interface{}, parent trace.SpanContext) {
+	message, err := c.codec.Encode(data)
+	if err != nil {
+		c.log().Error("unable to encode response", "error", err)
 		return
 	}
-	c.hub.broadcast <- buffer.Bytes()
+	m := c.message(data, message)
+	m.span = trace.Continue(parent, "ws.write", trace.Internal, "connection", c.id, "bytes", len(message))
+	if c.queue.push(m) {
+		r := c.route(data)
+		sent.With(r.scope, r.operation).Inc()
+	}
+}
+
+// Forgets the routes of the scope on the channel. The caller must hold the lock.
+func (c *Client) forget(scope document.DocumentScope, channel string) {
+	for uid, r := range c.routes {
+		if r.scope == scope.String() && r.channel == channel {
+			delete(c.routes, uid)
+		}
+	}
+}
+
+// Returns the route of the request a response answers, forgetting requests answered once, and the
+// watches, joins and subscriptions ended (or denied) by an error
+func (c *Client) route(data map[string]interface{}) route {
+	uid, _ := data["_uid"].(string)
+	_, failed := data["error"]
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	r, ok := c.routes[uid]
+	if !ok {
+		return route{scope: "none"}
+	}
+	switch r.scope {
+	case document.Find.String(), document.FindOne.String(), document.Write.String():
+		delete(c.routes, uid)
+	case document.Watch.String(), document.Join.String():
+		if failed {
+			delete(c.routes, uid)
+		}
+	case document.Subscribe.String():
+		// Failed publishes are answered under the uid of the subscription too
+		if scope, _ := data["_scope"].(string); failed && scope == r.scope {
+			delete(c.routes, uid)
+		}
+	}
+	return r
+}
+
+// Returns the queued form of a response, keyed by watch and document for coalescing
+func (c *Client) message(data map[string]interface{}, encoded []byte) message {
+	m := message{data: encoded}
+	uid, _ := data["_uid"].(string)
+
+	c.mutex.Lock()
+	watched := c.routes[uid].scope == document.Watch.String()
+	c.mutex.Unlock()
+	if !watched {
+		return m
+	}
+
+	var id interface{}
+	switch value := data["value"].(type) {
+	case bson.M:
+		id = value["_id"]
+	case map[string]interface{}:
+		id = value["_id"]
+	}
+	if id != nil {
+		m.key = fmt.Sprintf("%s/%v", uid, id)
+	}
+	return m
 }
@@ -0,0 +1,125 @@
+package ws
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/internal/event"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoutes(t *testing.T) {
+
+	buses := event.NewBuses("node", event.Options{Buffer: 64})
+	requests := buses.Requests.Subscribe(event.PubSubRequest)
+	joins := buses.Requests.Subscribe(event.PresenceRequest)
+
+	hub := NewHub(buses, Options{})
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(hub.Upgrade))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+	routes := func() int {
+		clients := hub.Clients()
+		assert.Len(t, clients, 1)
+		return len(clients[0].Subscriptions)
+	}
+
+	// Publishes are never answered when they succeed, so they are never routed
+	for i := 0; i < 32; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"_uid": "p%d", "scope": "publish", "channel": "chat", "value": {}}`, i)))
+		<-requests.C()
+	}
+	assert.Equal(t, 0, routes())
+
+	// Subscriptions and joins are forgotten when cancelled
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "s1", "scope": "subscribe", "channel": "chat"}`))
+	<-requests.C()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "j1", "scope": "join", "channel": "lobby"}`))
+	<-joins.C()
+	assert.Equal(t, 2, routes())
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "s1", "scope": "unsubscribe", "channel": "chat"}`))
+	<-requests.C()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "j2", "scope": "leave", "channel": "lobby"}`))
+	<-joins.C()
+	assert.Equal(t, 0, routes())
+}
+
+func TestUnwatch(t *testing.T) {
+
+	buses := event.NewBuses("node", event.Options{Buffer: 8})
+	watches := buses.Requests.Subscribe(event.MongoRequest)
+	cancels := buses.Requests.Subscribe(event.CancelRequest)
+
+	hub := NewHub(buses, Options{Limits: Limits{MaxWatches: 1}})
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(hub.Upgrade))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+	watch := func(uid string) {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "`+uid+`", "scope": "watch", "collection": "users", "operation": "insert"}`))
+	}
+	unwatch := func(uid string) {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "`+uid+`", "scope": "unwatch"}`))
+	}
+	read := func() string {
+		_, data, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		return string(data)
+	}
+
+	watch("w1")
+	assert.Equal(t, "w1", (<-watches.C()).Data.Uid)
+	watch("w2")
+	assert.Contains(t, read(), `"code":"quota_exceeded"`)
+
+	// Unwatching cancels the watch and frees its place
+	unwatch("w1")
+	cancel := <-cancels.C()
+	assert.Equal(t, "w1", cancel.Data.Uid)
+	assert.Equal(t, "users", cancel.Data.Collection)
+	watch("w2")
+	assert.Equal(t, "w2", (<-watches.C()).Data.Uid)
+
+	// Only open watches can be unwatched
+	unwatch("w1")
+	assert.Contains(t, read(), `uid 'w1' is not an open watch`)
+}
+
+func TestBusy(t *testing.T) {
+
+	// The database requests fill their buffer while every request slot is busy
+	buses := event.NewBuses("node", event.Options{Buffer: 1, Timeout: 10 * time.Millisecond})
+	requests := buses.Requests.Subscribe(event.MongoRequest)
+	defer requests.Unsubscribe()
+
+	hub := NewHub(buses, Options{})
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(hub.Upgrade))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "1", "scope": "find", "collection": "users"}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"_uid": "2", "scope": "find", "collection": "users"}`))
+
+	// The request the node could not take is answered rather than dropped
+	_, data, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"_uid":"2"`)
+	assert.Contains(t, string(data), `"code":"rate_limited"`)
+	assert.Contains(t, string(data), `"retryAfter":1000`)
+	assert.Equal(t, "1", (<-requests.C()).Data.Uid)
+}
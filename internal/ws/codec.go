@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/msgpack"
+	"strconv"
+)
+
+// Codec encodes the messages exchanged with a client over a subprotocol
+type Codec interface {
+
+	// Returns the websocket message type of the frames
+	MessageType() int
+
+	// Strictly decodes a request sent by the client (see document.DecodeRequest)
+	Decode(data []byte) (document.DocumentRequest, error)
+
+	// Encodes a response
+	Encode(response interface{}) ([]byte, error)
+
+	// Combines encoded responses into a single frame
+	Batch(messages [][]byte) []byte
+}
+
+// Returns the codec of the encoding
+func newCodec(encoding string, canonical bool) Codec {
+	switch encoding {
+	case MsgPack:
+		return msgpackCodec{}
+	case BSON:
+		return bsonCodec{}
+	}
+	return jsonCodec{canonical: canonical}
+}
+
+// Exchanges extended json text frames, batched in json arrays
+type jsonCodec struct {
+
+	// Flag indicating if responses are canonical (rather than relaxed) extended json
+	canonical bool
+}
+
+func (c jsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (c jsonCodec) Decode(data []byte) (document.DocumentRequest, error) {
+	return document.DecodeRequest(data)
+}
+
+func (c jsonCodec) Encode(response interface{}) ([]byte, error) {
+	return document.MarshalResponse(response, c.canonical)
+}
+
+func (c jsonCodec) Batch(messages [][]byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Write(openBracket)
+	for i, message := range messages {
+		if i > 0 {
+			buffer.Write(comma)
+		}
+		buffer.Write(message)
+	}
+	buffer.Write(closeBracket)
+	return buffer.Bytes()
+}
+
+// Exchanges MessagePack binary frames, batched in MessagePack arrays. Values have the same shape
+// as relaxed extended json (dates are {"$date": ...} maps and so on).
+type msgpackCodec struct{}
+
+func (c msgpackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (c msgpackCodec) Decode(data []byte) (document.DocumentRequest, error) {
+	value, err := msgpack.Unmarshal(data)
+	if err != nil {
+		return document.DocumentRequest{}, err
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return document.DocumentRequest{}, errors.New("request is not a map")
+	}
+	// Requests are decoded through extended json, like json requests
+	b, err := json.Marshal(value)
+	if err != nil {
+		return document.DocumentRequest{}, err
+	}
+	return document.DecodeRequest(b)
+}
+
+func (c msgpackCodec) Encode(response interface{}) ([]byte, error) {
+	b, err := document.MarshalResponse(response, false)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(value)
+}
+
+func (c msgpackCodec) Batch(messages [][]byte) []byte {
+	frame := msgpack.ArrayHeader(len(messages))
+	for _, message := range messages {
+		frame = append(frame, message...)
+	}
+	return frame
+}
+
+// Exchanges BSON binary frames. Each frame is a document whose "messages" array holds the batch.
+type bsonCodec struct{}
+
+func (c bsonCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (c bsonCodec) Decode(data []byte) (document.DocumentRequest, error) {
+	var value bson.M
+	if err := bson.Unmarshal(data, &value); err != nil {
+		return document.DocumentRequest{}, err
+	}
+	// Requests are decoded through canonical extended json, preserving the bson types
+	b, err := bson.MarshalExtJSON(value, true, false)
+	if err != nil {
+		return document.DocumentRequest{}, err
+	}
+	return document.DecodeRequest(b)
+}
+
+func (c bsonCodec) Encode(response interface{}) ([]byte, error) {
+	return bson.Marshal(response)
+}
+
+func (c bsonCodec) Batch(messages [][]byte) []byte {
+	// The array is a document keyed by index, embedding each message as a document
+	var array []byte
+	for i, message := range messages {
+		array = append(array, byte(bson.TypeEmbeddedDocument))
+		array = append(array, strconv.Itoa(i)...)
+		array = append(array, 0)
+		array = append(array, message...)
+	}
+	array = appendDocument(nil, array)
+
+	elements := append([]byte{byte(bson.TypeArray)}, "messages\x00"...)
+	return appendDocument(nil, append(elements, array...))
+}
+
+// Appends a document holding the encoded elements
+func appendDocument(b []byte, elements []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(elements)+5))
+	b = append(b, elements...)
+	return append(b, 0)
+}
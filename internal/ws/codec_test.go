@@ -0,0 +1,62 @@
+package ws
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/msgpack"
+	"testing"
+)
+
+func TestMsgPackCodec(t *testing.T) {
+
+	codec := newCodec(MsgPack, false)
+	data, _ := msgpack.Marshal(map[string]interface{}{
+		"_uid":       "1",
+		"collection": "users",
+		"scope":      "findOne",
+		"query":      map[string]interface{}{"count": map[string]interface{}{"$numberLong": "2"}},
+	})
+
+	request, err := codec.Decode(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", request.Uid)
+	assert.Equal(t, document.FindOne, request.Scope)
+	assert.Equal(t, int64(2), request.Query["count"])
+
+	first, err := codec.Encode(bson.M{"_uid": "1", "value": bson.M{"count": int32(2)}})
+	assert.Nil(t, err)
+	second, _ := codec.Encode(bson.M{"_uid": "2"})
+
+	batch, err := msgpack.Unmarshal(codec.Batch([][]byte{first, second}))
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"_uid": "1", "value": map[string]interface{}{"count": int64(2)}},
+		map[string]interface{}{"_uid": "2"},
+	}, batch)
+
+	_, err = codec.Decode([]byte{0x01})
+	assert.NotNil(t, err)
+}
+
+func TestBSONCodec(t *testing.T) {
+
+	codec := newCodec(BSON, false)
+	data, _ := bson.Marshal(bson.M{"_uid": "1", "collection": "users", "scope": "write", "operation": "insert", "value": bson.M{"count": int32(2)}})
+
+	request, err := codec.Decode(data)
+	assert.Nil(t, err)
+	assert.Equal(t, document.Write, request.Scope)
+	assert.Equal(t, document.Insert, request.Operation)
+	assert.Equal(t, int32(2), request.Value["count"])
+
+	first, err := codec.Encode(bson.M{"_uid": "1"})
+	assert.Nil(t, err)
+	second, _ := codec.Encode(bson.M{"_uid": "2"})
+
+	var batch struct {
+		Messages []bson.M `bson:"messages"`
+	}
+	assert.Nil(t, bson.Unmarshal(codec.Batch([][]byte{first, second}), &batch))
+	assert.Equal(t, []bson.M{{"_uid": "1"}, {"_uid": "2"}}, batch.Messages)
+}
@@ -1,100 +1,375 @@
 package ws
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"go.springy.io/api/document"
 	"go.springy.io/internal/event"
-	"log"
+	"go.springy.io/internal/trace"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// Configures the client connections
+type Options struct {
+
+	// The maximum size of a message read from a client
+	ReadLimit int64
+
+	// Time allowed to write a message to a client
+	WriteWait time.Duration
+
+	// Time allowed to read the next pong message from a client
+	PongWait time.Duration
+
+	// The size of the connection read and write buffers
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Flag indicating if permessage-deflate compression is negotiated with clients
+	Compression bool
+
+	// The compression level (see compress/flate, zero uses the default)
+	CompressionLevel int
+
+	// The origins allowed to connect, as path.Match patterns such as "https://*.example.com" or
+	// "*" for any origin. Only same origin requests are allowed when empty.
+	AllowedOrigins []string
+
+	// The maximum number of queued messages (zero is unlimited)
+	MaxMessages int
+
+	// The maximum number of queued bytes (zero is unlimited)
+	MaxBytes int
+
+	// What happens when a client's queue is full
+	Policy Policy
+
+	// The rate limits and quotas of the client requests
+	Limits Limits
+
+	// Returns the authenticated identity of an upgrade request, such as the subject of its verified
+	// client certificate (empty when anonymous). Every client is anonymous when nil.
+	Identify func(r *http.Request) string
 }
 
-// Hub maintains the set of active clients and broadcasts messages to the clients.
+// Hub maintains the set of active clients and routes snapshots to the clients they are addressed to.
 type Hub struct {
 
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Registered clients by connection identifier, guarded for the admin API.
+	ids   map[string]*Client
+	mutex sync.RWMutex
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// The buses connecting the hub to the other subsystems
+	buses *event.Buses
+
+	// The client connection options, replaced by Reconfigure
+	options atomic.Pointer[Options]
+
+	// Upgrades http requests to websocket connections
+	upgrader websocket.Upgrader
+
+	// The slow consumer metrics
+	metrics *Metrics
+
+	// Liveness checks answered by the hub loop
+	ping chan chan struct{}
+
+	// The rate limits shared by the connections of an identity, and by the requests to a collection
+	identities  buckets
+	collections buckets
 }
 
-var (
-	hub  *Hub
-	once sync.Once
-)
+// Creates a new hub publishing client requests to (and writing snapshots from) the buses
+func NewHub(buses *event.Buses, options Options) *Hub {
+	slog.Info("initializing hub", "node", buses.Node)
+	options = withDefaults(options)
+	hub := &Hub{
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		clients:    make(map[*Client]bool),
+		ids:        make(map[string]*Client),
+		buses:      buses,
+		metrics:    &Metrics{},
+		ping:       make(chan chan struct{}),
+
+		identities:  newBuckets(),
+		collections: newBuckets(),
+	}
+	hub.options.Store(&options)
+	hub.upgrader = websocket.Upgrader{
+		ReadBufferSize:    options.ReadBufferSize,
+		WriteBufferSize:   options.WriteBufferSize,
+		EnableCompression: options.Compression,
+		Subprotocols:      supportedProtocols(),
+		CheckOrigin: func(r *http.Request) bool {
+			return checkOrigin(hub.config().AllowedOrigins)(r)
+		},
+	}
+	return hub
+}
+
+// Replaces the client connection options without disconnecting the clients. The queue limits and
+// policy apply to every client at once, the allowed origins to the next upgrades and the other
+// limits to the clients connecting from now on. The buffer sizes and compression are kept.
+func (hub *Hub) Reconfigure(options Options) {
+	options = withDefaults(options)
+	current := hub.config()
+	options.ReadBufferSize = current.ReadBufferSize
+	options.WriteBufferSize = current.WriteBufferSize
+	options.Compression = current.Compression
+	options.CompressionLevel = current.CompressionLevel
+	hub.options.Store(&options)
+
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	for _, client := range hub.ids {
+		client.queue.configure(options)
+	}
+}
+
+// Returns the client connection options in effect
+func (hub *Hub) config() *Options {
+	return hub.options.Load()
+}
+
+// Returns the options with the defaults of the options left unset
+func withDefaults(options Options) Options {
+	if options.ReadLimit <= 0 {
+		options.ReadLimit = defaultReadLimit
+	}
+	if options.WriteWait <= 0 {
+		options.WriteWait = defaultWriteWait
+	}
+	if options.PongWait <= 0 {
+		options.PongWait = defaultPongWait
+	}
+	if options.ReadBufferSize <= 0 {
+		options.ReadBufferSize = defaultBufferSize
+	}
+	if options.WriteBufferSize <= 0 {
+		options.WriteBufferSize = defaultBufferSize
+	}
+	return options
+}
 
-func init() {
-	log.Println("🌱 [Initializing Hub] 🌱")
-	once.Do(func() {
-		hub = &Hub{
-			broadcast:  make(chan []byte),
-			register:   make(chan *Client),
-			unregister: make(chan *Client),
-			clients:    make(map[*Client]bool),
+// Returns a function allowing the requests from the origins matching the patterns, or from the
+// same origin when there are none
+func checkOrigin(patterns []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := strings.ToLower(r.Header.Get("Origin"))
+		if origin == "" {
+			// Not a browser
+			return true
+		}
+		if len(patterns) == 0 {
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		}
+		for _, pattern := range patterns {
+			if pattern == "*" {
+				return true
+			}
+			if matched, _ := path.Match(strings.ToLower(pattern), origin); matched {
+				return true
+			}
 		}
-	})
+		return false
+	}
+}
+
+// Returns the slow consumer metrics
+func (hub *Hub) Metrics() *Metrics {
+	return hub.metrics
+}
+
+// Returns nil once the hub loop answers, or the context error if it does not in time
+func (hub *Hub) Ping(ctx context.Context) error {
+	pong := make(chan struct{})
+	select {
+	case hub.ping <- pong:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-pong:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Performs the ws upgrade
-func Upgrade(w http.ResponseWriter, r *http.Request) {
+func (hub *Hub) Upgrade(w http.ResponseWriter, r *http.Request) {
+
+	offered := websocket.Subprotocols(r)
+	if len(offered) > 0 && !supported(offered) {
+		hub.reject(w, r, offered)
+		return
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := hub.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Println("💩", err)
+		slog.Warn("unable to upgrade connection", "remote", r.RemoteAddr, "error", err)
 		return
 	}
+	options := hub.config()
+	if options.Compression && options.CompressionLevel != 0 {
+		conn.SetCompressionLevel(options.CompressionLevel)
+	}
+
+	// Clients not negotiating a subprotocol speak json version 1
+	protocol := Protocol{Encoding: JSON, Version: MinVersion}
+	if p, ok := ParseProtocol(conn.Subprotocol()); ok {
+		protocol = p
+	}
+
+	// Json responses are relaxed extended json unless the client asks for canonical (?extjson=canonical)
+	canonical := r.URL.Query().Get("extjson") == "canonical"
+	codec := newCodec(protocol.Encoding, canonical)
+
+	client := &Client{
+		id:        NewID(),
+		hub:       hub,
+		conn:      conn,
+		queue:     newQueue(*options, hub.metrics),
+		snapshots: make(chan snapshot, snapshotBuffer(*options)),
+		requests:  make(map[string]document.DocumentRequest),
+		routes:    make(map[string]route),
+		codec:     codec,
+		protocol:  protocol,
+		trace:     trace.Parse(r.Header.Get("traceparent")),
+		buckets:   newBuckets(),
 
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), requests: make(map[string]document.DocumentRequest)}
+		remote:    r.RemoteAddr,
+		connected: time.Now(),
+	}
+	if options.Identify != nil {
+		client.identity = options.Identify(r)
+	}
 	client.hub.register <- client
+	client.log().Info("client connected", "remote", r.RemoteAddr, "protocol", protocol.String(), "identity", client.identity)
+
+	if protocol.Version >= 2 {
+		client.writeResponse(hello(client))
+	}
 
 	// Allow collection of memory referenced by the caller by doing all work in new goroutines.
 	go client.write()
 	go client.read()
+	go client.encode()
+}
+
+// Returns the number of snapshots waiting to be encoded before the client is considered behind
+func snapshotBuffer(options Options) int {
+	if options.MaxMessages > 0 {
+		return options.MaxMessages
+	}
+	return 256
+}
+
+// Returns true if any of the offered subprotocols is supported
+func supported(offered []string) bool {
+	for _, name := range offered {
+		if _, ok := ParseProtocol(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejects a client offering only unsupported subprotocols. Browsers fail connections answered
+// without one of the offered subprotocols before seeing a close frame, so the connection is
+// upgraded with the first offered subprotocol and closed with a code telling the client why.
+func (hub *Hub) reject(w http.ResponseWriter, r *http.Request, offered []string) {
+	slog.Warn("rejected unsupported protocols", "remote", r.RemoteAddr, "protocols", strings.Join(offered, ", "))
+
+	upgrader := websocket.Upgrader{CheckOrigin: hub.upgrader.CheckOrigin}
+	conn, err := upgrader.Upgrade(w, r, http.Header{"Sec-Websocket-Protocol": {offered[0]}})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reason := fmt.Sprintf("unsupported protocol, use springy.<json|msgpack|bson>.v%d to v%d", MinVersion, Version)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseUnsupportedProtocol, reason), time.Now().Add(hub.config().WriteWait))
+}
+
+// Generates a random connection (or node) identifier
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-func Run() {
+func (hub *Hub) Run() {
 
-	// Subscribe to websocket events
-	subscriber := make(chan event.Event)
-	event.Subscribe(event.Websocket, subscriber)
+	// Subscribe to snapshots addressed to clients
+	snapshots := hub.buses.Snapshots.Subscribe(event.Snapshot)
+	defer snapshots.Unsubscribe()
 
 	for {
 		select {
-		case e := <-subscriber:
-			if client, ok := e.Sender.(*Client); ok {
-				if snapshot, ok := e.Data.(document.DocumentSnapshot); ok {
-					go client.writeResponse(snapshot.Value)
-				}
+		case e := <-snapshots.C():
+			parent := trace.Parse(e.Data.Traceparent)
+			span := trace.Continue(parent, "hub.route", trace.Consumer)
+			if client, ok := hub.recipient(e.Sender); ok {
+				span.SetAttributes("connection", client.id)
+				client.deliver(e.Data.Value, span.SpanContext(parent))
 			}
+			span.End()
+		case pong := <-hub.ping:
+			close(pong)
 		case client := <-hub.register:
 			hub.clients[client] = true
+			hub.mutex.Lock()
+			hub.ids[client.id] = client
+			hub.mutex.Unlock()
+			hub.metrics.Clients.Add(1)
 		case client := <-hub.unregister:
 			if _, ok := hub.clients[client]; ok {
 				delete(hub.clients, client)
-				close(client.send)
-			}
-		case message := <-hub.broadcast:
-			for client := range hub.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(hub.clients, client)
-				}
+				hub.mutex.Lock()
+				delete(hub.ids, client.id)
+				hub.mutex.Unlock()
+				hub.metrics.Clients.Add(-1)
+				client.queue.close()
+				close(client.snapshots)
 			}
 		}
 	}
 }
+
+// Returns the client a snapshot is addressed to, looking up the senders connected to this node
+// through another node by connection identifier. Snapshots addressed to clients the hub already
+// unregistered have no recipient, as their snapshot channel is closed.
+func (hub *Hub) recipient(sender interface{}) (*Client, bool) {
+	switch s := sender.(type) {
+	case *Client:
+		return s, hub.clients[s]
+	case event.RemoteSender:
+		if s.Node == hub.buses.Node {
+			client, ok := hub.ids[s.Connection]
+			return client, ok
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,136 @@
+package ws
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/event"
+	"go.springy.io/internal/msgpack"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckOrigin(t *testing.T) {
+
+	request := func(host, origin string) bool {
+		r := httptest.NewRequest("GET", "http://"+host+"/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return checkOrigin(nil)(r)
+	}
+	assert.True(t, request("localhost:8080", ""))
+	assert.True(t, request("localhost:8080", "http://localhost:8080"))
+	assert.False(t, request("localhost:8080", "http://evil.com"))
+
+	allowed := checkOrigin([]string{"https://*.example.com", "http://localhost:3000"})
+	r := httptest.NewRequest("GET", "http://api.example.com/ws", nil)
+	for origin, ok := range map[string]bool{
+		"https://app.example.com": true,
+		"https://APP.example.com": true,
+		"http://localhost:3000":   true,
+		"http://app.example.com":  false,
+		"https://example.com":     false,
+		"https://evil.com":        false,
+	} {
+		r.Header.Set("Origin", origin)
+		assert.Equal(t, ok, allowed(r), origin)
+	}
+
+	r.Header.Set("Origin", "https://anything.test")
+	assert.True(t, checkOrigin([]string{"*"})(r))
+}
+
+func TestHandshake(t *testing.T) {
+
+	hub := NewHub(event.NewBuses("node", event.Options{}), Options{})
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(hub.Upgrade))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Version 2 starts with a hello message
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Sec-Websocket-Protocol": {"springy.msgpack.v2, springy.json.v1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "springy.msgpack.v2", conn.Subprotocol())
+	kind, data, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.BinaryMessage, kind)
+	batch, err := msgpack.Unmarshal(data)
+	assert.Nil(t, err)
+	messages := batch.([]interface{})
+	assert.Equal(t, "hello", messages[0].(map[string]interface{})["_type"])
+	assert.Equal(t, int64(2), messages[0].(map[string]interface{})["version"])
+	conn.Close()
+
+	// Previous versions are still supported
+	conn, _, err = websocket.DefaultDialer.Dial(url, http.Header{"Sec-Websocket-Protocol": {"springy.json.v1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "springy.json.v1", conn.Subprotocol())
+	conn.Close()
+
+	// Unknown versions are closed with a clear close code
+	conn, _, err = websocket.DefaultDialer.Dial(url, http.Header{"Sec-Websocket-Protocol": {"springy.json.v9"}})
+	assert.Nil(t, err)
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseUnsupportedProtocol))
+	conn.Close()
+}
+
+func TestPing(t *testing.T) {
+
+	hub := NewHub(event.NewBuses("node", event.Options{}), Options{})
+
+	// The hub loop is not running yet
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, hub.Ping(ctx))
+
+	go hub.Run()
+	assert.Nil(t, hub.Ping(context.Background()))
+}
+
+func TestReconfigure(t *testing.T) {
+
+	hub := NewHub(event.NewBuses("node", event.Options{}), Options{Compression: true})
+	r := httptest.NewRequest("GET", "http://localhost:8080/ws", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	assert.False(t, hub.upgrader.CheckOrigin(r))
+
+	// The allowed origins apply to the next upgrades, the compression is kept
+	hub.Reconfigure(Options{AllowedOrigins: []string{"https://*.example.com"}, MaxMessages: 8})
+	assert.True(t, hub.upgrader.CheckOrigin(r))
+	assert.True(t, hub.config().Compression)
+	assert.Equal(t, 8, hub.config().MaxMessages)
+	assert.Equal(t, int64(defaultReadLimit), hub.config().ReadLimit)
+}
+
+func TestSnapshotAfterDisconnect(t *testing.T) {
+
+	buses := event.NewBuses("node", event.Options{})
+	hub := NewHub(buses, Options{})
+	go hub.Run()
+	assert.Nil(t, hub.Ping(context.Background()))
+
+	connect := func() *Client {
+		client := &Client{id: NewID(), hub: hub, queue: newQueue(*hub.config(), hub.metrics), snapshots: make(chan snapshot, 1)}
+		hub.register <- client
+		return client
+	}
+	gone, connected := connect(), connect()
+	hub.unregister <- gone
+
+	// Snapshots addressed to an unregistered client are dropped, the hub keeps routing
+	buses.Snapshots.Publish(event.Snapshot, gone, document.DocumentSnapshot{Value: map[string]interface{}{"_uid": "1"}})
+	buses.Snapshots.Publish(event.Snapshot, connected, document.DocumentSnapshot{Value: map[string]interface{}{"_uid": "2"}})
+	select {
+	case s := <-connected.snapshots:
+		assert.Equal(t, "2", s.data["_uid"])
+	case <-time.After(time.Second):
+		t.Fatal("snapshot was not routed")
+	}
+}
@@ -0,0 +1,144 @@
+package ws
+
+import (
+	"fmt"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/metrics"
+	"go.springy.io/internal/ratelimit"
+	"time"
+)
+
+var limited = metrics.NewCounterVec("springy_requests_limited_total", "Requests rejected by the rate limits and quotas.", "class", "limit")
+
+// The classes of requests limited separately
+type class int
+
+const (
+	// Reads (find and findOne)
+	reads class = iota
+	// Writes to collections, and publishes to channels
+	writes
+	// Watches of collections, and subscriptions and joins of channels
+	watches
+	classes
+)
+
+var className = [classes]string{"reads", "writes", "watches"}
+
+// Returns the class of a request, returning false for the requests that are never limited (leaves
+// and unsubscriptions)
+func classOf(request document.DocumentRequest) (class, bool) {
+	switch request.Scope {
+	case document.Find, document.FindOne:
+		return reads, true
+	case document.Write, document.Publish:
+		return writes, true
+	case document.Watch, document.Subscribe, document.Join:
+		return watches, true
+	}
+	return 0, false
+}
+
+// Rates are the request rates of each class
+type Rates struct {
+	Reads   ratelimit.Rate
+	Writes  ratelimit.Rate
+	Watches ratelimit.Rate
+}
+
+// Returns the rate of the class
+func (r Rates) of(c class) ratelimit.Rate {
+	return [classes]ratelimit.Rate{r.Reads, r.Writes, r.Watches}[c]
+}
+
+// Limits caps the rates of the client requests per connection, per authenticated identity (across
+// the connections of this node) and per collection, and the concurrent watches of a connection.
+// Zero rates and caps are unlimited.
+type Limits struct {
+	Connection Rates
+	Identity   Rates
+	Collection Rates
+
+	// The maximum number of watches open at once on a connection
+	MaxWatches int
+}
+
+// The token buckets of the rate limits of a class
+type buckets [classes]*ratelimit.Buckets
+
+func newBuckets() buckets {
+	var b buckets
+	for c := range b {
+		b[c] = ratelimit.NewBuckets()
+	}
+	return b
+}
+
+// Returns nil if the limits in effect allow the request, or the error answering it
+func (c *Client) limit(request document.DocumentRequest) *document.DocumentError {
+
+	// Replacing the route of an open watch would leave the watch open, uncounted by its quota
+	if request.Scope != document.Watch && request.Scope != document.Publish && request.Scope != document.Unwatch && c.watched(request.Uid) {
+		return &document.DocumentError{
+			Code:    document.InvalidRequest,
+			Message: fmt.Sprintf("uid '%s' is used by an open watch", request.Uid),
+		}
+	}
+
+	class, ok := classOf(request)
+	if !ok {
+		return nil
+	}
+	limits := c.hub.config().Limits
+	now := time.Now()
+
+	if class == watches && request.Scope == document.Watch && limits.MaxWatches > 0 && c.watching(request.Uid) >= limits.MaxWatches {
+		limited.With(className[class], "watches").Inc()
+		return &document.DocumentError{
+			Code:    document.QuotaExceeded,
+			Message: fmt.Sprintf("%d watches open at most per connection, unwatch a watch first", limits.MaxWatches),
+		}
+	}
+
+	names := []string{"connection"}
+	tokens := []ratelimit.Token{{Buckets: c.buckets[class], Rate: limits.Connection.of(class)}}
+	if c.identity != "" {
+		names = append(names, "identity")
+		tokens = append(tokens, ratelimit.Token{Buckets: c.hub.identities[class], Key: c.identity, Rate: limits.Identity.of(class)})
+	}
+	if request.Collection != "" {
+		names = append(names, "collection")
+		tokens = append(tokens, ratelimit.Token{Buckets: c.hub.collections[class], Key: request.Collection, Rate: limits.Collection.of(class)})
+	}
+
+	// The tokens of every limit are taken at once, so rejected requests cost nothing
+	if i, wait := ratelimit.TakeAll(tokens, now); i >= 0 {
+		limited.With(className[class], names[i]).Inc()
+		return &document.DocumentError{
+			Code:       document.RateLimited,
+			Message:    fmt.Sprintf("%s rate limit of the %s exceeded (%g per second), retry later", className[class], names[i], tokens[i].Rate.PerSecond),
+			RetryAfter: wait.Milliseconds() + 1,
+		}
+	}
+	return nil
+}
+
+// Returns true if the uid is the uid of an open watch
+func (c *Client) watched(uid string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.routes[uid].scope == document.Watch.String()
+}
+
+// Returns the number of watches open, other than the watch of the request uid (replacing it)
+func (c *Client) watching(uid string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := 0
+	for u, r := range c.routes {
+		if u != uid && r.scope == document.Watch.String() {
+			count++
+		}
+	}
+	return count
+}
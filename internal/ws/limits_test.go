@@ -0,0 +1,64 @@
+package ws
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/event"
+	"go.springy.io/internal/ratelimit"
+	"testing"
+)
+
+func TestLimit(t *testing.T) {
+
+	one := ratelimit.Rate{PerSecond: 1, Burst: 1}
+	hub := NewHub(event.NewBuses("node", event.Options{}), Options{Limits: Limits{
+		Connection: Rates{Writes: one},
+		Identity:   Rates{Reads: one},
+		MaxWatches: 1,
+	}})
+	client := func(identity string) *Client {
+		return &Client{hub: hub, identity: identity, routes: make(map[string]route), buckets: newBuckets()}
+	}
+	write := document.DocumentRequest{Uid: "1", Scope: document.Write, Collection: "todos"}
+	find := document.DocumentRequest{Uid: "2", Scope: document.Find, Collection: "todos"}
+
+	// Connections are limited on their own, and per class of request
+	alice := client("alice")
+	assert.Nil(t, alice.limit(write))
+	err := alice.limit(write)
+	assert.Equal(t, document.RateLimited, err.Code)
+	assert.Equal(t, "writes rate limit of the connection exceeded (1 per second), retry later", err.Message)
+	assert.True(t, err.RetryAfter > 0)
+	assert.Nil(t, client("").limit(write))
+
+	// Identities are limited across their connections
+	assert.Nil(t, alice.limit(find))
+	assert.Equal(t, document.RateLimited, client("alice").limit(find).Code)
+	assert.Nil(t, client("bob").limit(find))
+
+	// Watches are capped per connection, a watch replacing itself
+	watch := document.DocumentRequest{Uid: "3", Scope: document.Watch, Collection: "todos"}
+	assert.Nil(t, alice.limit(watch))
+	alice.routes[watch.Uid] = routeOf(watch)
+	assert.Nil(t, alice.limit(watch))
+	watch.Uid = "4"
+	assert.Equal(t, document.QuotaExceeded, alice.limit(watch).Code)
+
+	// Other requests cannot take over the uid of an open watch
+	assert.Equal(t, document.InvalidRequest, alice.limit(document.DocumentRequest{Uid: "3", Scope: document.FindOne, Collection: "todos"}).Code)
+
+	// Requests rejected by a limit take no token from the others
+	two := ratelimit.Rate{PerSecond: 1, Burst: 2}
+	hub = NewHub(event.NewBuses("node", event.Options{}), Options{Limits: Limits{
+		Connection: Rates{Reads: two},
+		Collection: Rates{Reads: one},
+	}})
+	carol := client("carol")
+	assert.Nil(t, carol.limit(find))
+	assert.Equal(t, "reads rate limit of the collection exceeded (1 per second), retry later", carol.limit(find).Message)
+	find.Collection = "notes"
+	assert.Nil(t, carol.limit(find))
+
+	// Leaving is never limited
+	assert.Nil(t, alice.limit(document.DocumentRequest{Scope: document.Leave, Channel: "lobby"}))
+}
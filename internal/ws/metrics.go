@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"go.springy.io/api/document"
+	"go.springy.io/internal/metrics"
+	"sync/atomic"
+)
+
+var (
+	received = metrics.NewCounterVec("springy_messages_received_total", "Requests received from clients.", "scope", "operation")
+	sent     = metrics.NewCounterVec("springy_messages_sent_total", "Messages queued for clients.", "scope", "operation")
+)
+
+// Metrics counts the connected clients and their queued messages, and the messages the hub could
+// not deliver to slow clients
+type Metrics struct {
+
+	// Connected clients
+	Clients atomic.Int64
+
+	// Messages waiting in client queues
+	Queued atomic.Int64
+
+	// Messages dropped from full client queues
+	Dropped atomic.Uint64
+
+	// Watch snapshots replaced by a newer snapshot of the same document
+	Coalesced atomic.Uint64
+
+	// Clients disconnected for falling behind
+	Disconnected atomic.Uint64
+}
+
+// The request a message answers, labelling the message metrics
+type route struct {
+	scope     string
+	operation string
+
+	// The collection or channel of the request
+	collection string
+	channel    string
+}
+
+// Returns the route of a request, where only writes and watches have an operation
+func routeOf(request document.DocumentRequest) route {
+	r := route{scope: request.Scope.String(), collection: request.Collection, channel: request.Channel}
+	if request.Scope == document.Write || request.Scope == document.Watch {
+		r.operation = request.Operation.String()
+	}
+	return r
+}
@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The protocol versions supported side by side
+const (
+	// The current protocol version, which starts with a hello message from the server
+	Version = 2
+
+	// The oldest protocol version still supported
+	MinVersion = 1
+)
+
+// The encodings of the websocket frames
+const (
+	JSON    = "json"
+	MsgPack = "msgpack"
+	BSON    = "bson"
+)
+
+// The close code sent to clients offering only unsupported protocols
+const CloseUnsupportedProtocol = 4001
+
+// The capabilities announced to clients in the hello message
+var capabilities = []string{"find", "write", "watch", "presence", "pubsub", "sentinels", "extjson.canonical", "slow_consumer", "tracing", "rate_limits"}
+
+// Protocol is a websocket subprotocol (springy.<encoding>.v<version>). Clients that do not
+// negotiate a subprotocol speak json version 1.
+type Protocol struct {
+	Encoding string
+	Version  int
+}
+
+// Parses a subprotocol name, returning false if the protocol is not supported
+func ParseProtocol(name string) (Protocol, bool) {
+	parts := strings.Split(name, ".")
+	if len(parts) != 3 || parts[0] != "springy" || !strings.HasPrefix(parts[2], "v") {
+		return Protocol{}, false
+	}
+	version, err := strconv.Atoi(parts[2][1:])
+	if err != nil || version < MinVersion || version > Version {
+		return Protocol{}, false
+	}
+	switch parts[1] {
+	case JSON, MsgPack, BSON:
+		return Protocol{Encoding: parts[1], Version: version}, true
+	}
+	return Protocol{}, false
+}
+
+// Returns the subprotocol name
+func (p Protocol) String() string {
+	return fmt.Sprintf("springy.%s.v%d", p.Encoding, p.Version)
+}
+
+// Returns the supported subprotocols in order of preference
+func supportedProtocols() []string {
+	var names []string
+	for version := Version; version >= MinVersion; version-- {
+		for _, encoding := range []string{JSON, MsgPack, BSON} {
+			names = append(names, Protocol{Encoding: encoding, Version: version}.String())
+		}
+	}
+	return names
+}
+
+// Returns the hello message sent to version 2 clients once connected
+func hello(c *Client) map[string]interface{} {
+	return map[string]interface{}{
+		"_type":        "hello",
+		"version":      c.protocol.Version,
+		"connection":   c.id,
+		"capabilities": capabilities,
+	}
+}
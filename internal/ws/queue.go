@@ -0,0 +1,221 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"go.springy.io/internal/trace"
+	"sync"
+)
+
+// Represents what happens when a client's queue is full
+type Policy int
+
+const (
+	// Disconnect the client
+	Disconnect Policy = iota
+	// Drop the oldest queued messages to make room
+	DropOldest
+	// Replace the queued snapshot of the same watched document, dropping the oldest messages otherwise
+	Coalesce
+)
+
+var policyID = map[string]Policy{
+	"disconnect":  Disconnect,
+	"drop_oldest": DropOldest,
+	"coalesce":    Coalesce,
+}
+
+// Parses a slow consumer policy name (disconnect, drop_oldest or coalesce)
+func ParsePolicy(name string) (Policy, error) {
+	if policy, ok := policyID[name]; ok {
+		return policy, nil
+	}
+	return Disconnect, fmt.Errorf("unknown slow consumer policy '%s'", name)
+}
+
+// A message waiting to be written to the client
+type message struct {
+	data []byte
+
+	// The watched document the message is a snapshot of (empty for other messages)
+	key string
+
+	// The span ending once the message is written (nil for untraced messages)
+	span *trace.Span
+}
+
+// The reasons queued messages are never written
+var (
+	errDropped   = errors.New("dropped by the slow consumer policy")
+	errCoalesced = errors.New("coalesced with a later snapshot")
+)
+
+// Ends the spans of the messages, recording the error they failed with (if any)
+func end(messages []message, err error) {
+	for _, m := range messages {
+		m.span.Fail(err)
+		m.span.End()
+	}
+}
+
+// queue is a client's bounded queue of outbound messages
+type queue struct {
+	policy      Policy
+	maxMessages int
+	maxBytes    int
+	metrics     *Metrics
+
+	messages []message
+	bytes    int
+
+	// The number of messages dropped since the client was last notified
+	dropped int
+
+	// Flag indicating the client was disconnected for falling behind
+	overflowed bool
+	closed     bool
+
+	// Signalled when messages are queued or the queue is closed
+	ready chan struct{}
+	mutex sync.Mutex
+}
+
+func newQueue(options Options, metrics *Metrics) *queue {
+	return &queue{
+		policy:      options.Policy,
+		maxMessages: options.MaxMessages,
+		maxBytes:    options.MaxBytes,
+		metrics:     metrics,
+		ready:       make(chan struct{}, 1),
+	}
+}
+
+// Replaces the limits and policy, applied from the next message queued
+func (q *queue) configure(options Options) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.policy = options.Policy
+	q.maxMessages = options.MaxMessages
+	q.maxBytes = options.MaxBytes
+}
+
+// Queues the message according to the policy, returning false if it was not queued
+func (q *queue) push(m message) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		end([]message{m}, errDropped)
+		return false
+	}
+
+	if q.policy == Coalesce && m.key != "" {
+		for i := range q.messages {
+			if q.messages[i].key == m.key {
+				q.bytes += len(m.data) - len(q.messages[i].data)
+				end(q.messages[i:i+1], errCoalesced)
+				q.messages[i] = m
+				q.metrics.Coalesced.Add(1)
+				q.signal()
+				return true
+			}
+		}
+	}
+
+	q.messages = append(q.messages, m)
+	q.bytes += len(m.data)
+	q.metrics.Queued.Add(1)
+
+	for q.full() {
+		if q.policy == Disconnect {
+			q.overflow()
+			return false
+		}
+		if len(q.messages) == 1 {
+			// A single message larger than the queue is still delivered
+			break
+		}
+		q.bytes -= len(q.messages[0].data)
+		end(q.messages[:1], errDropped)
+		q.messages = q.messages[1:]
+		q.dropped++
+		q.metrics.Dropped.Add(1)
+		q.metrics.Queued.Add(-1)
+	}
+	q.signal()
+	return true
+}
+
+// Counts a message which could not even be handed to the queue as dropped, disconnecting the
+// client if the policy says so
+func (q *queue) reject() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	if q.policy == Disconnect {
+		q.overflow()
+		return
+	}
+	q.dropped++
+	q.metrics.Dropped.Add(1)
+	q.signal()
+}
+
+// Drops the queued messages and closes the queue of a client which fell behind. The caller must
+// hold the lock.
+func (q *queue) overflow() {
+	q.metrics.Queued.Add(-int64(len(q.messages)))
+	end(q.messages, errDropped)
+	q.messages = nil
+	q.bytes = 0
+	q.overflowed = true
+	q.closed = true
+	q.metrics.Disconnected.Add(1)
+	q.signal()
+}
+
+// Returns true if the queue holds more than its limits. The caller must hold the lock.
+func (q *queue) full() bool {
+	return (q.maxMessages > 0 && len(q.messages) > q.maxMessages) || (q.maxBytes > 0 && q.bytes > q.maxBytes)
+}
+
+// Wakes up the writer. The caller must hold the lock.
+func (q *queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Removes the queued messages, returning them with the number of messages dropped since the last
+// drain, and whether the queue is closed (and the client overflowed it)
+func (q *queue) drain() (messages []message, dropped int, closed bool, overflowed bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	messages = q.messages
+	dropped = q.dropped
+	q.metrics.Queued.Add(-int64(len(q.messages)))
+	q.messages = nil
+	q.bytes = 0
+	q.dropped = 0
+	return messages, dropped, q.closed, q.overflowed
+}
+
+// Closes the queue, dropping messages queued later
+func (q *queue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.signal()
+	}
+}
+
+// Returns the number of messages and bytes queued
+func (q *queue) depth() (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages), q.bytes
+}
@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func push(q *queue, messages ...string) {
+	for _, m := range messages {
+		q.push(message{data: []byte(m)})
+	}
+}
+
+func texts(messages []message) []string {
+	var s []string
+	for _, m := range messages {
+		s = append(s, string(m.data))
+	}
+	return s
+}
+
+func TestDropOldest(t *testing.T) {
+
+	metrics := &Metrics{}
+	q := newQueue(Options{MaxMessages: 2, Policy: DropOldest}, metrics)
+	push(q, "1", "2", "3")
+
+	messages, dropped, closed, _ := q.drain()
+	assert.Equal(t, []string{"2", "3"}, texts(messages))
+	assert.Equal(t, 1, dropped)
+	assert.False(t, closed)
+	assert.Equal(t, uint64(1), metrics.Dropped.Load())
+	assert.Equal(t, int64(0), metrics.Queued.Load())
+
+	// Snapshots the encoder fell behind on are dropped too
+	q.reject()
+	_, dropped, _, _ = q.drain()
+	assert.Equal(t, 1, dropped)
+
+	// Byte limits
+	q = newQueue(Options{MaxBytes: 4, Policy: DropOldest}, metrics)
+	push(q, "12", "34", "5")
+	messages, _, _, _ = q.drain()
+	assert.Equal(t, []string{"34", "5"}, texts(messages))
+
+	// Oversized messages are still delivered
+	push(q, "123456")
+	messages, _, _, _ = q.drain()
+	assert.Equal(t, []string{"123456"}, texts(messages))
+}
+
+func TestDisconnect(t *testing.T) {
+
+	metrics := &Metrics{}
+	q := newQueue(Options{MaxMessages: 2, Policy: Disconnect}, metrics)
+	push(q, "1", "2")
+	assert.False(t, q.push(message{data: []byte("3")}))
+
+	messages, _, closed, overflowed := q.drain()
+	assert.Empty(t, messages)
+	assert.True(t, closed)
+	assert.True(t, overflowed)
+	assert.Equal(t, uint64(1), metrics.Disconnected.Load())
+
+	// So do snapshots the encoder fell behind on
+	q = newQueue(Options{MaxMessages: 2, Policy: Disconnect}, metrics)
+	push(q, "1")
+	q.reject()
+	messages, _, closed, overflowed = q.drain()
+	assert.Empty(t, messages)
+	assert.True(t, closed)
+	assert.True(t, overflowed)
+
+	// Closed queues drop messages instead of panicking
+	q = newQueue(Options{}, metrics)
+	q.close()
+	assert.False(t, q.push(message{data: []byte("1")}))
+}
+
+func TestCoalesce(t *testing.T) {
+
+	metrics := &Metrics{}
+	q := newQueue(Options{MaxMessages: 2, Policy: Coalesce}, metrics)
+	q.push(message{data: []byte("a1"), key: "w/a"})
+	q.push(message{data: []byte("b1"), key: "w/b"})
+	q.push(message{data: []byte("a2"), key: "w/a"})
+
+	messages, dropped, _, _ := q.drain()
+	assert.Equal(t, []string{"a2", "b1"}, texts(messages))
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, uint64(1), metrics.Coalesced.Load())
+}
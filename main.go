@@ -1,9 +1,10 @@
 package main
 
 import (
-	"go.springy.io/pkg/http"
+	"go.springy.io/pkg/cli"
+	"os"
 )
 
 func main() {
-	http.Start()
+	os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
 }
@@ -0,0 +1,213 @@
+// Package cli implements the springy command line, running the server and the operator tools
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go.springy.io/api/index"
+	"go.springy.io/api/schema"
+	"go.springy.io/internal/rules"
+	"go.springy.io/pkg/http"
+	"go.springy.io/pkg/util"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// A springy subcommand
+type command struct {
+
+	// The words naming the command, e.g. "config check"
+	name string
+
+	// The arguments following the flags
+	args string
+
+	// What the command does
+	usage string
+
+	run func(r *runner, args []string) error
+}
+
+// Runs the commands, writing to the outputs
+type runner struct {
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// The subcommands, serve running when none is named
+var commands = []command{
+	{name: "serve", usage: "Runs the server", run: serve},
+	{name: "config print", usage: "Prints the effective configuration with secrets redacted", run: configPrint},
+	{name: "config check", usage: "Validates the configuration and the rules, index and schema files", run: configCheck},
+	{name: "rules test", args: "[samples.jsonl]", usage: "Evaluates the rules against sample requests (read from stdin without a file)", run: rulesTest},
+	{name: "indexes sync", usage: "Creates (or recreates) the indexes declared in the index file", run: indexesSync},
+	{name: "export", args: "<collection>", usage: "Writes the documents of a collection as extended json lines", run: export},
+	{name: "import", args: "<collection>", usage: "Inserts the documents read as extended json lines into a collection", run: importDocuments},
+	{name: "tail", args: "<collection>", usage: "Connects to a server and prints the changes of a collection", run: tail},
+}
+
+// usageError is returned for invalid command lines
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+// Runs the command line arguments, returning the exit code: 0 on success (or help), 1 when the
+// command fails and 2 for invalid command lines or configurations
+func Run(args []string, stdout, stderr io.Writer) int {
+	r := &runner{stdout: stdout, stderr: stderr}
+
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help") {
+		r.usage(stdout)
+		return 0
+	}
+
+	// Flags without a command are passed to serve
+	cmd, rest, ok := lookup(args)
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command '%s'\n\n", strings.Join(args, " "))
+		r.usage(stderr)
+		return 2
+	}
+
+	err := cmd.run(r, rest)
+	var usage *usageError
+	var config *util.ConfigError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &usage):
+		fmt.Fprintf(stderr, "%s\nusage: %s\n", err, strings.TrimSpace("springy "+cmd.name+" [flags] "+cmd.args))
+		return 2
+	case errors.As(err, &config):
+		fmt.Fprintln(stderr, err)
+		return 2
+	default:
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+}
+
+// Returns the command named by the arguments with the arguments left, serve when none is named
+func lookup(args []string) (command, []string, bool) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commands[0], args, true
+	}
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+// Prints the commands
+func (r *runner) usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: springy [command] [flags]\n\ncommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.usage)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun springy <command> --help for the flags of a command.\n")
+}
+
+// Returns the flag set of a command, reporting errors to stderr
+func (r *runner) flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("springy "+name, flag.ContinueOnError)
+	flags.SetOutput(r.stderr)
+	return flags
+}
+
+// Parses the flags, returning a *usageError unless the arguments left are within the bounds
+func parse(flags *flag.FlagSet, args []string, min int, max int) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{message: err.Error()}
+	}
+	if flags.NArg() < min {
+		return &usageError{message: "missing arguments"}
+	}
+	if flags.NArg() > max {
+		return &usageError{message: "unexpected arguments: " + strings.Join(flags.Args()[max:], " ")}
+	}
+	return nil
+}
+
+// Parses the command and configuration flags, loading the configuration
+func (r *runner) configure(name string, args []string, min int, max int) (*flag.FlagSet, *util.Environment, error) {
+	flags := r.flags(name)
+	loader := util.NewLoader(flags)
+	if err := parse(flags, args, min, max); err != nil {
+		return nil, nil, err
+	}
+	env, err := loader.Load()
+	return flags, env, err
+}
+
+// Runs the server until it fails
+func serve(r *runner, args []string) error {
+	if _, err := util.Configure(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		var config *util.ConfigError
+		if errors.As(err, &config) {
+			return err
+		}
+		return &usageError{message: err.Error()}
+	}
+	http.Start()
+	return nil
+}
+
+func configPrint(r *runner, args []string) error {
+	_, env, err := r.configure("config print", args, 0, 0)
+	if err != nil {
+		return err
+	}
+	env.Print(r.stdout)
+	return nil
+}
+
+// Validates the configuration, then loads the files it names without connecting to the database
+func configCheck(r *runner, args []string) error {
+	_, env, err := r.configure("config check", args, 0, 0)
+	if err != nil {
+		return err
+	}
+	if env.File != "" {
+		fmt.Fprintf(r.stdout, "config file %s is valid\n", env.File)
+	}
+	if file := env.Server.RulesFile; file != "" {
+		rs, err := rules.Load(file)
+		if err != nil {
+			return fmt.Errorf("invalid rules file %s: %w", file, err)
+		}
+		fmt.Fprintf(r.stdout, "rules file %s is valid (%d channel rules)\n", file, len(rs.Channels))
+	}
+	if file := env.Database.IndexFile; file != "" {
+		specs, err := index.Load(file)
+		if err != nil {
+			return fmt.Errorf("invalid index file %s: %w", file, err)
+		}
+		fmt.Fprintf(r.stdout, "index file %s is valid (%d collections)\n", file, len(specs))
+	}
+	if dir := env.Schema.Dir; dir != "" {
+		schemas, err := schema.Load(dir)
+		if err != nil {
+			return fmt.Errorf("invalid schema directory %s: %w", dir, err)
+		}
+		fmt.Fprintf(r.stdout, "schema directory %s is valid (%d schemas)\n", dir, len(schemas))
+	}
+	fmt.Fprintln(r.stdout, "configuration is valid")
+	return nil
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+
+	cmd, rest, ok := lookup([]string{"config", "check", "--server-port", "9000"})
+	assert.True(t, ok)
+	assert.Equal(t, "config check", cmd.name)
+	assert.Equal(t, []string{"--server-port", "9000"}, rest)
+
+	// Flags without a command are passed to serve
+	cmd, rest, ok = lookup([]string{"--server-port", "9000"})
+	assert.True(t, ok)
+	assert.Equal(t, "serve", cmd.name)
+	assert.Equal(t, []string{"--server-port", "9000"}, rest)
+
+	_, _, ok = lookup([]string{"config", "delete"})
+	assert.False(t, ok)
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, Run([]string{"frobnicate"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "unknown command 'frobnicate'")
+	assert.Equal(t, 0, Run([]string{"help"}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "rules test [samples.jsonl]")
+}
+
+func TestRulesTest(t *testing.T) {
+
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.json")
+	os.WriteFile(rules, []byte(`{"channels": [{"match": "rooms/*", "actions": ["join"], "identities": ["*"]}]}`), 0o600)
+	samples := filepath.Join(dir, "samples.jsonl")
+	os.WriteFile(samples, []byte(`# Members join rooms
+{"scope": "join", "channel": "rooms/lobby", "identity": "alice", "expect": "allow"}
+{"scope": "join", "channel": "rooms/lobby", "expect": "deny"}
+{"scope": "publish", "channel": "rooms/lobby", "identity": "alice"}
+`), 0o600)
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, Run([]string{"rules", "test", "--config", "", "--rules-file", rules, samples}, &stdout, &stderr), stderr.String())
+	assert.Contains(t, stdout.String(), "allow  join     rooms/lobby  alice")
+	assert.Contains(t, stdout.String(), "deny   publish  rooms/lobby  alice")
+
+	// Unexpected outcomes fail the command
+	os.WriteFile(samples, []byte(`{"scope": "join", "channel": "rooms/lobby", "expect": "allow"}`), 0o600)
+	stdout.Reset()
+	stderr.Reset()
+	assert.Equal(t, 1, Run([]string{"rules", "test", "--config", "", "--rules-file", rules, samples}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "FAIL (expected allow)")
+	assert.Contains(t, stderr.String(), "1 of 1 samples did not match their expectation")
+}
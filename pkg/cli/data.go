@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.springy.io/api/index"
+	"go.springy.io/internal/mongo"
+	"go.springy.io/pkg/util"
+	"io"
+	"os"
+	"time"
+)
+
+// Makes the configuration the Environment and connects to its database, returning the function
+// disconnecting from it
+func open(env *util.Environment) (func(), error) {
+	util.SetEnv(env)
+	if err := mongo.Open(); err != nil {
+		return nil, err
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		mongo.Close(ctx)
+	}, nil
+}
+
+// Reconciles the indexes declared in the index file with the database
+func indexesSync(r *runner, args []string) error {
+	_, env, err := r.configure("indexes sync", args, 0, 0)
+	if err != nil {
+		return err
+	}
+	if env.Database.IndexFile == "" {
+		return &usageError{message: "no index file, set MONGO_INDEX_FILE or --mongo-index-file"}
+	}
+	specs, err := index.Load(env.Database.IndexFile)
+	if err != nil {
+		return fmt.Errorf("invalid index file %s: %w", env.Database.IndexFile, err)
+	}
+
+	closeDatabase, err := open(env)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase()
+	if err := mongo.SyncIndexes(context.Background(), specs); err != nil {
+		return fmt.Errorf("unable to sync indexes: %w", err)
+	}
+	fmt.Fprintf(r.stdout, "indexes of %d collections are in sync\n", len(specs))
+	return nil
+}
+
+// Writes the documents of a collection as extended json lines
+func export(r *runner, args []string) error {
+	flags := r.flags("export")
+	filter := flags.String("filter", "", "The extended json filter of the exported documents")
+	out := flags.String("out", "", "The file written (stdout when empty)")
+	relaxed := flags.Bool("relaxed", false, "Write relaxed rather than canonical extended json")
+	loader := util.NewLoader(flags)
+	if err := parse(flags, args, 1, 1); err != nil {
+		return err
+	}
+	env, err := loader.Load()
+	if err != nil {
+		return err
+	}
+
+	var query bson.M
+	if *filter != "" {
+		if err := bson.UnmarshalExtJSON([]byte(*filter), false, &query); err != nil {
+			return &usageError{message: "invalid filter: " + err.Error()}
+		}
+	}
+	var w io.Writer = r.stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	closeDatabase, err := open(env)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase()
+	count, err := mongo.Export(context.Background(), flags.Arg(0), query, *relaxed, w)
+	if err != nil {
+		return fmt.Errorf("export failed after %d documents: %w", count, err)
+	}
+	fmt.Fprintf(r.stderr, "exported %d documents from %s\n", count, flags.Arg(0))
+	return nil
+}
+
+// Inserts the documents read as extended json lines into a collection
+func importDocuments(r *runner, args []string) error {
+	flags := r.flags("import")
+	in := flags.String("in", "", "The file read (stdin when empty)")
+	upsert := flags.Bool("upsert", false, "Replace the documents with the same _id rather than failing")
+	loader := util.NewLoader(flags)
+	if err := parse(flags, args, 1, 1); err != nil {
+		return err
+	}
+	env, err := loader.Load()
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		reader = f
+	}
+
+	closeDatabase, err := open(env)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase()
+	count, err := mongo.Import(context.Background(), flags.Arg(0), reader, *upsert)
+	if err != nil {
+		return fmt.Errorf("import failed after %d documents: %w", count, err)
+	}
+	fmt.Fprintf(r.stderr, "imported %d documents into %s\n", count, flags.Arg(0))
+	return nil
+}
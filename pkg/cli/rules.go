@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.springy.io/internal/rules"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// A sample request evaluated by rules test: the request a client would send (only the scope and
+// channel matter), the identity sending it and optionally the expected outcome (allow or deny)
+type sample struct {
+	Scope    string `json:"scope"`
+	Channel  string `json:"channel"`
+	Identity string `json:"identity"`
+	Expect   string `json:"expect"`
+}
+
+// Evaluates the rules of the configuration against the sample requests (json lines), failing if any
+// outcome differs from the expected one
+func rulesTest(r *runner, args []string) error {
+	flags, env, err := r.configure("rules test", args, 0, 1)
+	if err != nil {
+		return err
+	}
+	if env.Server.RulesFile == "" {
+		return &usageError{message: "no rules file, set RULES_FILE or --rules-file"}
+	}
+	rs, err := rules.Load(env.Server.RulesFile)
+	if err != nil {
+		return fmt.Errorf("invalid rules file %s: %w", env.Server.RulesFile, err)
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	tw := tabwriter.NewWriter(r.stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	total, failed := 0, 0
+	scanner := bufio.NewScanner(in)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 || data[0] == '#' {
+			continue
+		}
+		var s sample
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		switch s.Scope {
+		case rules.Subscribe, rules.Publish, rules.Join:
+		default:
+			return fmt.Errorf("line %d: scope '%s' is not governed by the rules (subscribe, publish or join)", line, s.Scope)
+		}
+		switch s.Expect {
+		case "", "allow", "deny":
+		default:
+			return fmt.Errorf("line %d: unknown expectation '%s' (allow or deny)", line, s.Expect)
+		}
+
+		outcome := "deny"
+		if rs.Allow(s.Scope, s.Channel, s.Identity) {
+			outcome = "allow"
+		}
+		result := ""
+		if s.Expect != "" && s.Expect != outcome {
+			result = "FAIL (expected " + s.Expect + ")"
+			failed++
+		}
+		identity := s.Identity
+		if identity == "" {
+			identity = "(anonymous)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", outcome, s.Scope, s.Channel, identity, result)
+		total++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	tw.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d samples did not match their expectation", failed, total)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"go.springy.io/api/document"
+	"go.springy.io/internal/ws"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// Connects to a server and prints the watch stream of a collection as json lines, until interrupted
+func tail(r *runner, args []string) error {
+	flags := r.flags("tail")
+	address := flags.String("url", "ws://localhost:8080/ws", "The websocket url of the server")
+	operations := flags.String("operations", "insert,update,replace,delete", "The operations watched (comma separated)")
+	canonical := flags.Bool("canonical", false, "Print canonical rather than relaxed extended json")
+	cert := flags.String("cert", "", "The PEM client certificate presented to servers verifying them (wss)")
+	key := flags.String("key", "", "The PEM private key of the client certificate")
+	ca := flags.String("ca", "", "The PEM certificates of the authorities issuing the server certificate (the system roots when empty)")
+	if err := parse(flags, args, 1, 1); err != nil {
+		return err
+	}
+	collection := flags.Arg(0)
+
+	u, err := url.Parse(*address)
+	if err != nil {
+		return &usageError{message: "invalid url: " + err.Error()}
+	}
+	if *canonical {
+		q := u.Query()
+		q.Set("extjson", "canonical")
+		u.RawQuery = q.Encode()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	protocol := ws.Protocol{Encoding: ws.JSON, Version: ws.Version}
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.String()}}
+	if dialer.TLSClientConfig, err = clientTLS(*cert, *key, *ca); err != nil {
+		return err
+	}
+	conn, _, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %w", u, err)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Each operation is watched by its own request
+	for _, operation := range strings.Split(*operations, ",") {
+		operation = strings.TrimSpace(operation)
+		request := map[string]interface{}{
+			"_uid":       "tail-" + operation,
+			"scope":      document.Watch.String(),
+			"collection": collection,
+			"operation":  operation,
+		}
+		if err := conn.WriteJSON(request); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(r.stderr, "watching %s on %s\n", collection, u)
+
+	out := json.NewEncoder(r.stdout)
+	for {
+		var batch []map[string]json.RawMessage
+		if err := conn.ReadJSON(&batch); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("connection closed: %w", err)
+		}
+		for _, message := range batch {
+			if _, ok := message["_type"]; ok {
+				// The hello message
+				continue
+			}
+			if e, ok := message["error"]; ok {
+				return fmt.Errorf("watch failed: %s", e)
+			}
+			out.Encode(map[string]json.RawMessage{"operation": message["_operation"], "value": message["value"]})
+		}
+	}
+}
+
+// Returns the client TLS configuration presenting the certificate and trusting the authorities (if any)
+func clientTLS(cert, key, ca string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if cert != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", ca)
+		}
+	}
+	return config, nil
+}
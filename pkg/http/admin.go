@@ -0,0 +1,154 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"go.springy.io/api/index"
+	"go.springy.io/internal/mongo"
+	"go.springy.io/internal/ws"
+	"go.springy.io/pkg/util"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// Initialize the admin routes
+func initAdminRoutes(hub *ws.Hub) {
+	http.HandleFunc("GET /admin/indexes/{collection}", admin(listIndexesRoute))
+	http.HandleFunc("POST /admin/indexes/{collection}", admin(createIndexRoute))
+	http.HandleFunc("DELETE /admin/indexes/{collection}/{name}", admin(dropIndexRoute))
+
+	http.HandleFunc("GET /admin/clients", admin(listClientsRoute(hub)))
+	http.HandleFunc("GET /admin/clients/{id}", admin(getClientRoute(hub)))
+	http.HandleFunc("DELETE /admin/clients/{id}", admin(disconnectClientRoute(hub)))
+	http.HandleFunc("DELETE /admin/clients/{id}/subscriptions/{uid}", admin(cancelSubscriptionRoute(hub)))
+
+	http.HandleFunc("GET /admin/{$}", dashboardRoute)
+}
+
+// Returns the admin dashboard. The page holds no data, it asks for the token and calls the admin API.
+func dashboardRoute(w http.ResponseWriter, r *http.Request) {
+	if util.Env().Server.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("web/templates/admin.html"))
+	tmpl.Execute(w, nil)
+}
+
+// Guards an admin route with the configured bearer token
+func admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := util.Env().Server.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="springy"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Lists the indexes of a collection
+func listIndexesRoute(w http.ResponseWriter, r *http.Request) {
+	indexes, err := mongo.ListIndexes(r.Context(), r.PathValue("collection"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, indexes)
+}
+
+// Creates an index on a collection
+func createIndexRoute(w http.ResponseWriter, r *http.Request) {
+	var spec index.Spec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := spec.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name, err := mongo.CreateIndex(r.Context(), r.PathValue("collection"), spec)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"name": name})
+}
+
+// Drops the named index of a collection
+func dropIndexRoute(w http.ResponseWriter, r *http.Request) {
+	if err := mongo.DropIndex(r.Context(), r.PathValue("collection"), r.PathValue("name")); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Lists the connected clients with their queues and subscriptions
+func listClientsRoute(hub *ws.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, hub.Clients())
+	}
+}
+
+// Describes a connected client
+func getClientRoute(hub *ws.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := hub.Client(r.PathValue("id"))
+		if err != nil {
+			writeHubError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, client)
+	}
+}
+
+// Forcibly disconnects a client
+func disconnectClientRoute(hub *ws.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := hub.Disconnect(r.PathValue("id")); err != nil {
+			writeHubError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Cancels a watch, subscription or channel membership of a client
+func cancelSubscriptionRoute(hub *ws.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := hub.Cancel(r.PathValue("id"), r.PathValue("uid")); err != nil {
+			writeHubError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Answers a failed hub operation, where unknown clients and subscriptions are not found
+func writeHubError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ws.ErrUnknownClient) || errors.Is(err, ws.ErrUnknownSubscription) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,76 @@
+package http
+
+import (
+	"context"
+	"go.springy.io/internal/mongo"
+	"go.springy.io/internal/ws"
+	"net/http"
+	"time"
+)
+
+// Time allowed to each readiness check
+const checkTimeout = 2 * time.Second
+
+// The outcome of a dependency check
+type check struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Initialize the liveness and readiness routes
+func initHealthRoutes(hub *ws.Hub) {
+	http.HandleFunc("GET /healthz", healthzRoute)
+	http.HandleFunc("GET /readyz", readyzRoute(map[string]func(ctx context.Context) error{
+		"mongo":          mongo.Ping,
+		"hub":            hub.Ping,
+		"change_streams": mongo.CheckChangeStreams,
+	}))
+}
+
+// Answers as long as the process is serving http
+func healthzRoute(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Answers whether every dependency check passes, detailing each check
+func readyzRoute(checks map[string]func(ctx context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type result struct {
+			name  string
+			check check
+		}
+		results := make(chan result, len(checks))
+		for name, f := range checks {
+			go func() {
+				ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+				defer cancel()
+
+				start := time.Now()
+				c := check{Status: "ok"}
+				if err := f(ctx); err != nil {
+					c.Status = "failed"
+					c.Error = err.Error()
+				}
+				c.Duration = time.Since(start).String()
+				results <- result{name, c}
+			}()
+		}
+
+		status := http.StatusOK
+		detail := make(map[string]check, len(checks))
+		for range checks {
+			r := <-results
+			detail[r.name] = r.check
+			if r.check.Status != "ok" {
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		ready := "ok"
+		if status != http.StatusOK {
+			ready = "unavailable"
+		}
+		writeJSON(w, status, map[string]interface{}{"status": ready, "checks": detail})
+	}
+}
@@ -0,0 +1,39 @@
+package http
+
+import (
+	"go.springy.io/internal/event"
+	"go.springy.io/internal/metrics"
+	"go.springy.io/internal/ws"
+	"go.springy.io/pkg/util"
+	"net/http"
+)
+
+var (
+	clients      = metrics.NewGaugeFunc("springy_clients_connected", "Connected websocket clients.")
+	queued       = metrics.NewGaugeFunc("springy_send_queue_messages", "Messages waiting in client send queues.")
+	dropped      = metrics.NewCounterFunc("springy_send_queue_dropped_total", "Messages dropped from full client send queues.")
+	coalesced    = metrics.NewCounterFunc("springy_send_queue_coalesced_total", "Watch snapshots replaced by a newer snapshot of the same document.")
+	disconnected = metrics.NewCounterFunc("springy_slow_consumers_disconnected_total", "Clients disconnected for falling behind.")
+	backlog      = metrics.NewGaugeFunc("springy_event_backlog", "Events buffered in event bus subscriptions.", "bus")
+	spansDropped = metrics.NewCounterFunc("springy_trace_spans_dropped_total", "Spans dropped because the export queue was full.")
+)
+
+// Initialize the metrics route, reading the hub and bus metrics when scraped
+func initMetricsRoutes(hub *ws.Hub, buses *event.Buses) {
+	if !util.Env().Server.Metrics {
+		return
+	}
+
+	m := hub.Metrics()
+	clients.Set(func() float64 { return float64(m.Clients.Load()) })
+	queued.Set(func() float64 { return float64(m.Queued.Load()) })
+	dropped.Set(func() float64 { return float64(m.Dropped.Load()) })
+	coalesced.Set(func() float64 { return float64(m.Coalesced.Load()) })
+	disconnected.Set(func() float64 { return float64(m.Disconnected.Load()) })
+
+	backlog.Set(func() float64 { return float64(buses.Requests.Backlog()) }, "requests")
+	backlog.Set(func() float64 { return float64(buses.Snapshots.Backlog()) }, "snapshots")
+	backlog.Set(func() float64 { return float64(buses.Connections.Backlog()) }, "connections")
+
+	http.Handle("GET /metrics", metrics.Handler())
+}
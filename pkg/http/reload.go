@@ -0,0 +1,152 @@
+package http
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"go.springy.io/internal/rules"
+	"go.springy.io/internal/ws"
+	"go.springy.io/pkg/util"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// How long file events settle before reloading, editors writing files in several steps
+const reloadDelay = 200 * time.Millisecond
+
+// Applies the reloadable settings of a new configuration (and the rules) to the running server
+type reloader struct {
+	hub   *ws.Hub
+	rules *rules.Current
+
+	// The certificates served (nil without TLS)
+	certificates *certificates
+
+	// The watched config and rules files, by absolute path
+	files map[string]bool
+
+	// The watched directories of the files
+	dirs map[string]bool
+}
+
+// Reloads the configuration when the config, rules or certificate files change, or on SIGHUP
+func (r *reloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// The directories are watched, as editors and config maps replace the files they update
+	var events chan fsnotify.Event
+	var errors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("unable to watch the configuration files, reloading on SIGHUP only", "error", err)
+	} else {
+		defer watcher.Close()
+		events, errors = watcher.Events, watcher.Errors
+		r.follow(watcher, util.Env())
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			r.reload("signal", watcher)
+		case e := <-events:
+			if r.files[filepath.Clean(e.Name)] {
+				settled = time.After(reloadDelay)
+			}
+		case err := <-errors:
+			slog.Warn("unable to watch the configuration files", "error", err)
+		case <-settled:
+			settled = nil
+			r.reload("file changed", watcher)
+		}
+	}
+}
+
+// Watches the config, rules and certificate files of the configuration, no longer watching the
+// directories of the files the configuration stopped referencing
+func (r *reloader) follow(watcher *fsnotify.Watcher, env *util.Environment) {
+	r.files = make(map[string]bool)
+	dirs := make(map[string]bool)
+	files := []string{env.File, env.Server.RulesFile}
+	if r.certificates != nil {
+		files = append(files, r.certificates.files()...)
+	}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		path, err := filepath.Abs(file)
+		if err != nil {
+			continue
+		}
+		r.files[path] = true
+		dir := filepath.Dir(path)
+		if dirs[dir] || r.dirs[dir] {
+			// Already watched
+			dirs[dir] = true
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			slog.Warn("unable to watch the configuration file", "file", path, "error", err)
+			continue
+		}
+		dirs[dir] = true
+	}
+
+	for dir := range r.dirs {
+		if !dirs[dir] {
+			if err := watcher.Remove(dir); err != nil {
+				slog.Warn("unable to stop watching the configuration directory", "dir", dir, "error", err)
+			}
+		}
+	}
+	r.dirs = dirs
+}
+
+// Loads and validates the configuration, swapping in the rules, client limits and log level
+// without disconnecting the clients, and reads the certificates again. Invalid configurations
+// (and certificates) are logged and not applied.
+func (r *reloader) reload(reason string, watcher *fsnotify.Watcher) {
+	if r.certificates != nil {
+		if err := r.certificates.reload(); err != nil {
+			slog.Error("certificates not reloaded", "reason", reason, "error", err)
+		}
+	}
+
+	env, changes, err := util.Reload()
+	if err != nil {
+		slog.Error("configuration not reloaded", "reason", reason, "error", err)
+		return
+	}
+	rs, err := loadRules(env.Server.RulesFile)
+	if err != nil {
+		slog.Error("configuration not reloaded", "reason", reason, "file", env.Server.RulesFile, "error", err)
+		return
+	}
+	options, err := hubOptions(env)
+	if err != nil {
+		slog.Error("configuration not reloaded", "reason", reason, "error", err)
+		return
+	}
+
+	r.rules.Store(rs)
+	r.hub.Reconfigure(options)
+	util.SetEnv(env)
+	if watcher != nil {
+		r.follow(watcher, env)
+	}
+
+	for _, c := range changes {
+		args := []any{"setting", c.To.Setting.Name, "from", c.From.Redacted(), "to", c.To.Redacted()}
+		if c.To.Setting.Reloadable {
+			slog.Info("setting changed", args...)
+		} else {
+			slog.Warn("setting changed, restart to apply", args...)
+		}
+	}
+	slog.Info("configuration reloaded", "reason", reason, "changes", len(changes), "rules", env.Server.RulesFile)
+}
@@ -0,0 +1,33 @@
+package http
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/pkg/util"
+	"path/filepath"
+	"testing"
+)
+
+func TestFollow(t *testing.T) {
+
+	watcher, err := fsnotify.NewWatcher()
+	assert.Nil(t, err)
+	defer watcher.Close()
+
+	config, rules := t.TempDir(), t.TempDir()
+	env := &util.Environment{File: filepath.Join(config, "springy.toml")}
+	env.Server.RulesFile = filepath.Join(rules, "rules.json")
+
+	r := &reloader{}
+	r.follow(watcher, env)
+	assert.Equal(t, map[string]bool{config: true, rules: true}, r.dirs)
+	assert.True(t, r.files[env.Server.RulesFile])
+
+	// The directory of a dropped rules file is no longer watched
+	env.Server.RulesFile = ""
+	r.follow(watcher, env)
+	assert.Equal(t, map[string]bool{config: true}, r.dirs)
+	assert.False(t, r.files[filepath.Join(rules, "rules.json")])
+	assert.NotNil(t, watcher.Remove(rules))
+	assert.Nil(t, watcher.Remove(config))
+}
@@ -2,30 +2,193 @@ package http
 
 import (
 	"fmt"
+	"go.springy.io/internal/event"
 	"go.springy.io/internal/mongo"
+	"go.springy.io/internal/presence"
+	"go.springy.io/internal/pubsub"
+	"go.springy.io/internal/ratelimit"
+	"go.springy.io/internal/rules"
+	"go.springy.io/internal/trace"
 	"go.springy.io/internal/ws"
 	"go.springy.io/pkg/util"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 )
 
-func init() {
+// Wires the subsystems together and registers the http routes, returning the certificates served
+// (nil without TLS)
+func initServer() *certificates {
 
-	initRoutes()
+	initTracing()
+	if err := mongo.Connect(); err != nil {
+		util.Fatal("unable to initialize mongo", "error", err)
+	}
+
+	env := util.Env()
+	options, err := hubOptions(env)
+	if err != nil {
+		util.Fatal("invalid websocket configuration", "error", err)
+	}
+	r, err := loadRules(env.Server.RulesFile)
+	if err != nil {
+		util.Fatal("unable to load rules", "file", env.Server.RulesFile, "error", err)
+	}
+	current := rules.NewCurrent(r)
+
+	var certs *certificates
+	if env.TLS.Enabled() {
+		if certs, err = newCertificates(env.TLS); err != nil {
+			util.Fatal("invalid tls configuration", "error", err)
+		}
+	}
+
+	buses := newBuses()
+	hub := ws.NewHub(buses, options)
+
+	initRoutes(hub)
+	initHealthRoutes(hub)
+	initMetricsRoutes(hub, buses)
 
 	// Run the db in a new goroutine
-	go mongo.Run()
+	go mongo.Run(buses)
 
 	// Run the hub in a new goroutine
-	go ws.Run()
+	go hub.Run()
+
+	// Run the presence tracker in a new goroutine
+	go presence.Run(buses, mongo.PresenceStore(), current)
+
+	// Run the ephemeral pub/sub router in a new goroutine
+	go pubsub.Run(buses, current)
+
+	// Reload the configuration when its files change or on SIGHUP
+	go (&reloader{hub: hub, rules: current, certificates: certs}).watch()
+	return certs
+}
+
+// Starts exporting the request spans (if enabled)
+func initTracing() {
+	env := util.Env()
+	var exporter trace.Exporter
+	switch env.Trace.Exporter {
+	case "", "none":
+		return
+	case "stdout":
+		exporter = trace.NewWriterExporter(os.Stdout)
+	case "otlp":
+		exporter = trace.NewOTLPExporter(env.Trace.Endpoint)
+	default:
+		util.Fatal("invalid trace configuration", "error", fmt.Errorf("unknown exporter '%s'", env.Trace.Exporter))
+	}
+	tracer := trace.NewTracer(exporter, trace.Options{Service: env.Trace.Service, Ratio: env.Trace.Ratio})
+	trace.SetTracer(tracer)
+	spansDropped.Set(func() float64 { return float64(tracer.Dropped()) })
+	slog.Info("tracing requests", "exporter", env.Trace.Exporter, "ratio", env.Trace.Ratio)
+}
+
+// Creates the event buses connecting the subsystems
+func newBuses() *event.Buses {
+	env := util.Env()
+	overflow, err := event.ParseOverflow(env.Event.Overflow)
+	if err != nil {
+		util.Fatal("invalid event configuration", "error", err)
+	}
+	node := env.Event.Node
+	if node == "" {
+		node = ws.NewID()
+	}
+	buses := event.NewBuses(node, event.Options{
+		Buffer:   env.Event.Buffer,
+		Overflow: overflow,
+		Timeout:  env.Event.Timeout,
+	})
+
+	if env.Event.BrokerListen != "" {
+		broker, err := event.NewBroker(env.Event.BrokerListen)
+		if err != nil {
+			util.Fatal("unable to start the event broker", "error", err)
+		}
+		slog.Info("event broker listening", "address", broker.Addr())
+	}
+
+	if env.Event.Broker != "" {
+		transport, err := event.Dial(env.Event.Broker)
+		if err != nil {
+			util.Fatal("unable to connect to the event broker", "broker", env.Event.Broker, "error", err)
+		}
+		if _, err := buses.Bridge(transport, topics(env.Event.Export), topics(env.Event.Import)); err != nil {
+			util.Fatal("unable to bridge the event buses", "error", err)
+		}
+		slog.Info("connected to event broker", "node", node, "broker", env.Event.Broker)
+	}
+	return buses
+}
+
+func topics(patterns []string) []event.Topic {
+	var t []event.Topic
+	for _, p := range patterns {
+		t = append(t, event.Topic(p))
+	}
+	return t
+}
+
+// Returns the client connection options of the configuration
+func hubOptions(env *util.Environment) (ws.Options, error) {
+	policy, err := ws.ParsePolicy(env.WebSocket.QueuePolicy)
+	if err != nil {
+		return ws.Options{}, err
+	}
+	options := ws.Options{
+		ReadLimit:        env.WebSocket.ReadLimit,
+		WriteWait:        env.WebSocket.WriteWait,
+		PongWait:         env.WebSocket.PongWait,
+		ReadBufferSize:   env.WebSocket.ReadBufferSize,
+		WriteBufferSize:  env.WebSocket.WriteBufferSize,
+		Compression:      env.WebSocket.Compression,
+		CompressionLevel: env.WebSocket.CompressionLevel,
+		AllowedOrigins:   env.WebSocket.AllowedOrigins,
+
+		MaxMessages: env.WebSocket.QueueMessages,
+		MaxBytes:    env.WebSocket.QueueBytes,
+		Policy:      policy,
+
+		Limits: limits(env.Limit),
+	}
+	if env.TLS.ClientAuth != "none" {
+		options.Identify = identify(env.TLS.ClientIdentity)
+	}
+	return options, nil
+}
+
+// Returns the rate limits and quotas of the client requests
+func limits(env util.LimitEnv) ws.Limits {
+	rate := func(perSecond float64) ratelimit.Rate {
+		return ratelimit.Rate{PerSecond: perSecond, Burst: perSecond * env.Burst}
+	}
+	return ws.Limits{
+		Connection: ws.Rates{Reads: rate(env.ConnectionReads), Writes: rate(env.ConnectionWrites), Watches: rate(env.ConnectionWatches)},
+		Identity:   ws.Rates{Reads: rate(env.IdentityReads), Writes: rate(env.IdentityWrites), Watches: rate(env.IdentityWatches)},
+		Collection: ws.Rates{Reads: rate(env.CollectionReads), Writes: rate(env.CollectionWrites), Watches: rate(env.CollectionWatches)},
+		MaxWatches: env.MaxWatches,
+	}
+}
+
+// Loads the authorization rules of the file (nil allowing everything without one)
+func loadRules(file string) (*rules.Rules, error) {
+	if file == "" {
+		return nil, nil
+	}
+	return rules.Load(file)
 }
 
 // Initialize the http routes
-func initRoutes() {
+func initRoutes(hub *ws.Hub) {
 	http.HandleFunc("/", indexRoute)
-	http.HandleFunc("/ws", ws.Upgrade)
+	http.HandleFunc("/ws", hub.Upgrade)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./web/static"))))
+	initAdminRoutes(hub)
 }
 
 /// Returns the index.html
@@ -34,9 +197,22 @@ func indexRoute(w http.ResponseWriter, r *http.Request) {
 	tmpl.Execute(w, nil)
 }
 
+// Starts the server with the configuration of util.Env, over TLS when a certificate is configured
 func Start() {
+	certs := initServer()
+
 	env := util.Env()
-	port := fmt.Sprintf(":%d", env.Server.Port)
-	log.Printf("🌱 [Starting http server %s] 🌱", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", env.Server.Port)}
+	var err error
+	if certs == nil {
+		slog.Info("starting http server", "address", server.Addr)
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig = certs.tlsConfig()
+		slog.Info("starting https server", "address", server.Addr, "clientAuth", env.TLS.ClientAuth)
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil {
+		util.Fatal("http server failed", "error", err)
+	}
 }
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go.springy.io/pkg/util"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+var clientAuth = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersion = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Serves the certificate and verifies the client certificates of the files, which are read again on reload
+type certificates struct {
+	env    util.TLSEnv
+	config atomic.Pointer[tls.Config]
+}
+
+// Loads the certificate (and the client certificate authorities) of the TLS configuration
+func newCertificates(env util.TLSEnv) (*certificates, error) {
+	c := &certificates{env: env}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reads the files again, keeping the certificates in use when they are invalid
+func (c *certificates) reload() error {
+	certificate, err := tls.LoadX509KeyPair(c.env.CertFile, c.env.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load the certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   clientAuth[c.env.ClientAuth],
+		MinVersion:   tlsVersion[c.env.MinVersion],
+		// HTTP/2 is negotiated for the REST API, websockets upgrade HTTP/1.1 connections
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if c.env.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.env.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("unable to load the client certificate authorities: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("unable to load the client certificate authorities: no PEM certificates found")
+		}
+		config.ClientCAs = pool
+	}
+	c.config.Store(config)
+
+	if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err == nil {
+		slog.Info("loaded certificate", "subject", leaf.Subject.String(), "expires", leaf.NotAfter)
+	}
+	return nil
+}
+
+// Returns the server configuration, handing each connection the certificates loaded last
+func (c *certificates) tlsConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.config.Load(), nil
+		},
+	}
+}
+
+// Returns the files watched for certificate renewals
+func (c *certificates) files() []string {
+	return []string{c.env.CertFile, c.env.KeyFile, c.env.ClientCAFile}
+}
+
+// Returns the function mapping the verified client certificate of a request to its identity: the
+// subject common name (cn), or the first uri (uri) or dns (dns) subject alternative name
+func identify(field string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			// No certificate, or one that was not verified
+			return ""
+		}
+		leaf := r.TLS.VerifiedChains[0][0]
+		switch field {
+		case "uri":
+			if len(leaf.URIs) > 0 {
+				return leaf.URIs[0].String()
+			}
+		case "dns":
+			if len(leaf.DNSNames) > 0 {
+				return leaf.DNSNames[0]
+			}
+		default:
+			return leaf.Subject.CommonName
+		}
+		return ""
+	}
+}
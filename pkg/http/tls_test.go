@@ -0,0 +1,119 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/pkg/util"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Issues a certificate signed by the parent (self-signed without one)
+func issue(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return certificate, key
+}
+
+// Writes the certificate and key as PEM files, returning their paths
+func write(t *testing.T, dir string, name string, certificate *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), 0o600)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+
+	dir := t.TempDir()
+	ca, caKey := issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "springy ca"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	caFile, _ := write(t, dir, "ca", ca, caKey)
+	server := func(name string) {
+		certificate, key := issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: name}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca, caKey)
+		write(t, dir, "server", certificate, key)
+	}
+	server("springy one")
+	spiffe, _ := url.Parse("spiffe://example.com/billing")
+	client, clientKey := issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, URIs: []*url.URL{spiffe}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, caKey)
+
+	certs, err := newCertificates(util.TLSEnv{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: caFile,
+		ClientAuth:   "require",
+		MinVersion:   "1.2",
+	})
+	assert.Nil(t, err)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Proto, identify("cn")(r), identify("uri")(r))
+	}))
+	s.EnableHTTP2 = true
+	s.TLS = certs.tlsConfig()
+	s.StartTLS()
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(certificates ...tls.Certificate) (string, string, error) {
+		transport := &http.Transport{ForceAttemptHTTP2: true, TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}
+		defer transport.CloseIdleConnections()
+		response, err := (&http.Client{Transport: transport}).Get(s.URL)
+		if err != nil {
+			return "", "", err
+		}
+		defer response.Body.Close()
+		var proto, cn, uri string
+		fmt.Fscan(response.Body, &proto, &cn, &uri)
+		return proto, cn + " " + uri, nil
+	}
+
+	// Client certificates are verified and mapped to identities, over HTTP/2
+	proto, identity, err := get(tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey})
+	assert.Nil(t, err)
+	assert.Equal(t, "HTTP/2.0", proto)
+	assert.Equal(t, "billing spiffe://example.com/billing", identity)
+
+	_, _, err = get()
+	assert.NotNil(t, err)
+
+	// Renewed certificates are served once reloaded
+	server("springy two")
+	assert.Nil(t, certs.reload())
+	conn, err := tls.Dial("tcp", s.Listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "springy two", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+
+	// Invalid files keep the certificates in use
+	config := certs.config.Load()
+	os.WriteFile(filepath.Join(dir, "server.pem"), []byte("renewing"), 0o600)
+	assert.NotNil(t, certs.reload())
+	assert.Same(t, config, certs.config.Load())
+}
@@ -0,0 +1,358 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Setting is a configuration value, named MONGO_REPLICA_SET in the environment,
+// mongo.replica_set in config files and --mongo-replica-set on the command line
+type Setting struct {
+	Name    string
+	Default string
+	Usage   string
+
+	// Flag indicating if the value is redacted when printed
+	Secret bool
+
+	// Flag indicating if a change takes effect on reload (see Reload), others need a restart
+	Reloadable bool
+}
+
+// Returns the key of the setting in config files
+func (s Setting) Key() string {
+	section, rest, _ := strings.Cut(strings.ToLower(s.Name), "_")
+	return section + "." + rest
+}
+
+// Returns the command line flag of the setting
+func (s Setting) Flag() string {
+	return strings.ReplaceAll(strings.ToLower(s.Name), "_", "-")
+}
+
+// Returns true if the setting is a flag that may be passed without a value
+func (s Setting) boolean() bool {
+	return s.Default == "true" || s.Default == "false"
+}
+
+// Settings lists every configuration value with its default
+var Settings = []Setting{
+	{Name: "MONGO_URI", Usage: "The MongoDB connection string (mongodb:// or mongodb+srv://), used instead of the host, port and replica set", Secret: true},
+	{Name: "MONGO_HOST", Default: "localhost", Usage: "The MongoDB host"},
+	{Name: "MONGO_PORT", Default: "27017", Usage: "The MongoDB port"},
+	{Name: "MONGO_REPLICA_SET", Usage: "The MongoDB replica set (a direct connection is made without one)"},
+	{Name: "MONGO_DB", Default: "springy", Usage: "The database name"},
+	{Name: "MONGO_COLLECTION", Usage: "The default collection"},
+	{Name: "MONGO_USER", Usage: "The database user"},
+	{Name: "MONGO_PASSWORD", Usage: "The database password", Secret: true},
+	{Name: "MONGO_INDEX_FILE", Usage: "The json file declaring the indexes of each collection"},
+	{Name: "MONGO_PRESENCE_COLLECTION", Usage: "The collection presence channel members are persisted to"},
+
+	{Name: "SERVER_PORT", Default: "8080", Usage: "The http port"},
+	{Name: "ADMIN_TOKEN", Usage: "The bearer token guarding the admin API (disabled when empty)", Secret: true, Reloadable: true},
+	{Name: "RULES_FILE", Usage: "The json file holding the authorization rules (everything is allowed when empty)", Reloadable: true},
+	{Name: "METRICS_ENABLED", Default: "true", Usage: "Expose Prometheus metrics on /metrics"},
+
+	{Name: "TLS_CERT_FILE", Usage: "The PEM certificate (chain) served over TLS (plain http when empty)"},
+	{Name: "TLS_KEY_FILE", Usage: "The PEM private key of the certificate"},
+	{Name: "TLS_CLIENT_CA_FILE", Usage: "The PEM certificates of the authorities issuing client certificates"},
+	{Name: "TLS_CLIENT_AUTH", Default: "none", Usage: "Whether clients present certificates (none, optional or require)"},
+	{Name: "TLS_CLIENT_IDENTITY", Default: "cn", Usage: "The client certificate field mapped to the identity (cn, uri or dns)"},
+	{Name: "TLS_MIN_VERSION", Default: "1.2", Usage: "The minimum TLS version (1.2 or 1.3)"},
+
+	{Name: "LOG_LEVEL", Default: "info", Usage: "The minimum level logged (debug, info, warn or error)", Reloadable: true},
+	{Name: "LOG_FORMAT", Default: "text", Usage: "The log line format (text or json)"},
+
+	{Name: "TRACE_EXPORTER", Default: "none", Usage: "Where spans are exported (none, stdout or otlp)"},
+	{Name: "TRACE_ENDPOINT", Default: "http://localhost:4318/v1/traces", Usage: "The OTLP/HTTP traces endpoint"},
+	{Name: "TRACE_SAMPLE_RATIO", Default: "1", Usage: "The fraction of new traces recorded, from 0 to 1"},
+	{Name: "TRACE_SERVICE", Default: "springy", Usage: "The service name spans are exported under"},
+
+	{Name: "STAMP_COLLECTIONS", Usage: "The collections stamped on writes (comma separated)", Reloadable: true},
+	{Name: "STAMP_CREATED_FIELD", Default: "createdAt", Usage: "The field holding the time a document was created", Reloadable: true},
+	{Name: "STAMP_UPDATED_FIELD", Default: "updatedAt", Usage: "The field holding the time a document was last written", Reloadable: true},
+	{Name: "STAMP_AUTHOR_FIELD", Usage: "The field holding the identity of the last writer", Reloadable: true},
+
+	{Name: "SCHEMA_DIR", Usage: "The directory holding a <collection>.json schema per collection"},
+	{Name: "SCHEMA_PUSH", Default: "false", Usage: "Push the schemas to mongo as $jsonSchema validators"},
+
+	{Name: "QUERY_MAX_DEPTH", Default: "8", Usage: "The maximum nesting depth of a filter", Reloadable: true},
+	{Name: "QUERY_MAX_CLAUSES", Default: "256", Usage: "The maximum number of clauses and operands in a filter", Reloadable: true},
+
+	{Name: "EVENT_BUFFER", Default: "256", Usage: "The number of events buffered per subscriber"},
+	{Name: "EVENT_OVERFLOW", Default: "block", Usage: "What happens when a subscriber's buffer is full (block, drop_oldest or drop_newest)"},
+	{Name: "EVENT_TIMEOUT", Default: "5s", Usage: "How long a publisher blocks on a full buffer (zero waits forever)"},
+	{Name: "EVENT_NODE", Usage: "The identifier of this node (random when empty)"},
+	{Name: "EVENT_BROKER", Usage: "The address of the broker connecting the nodes (a single node runs when empty)"},
+	{Name: "EVENT_BROKER_LISTEN", Usage: "The address the embedded broker listens on"},
+	{Name: "EVENT_EXPORT", Usage: "The topics forwarded to the other nodes (comma separated)"},
+	{Name: "EVENT_IMPORT", Usage: "The topics received from the other nodes (comma separated)"},
+
+	{Name: "WS_READ_LIMIT", Default: "1048576", Usage: "The maximum size of a message read from a client", Reloadable: true},
+	{Name: "WS_WRITE_WAIT", Default: "10s", Usage: "Time allowed to write a message to a client", Reloadable: true},
+	{Name: "WS_PONG_WAIT", Default: "60s", Usage: "Time allowed to read the next pong message from a client", Reloadable: true},
+	{Name: "WS_READ_BUFFER_SIZE", Default: "4096", Usage: "The size of the connection read buffers"},
+	{Name: "WS_WRITE_BUFFER_SIZE", Default: "4096", Usage: "The size of the connection write buffers"},
+	{Name: "WS_COMPRESSION", Default: "false", Usage: "Negotiate permessage-deflate compression"},
+	{Name: "WS_COMPRESSION_LEVEL", Default: "1", Usage: "The compression level, from -2 (huffman only) to 9 (best compression)"},
+	{Name: "WS_ALLOWED_ORIGINS", Usage: "The origins allowed to connect (comma separated patterns, same origin only when empty)", Reloadable: true},
+	{Name: "WS_QUEUE_MESSAGES", Default: "256", Usage: "The maximum number of messages queued per client (zero is unlimited)", Reloadable: true},
+	{Name: "WS_QUEUE_BYTES", Default: "1048576", Usage: "The maximum number of bytes queued per client (zero is unlimited)", Reloadable: true},
+	{Name: "WS_QUEUE_POLICY", Default: "disconnect", Usage: "What happens when a client's queue is full (disconnect, drop_oldest or coalesce)", Reloadable: true},
+
+	{Name: "LIMIT_CONNECTION_READS", Default: "100", Usage: "The reads per second of each connection (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_CONNECTION_WRITES", Default: "100", Usage: "The writes and publishes per second of each connection (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_CONNECTION_WATCHES", Default: "20", Usage: "The watches, subscriptions and joins per second of each connection (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_IDENTITY_READS", Default: "0", Usage: "The reads per second of each authenticated identity (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_IDENTITY_WRITES", Default: "0", Usage: "The writes and publishes per second of each authenticated identity (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_IDENTITY_WATCHES", Default: "0", Usage: "The watches, subscriptions and joins per second of each authenticated identity (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_COLLECTION_READS", Default: "0", Usage: "The reads per second of each collection (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_COLLECTION_WRITES", Default: "0", Usage: "The writes per second of each collection (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_COLLECTION_WATCHES", Default: "0", Usage: "The watches per second of each collection (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_BURST", Default: "2", Usage: "The seconds of requests allowed at once after an idle period", Reloadable: true},
+	{Name: "LIMIT_MAX_WATCHES", Default: "256", Usage: "The maximum number of watches open at once on a connection (zero is unlimited)", Reloadable: true},
+	{Name: "LIMIT_MAX_REQUESTS", Default: "256", Usage: "The maximum number of database requests processed at once by the node (zero is unlimited)"},
+}
+
+// The sources of configuration values, from lowest to highest precedence
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// The config file read when none is passed with --config or SPRINGY_CONFIG (if it exists)
+const defaultConfigFile = ".env"
+
+// Value is the effective value of a setting
+type Value struct {
+	Setting Setting
+	Value   string
+	Source  string
+}
+
+// Loader registers the configuration flags on a flag set, and loads the configuration once the
+// flags are parsed
+type Loader struct {
+	flags *flag.FlagSet
+	file  *string
+}
+
+// Registers the configuration flags (--config and one flag per setting) on the flag set
+func NewLoader(flags *flag.FlagSet) *Loader {
+	file := flags.String("config", os.Getenv("SPRINGY_CONFIG"), "The yaml, toml, json or dotenv config file (defaults to .env when it exists)")
+	for _, s := range Settings {
+		if s.boolean() {
+			flags.Bool(s.Flag(), s.Default == "true", s.Usage)
+		} else {
+			flags.String(s.Flag(), s.Default, s.Usage)
+		}
+	}
+	return &Loader{flags: flags, file: file}
+}
+
+// Loads the configuration from the command line arguments
+func Load(args []string) (*Environment, error) {
+	flags := flag.NewFlagSet("springy", flag.ContinueOnError)
+	loader := NewLoader(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	return loader.Load()
+}
+
+// Loads the configuration from, in increasing order of precedence, the defaults, the config file
+// (yaml, toml, json or dotenv), the environment variables and the parsed flags
+func (l *Loader) Load() (*Environment, error) {
+	values := make(map[string]Value, len(Settings))
+	for _, s := range Settings {
+		values[s.Name] = Value{Setting: s, Value: s.Default, Source: SourceDefault}
+	}
+
+	path := *l.file
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		if err := readFile(path, values); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range Settings {
+		if value, ok := os.LookupEnv(s.Name); ok {
+			values[s.Name] = Value{Setting: s, Value: value, Source: SourceEnv}
+		}
+	}
+
+	byFlag := make(map[string]Setting, len(Settings))
+	for _, s := range Settings {
+		byFlag[s.Flag()] = s
+	}
+	l.flags.Visit(func(f *flag.Flag) {
+		if s, ok := byFlag[f.Name]; ok {
+			values[s.Name] = Value{Setting: s, Value: f.Value.String(), Source: SourceFlag}
+		}
+	})
+
+	e, err := build(values)
+	if err != nil {
+		return nil, err
+	}
+	e.File = path
+	return e, nil
+}
+
+// Builds and validates the environment from the effective setting values, returning a
+// *ConfigError listing the settings of the wrong type and the invalid ones
+func build(values map[string]Value) (*Environment, error) {
+	e, errs := parse(values)
+
+	// Settings of the wrong type are not validated any further
+	invalid := make(map[string]bool, len(errs))
+	for _, err := range errs {
+		invalid[err.Name] = true
+	}
+	for _, err := range e.validate() {
+		if !invalid[err.Name] {
+			errs = append(errs, err)
+		}
+	}
+	if err := configError(errs); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reads the values set by a config file. Dotenv files use the environment names (MONGO_HOST),
+// other files nest the values by section (mongo: {host: ...}).
+func readFile(path string, values map[string]Value) error {
+	f := viper.New()
+	f.SetConfigFile(path)
+	if filepath.Base(path) == defaultConfigFile {
+		f.SetConfigType("dotenv")
+	}
+	if err := f.ReadInConfig(); err != nil {
+		return fmt.Errorf("unable to read config file %s: %w", path, err)
+	}
+	for _, s := range Settings {
+		for _, key := range []string{s.Key(), strings.ToLower(s.Name)} {
+			if f.IsSet(key) {
+				values[s.Name] = Value{Setting: s, Value: text(f.Get(key)), Source: SourceFile}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Formats a config file value, joining lists with commas
+func text(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// Returns the value as printed, redacting secrets
+func (v Value) Redacted() string {
+	if !v.Setting.Secret || v.Value == "" {
+		return v.Value
+	}
+	if u, err := url.Parse(v.Value); err == nil && u.Scheme != "" {
+		// Connection strings only hide their password
+		return u.Redacted()
+	}
+	return "********"
+}
+
+// Writes the effective configuration in the dotenv format, redacting secrets
+func (e *Environment) Print(w io.Writer) {
+	if e.File != "" {
+		fmt.Fprintf(w, "# Config file: %s\n", e.File)
+	}
+	for _, s := range Settings {
+		v := e.values[s.Name]
+		fmt.Fprintf(w, "%s=%s # %s\n", s.Name, v.Redacted(), v.Source)
+	}
+}
+
+// Returns the effective values of the settings
+func (e *Environment) Values() []Value {
+	values := make([]Value, 0, len(Settings))
+	for _, s := range Settings {
+		values = append(values, e.values[s.Name])
+	}
+	return values
+}
+
+// Change is a setting whose value differs between two configurations
+type Change struct {
+	From Value
+	To   Value
+}
+
+// Returns the settings whose values differ in the next configuration
+func (e *Environment) Changes(next *Environment) []Change {
+	var changes []Change
+	for _, s := range Settings {
+		from, to := e.values[s.Name], next.values[s.Name]
+		if from.Value != to.Value {
+			changes = append(changes, Change{From: from, To: to})
+		}
+	}
+	return changes
+}
+
+// SettingError describes an invalid setting
+type SettingError struct {
+	Name    string
+	Message string
+}
+
+func newSettingError(name string, format string, args ...interface{}) *SettingError {
+	return &SettingError{Name: name, Message: fmt.Sprintf(format, args...)}
+}
+
+// Names the setting in every form it can be passed in
+func (e *SettingError) Error() string {
+	s := Setting{Name: e.Name}
+	return fmt.Sprintf("%s (%s, --%s): %s", e.Name, s.Key(), s.Flag(), e.Message)
+}
+
+// ConfigError lists the invalid settings of a configuration
+type ConfigError struct {
+	Errors []*SettingError
+}
+
+func (e *ConfigError) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		lines[i] = "  " + err.Error()
+	}
+	return "invalid configuration:\n" + strings.Join(lines, "\n")
+}
+
+// Returns nil, or a *ConfigError listing the errors
+func configError(errs []*SettingError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ConfigError{Errors: errs}
+}
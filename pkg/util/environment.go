@@ -1,24 +1,35 @@
 package util
 
 import (
-	"github.com/spf13/viper"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	env  *Environment
-	once sync.Once
+	env   *Environment
+	mutex sync.Mutex
+
+	// The command line arguments passed to Configure, loaded again on Reload
+	args []string
 )
 
 type ServerEnv struct {
 	Port int
+	// The bearer token guarding the admin API (the admin API is disabled when empty)
+	AdminToken string
+	// The json file holding the authorization rules (everything is allowed when empty)
+	RulesFile string
+	// Flag indicating if Prometheus metrics are exposed on /metrics
+	Metrics bool
 }
 
 type DatabaseEnv struct {
+	// The connection string, used instead of the host, port and replica set (optional)
+	URI        string
 	Host       string
 	Port       int
 	Db         string
@@ -26,11 +37,186 @@ type DatabaseEnv struct {
 	Username   string
 	Password   string
 	ReplicaSet string
+	// The json file declaring the indexes of each collection (optional)
+	IndexFile string
+	// The collection presence channel members are persisted to (optional)
+	PresenceCollection string
+}
+
+// Configures the fields the server stamps automatically on writes
+type StampEnv struct {
+	// The collections to stamp
+	Collections []string
+	// The field holding the time a document was created
+	CreatedField string
+	// The field holding the time a document was last written
+	UpdatedField string
+	// The field holding the identity of the last writer (optional)
+	AuthorField string
+}
+
+// Configures the JSON schemas enforced on writes
+type SchemaEnv struct {
+	// The directory holding a <collection>.json schema per collection (optional)
+	Dir string
+	// Flag indicating if the schemas are also pushed to mongo as $jsonSchema validators
+	Push bool
+}
+
+// Configures TLS termination
+type TLSEnv struct {
+	// The PEM certificate (chain) and private key served, plain http being served when empty
+	CertFile string
+	KeyFile  string
+	// The PEM certificates of the authorities issuing client certificates
+	ClientCAFile string
+	// Whether clients present certificates (none, optional or require)
+	ClientAuth string
+	// The client certificate field mapped to the identity of a connection (cn, uri or dns)
+	ClientIdentity string
+	// The minimum TLS version (1.2 or 1.3)
+	MinVersion string
+}
+
+// Returns true if TLS is terminated by the server
+func (e *TLSEnv) Enabled() bool {
+	return e.CertFile != ""
+}
+
+// Configures the logger
+type LogEnv struct {
+	// The minimum level logged (debug, info, warn or error)
+	Level string
+	// The line format (text or json)
+	Format string
+}
+
+// Configures the tracing of requests
+type TraceEnv struct {
+	// Where spans are exported (none, stdout or otlp)
+	Exporter string
+	// The OTLP/HTTP traces endpoint of the collector
+	Endpoint string
+	// The fraction of new traces recorded, from 0 to 1
+	Ratio float64
+	// The service name the spans are exported under
+	Service string
+}
+
+// Configures the websocket connections
+type WebSocketEnv struct {
+	// The maximum size of a message read from a client
+	ReadLimit int64
+	// Time allowed to write a message to a client
+	WriteWait time.Duration
+	// Time allowed to read the next pong message from a client (pings are sent at 9/10 of it)
+	PongWait time.Duration
+	// The size of the connection read and write buffers
+	ReadBufferSize  int
+	WriteBufferSize int
+	// Flag indicating if permessage-deflate compression is negotiated with clients
+	Compression bool
+	// The compression level, from -2 (huffman only) to 9 (best compression)
+	CompressionLevel int
+	// The origins allowed to connect, such as https://*.example.com (same origin only when empty)
+	AllowedOrigins []string
+	// The maximum number of messages queued per client (zero is unlimited)
+	QueueMessages int
+	// The maximum number of bytes queued per client (zero is unlimited)
+	QueueBytes int
+	// What happens when a client's queue is full (disconnect, drop_oldest or coalesce)
+	QueuePolicy string
+}
+
+// Configures the rate limits (in requests per second) and quotas of the client requests, where
+// zero is unlimited. Reads are finds, writes include channel publishes, and watches include
+// channel subscriptions and joins.
+type LimitEnv struct {
+	// The rates of each connection
+	ConnectionReads   float64
+	ConnectionWrites  float64
+	ConnectionWatches float64
+	// The rates of each authenticated identity, across its connections
+	IdentityReads   float64
+	IdentityWrites  float64
+	IdentityWatches float64
+	// The rates of each collection
+	CollectionReads   float64
+	CollectionWrites  float64
+	CollectionWatches float64
+	// The seconds of requests allowed at once after an idle period
+	Burst float64
+	// The maximum number of watches open at once on a connection
+	MaxWatches int
+	// The maximum number of database requests processed at once by the node
+	MaxRequests int
+}
+
+// Configures the limits on query filters sent by clients
+type QueryEnv struct {
+	// The maximum nesting depth of a filter
+	MaxDepth int
+	// The maximum number of clauses and operands in a filter
+	MaxClauses int
+}
+
+// Configures the event buses connecting the subsystems
+type EventEnv struct {
+	// The number of events buffered per subscriber
+	Buffer int
+	// What happens when a subscriber's buffer is full (block, drop_oldest or drop_newest)
+	Overflow string
+	// How long a publisher blocks on a full buffer before dropping the event (zero waits forever)
+	Timeout time.Duration
+	// The identifier of this node (random if empty)
+	Node string
+	// The address of the broker connecting the nodes (empty runs a single node)
+	Broker string
+	// The address the embedded broker listens on (empty does not run it)
+	BrokerListen string
+	// The topics forwarded to the other nodes
+	Export []string
+	// The topics received from the other nodes
+	Import []string
 }
 
 type Environment struct {
 	Server   ServerEnv
 	Database DatabaseEnv
+	Stamp    StampEnv
+	Schema   SchemaEnv
+	Query    QueryEnv
+	Event    EventEnv
+
+	WebSocket WebSocketEnv
+	Limit     LimitEnv
+	Log       LogEnv
+	Trace     TraceEnv
+	TLS       TLSEnv
+
+	// The config file the configuration was read from (if any)
+	File string
+
+	// The effective setting values
+	values map[string]Value
+}
+
+// Returns true if writes to the collection should be stamped
+func (e *StampEnv) Stamps(collection string) bool {
+	for _, c := range e.Collections {
+		if c == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address of the database for log lines, hiding the password of connection strings
+func (e *DatabaseEnv) Address() string {
+	if e.URI != "" {
+		return Value{Setting: Setting{Secret: true}, Value: e.URI}.Redacted()
+	}
+	return e.GetURI()
 }
 
 // Builds the fully qualified host URI
@@ -43,39 +229,317 @@ func (e *DatabaseEnv) GetURI() string {
 	return uri
 }
 
-//Our singleton instance of the Environment
+// Our singleton instance of the Environment, loaded from the defaults, the .env file (or the
+// SPRINGY_CONFIG file) and the environment unless Configure was called first
 func Env() *Environment {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if env == nil {
+		e, err := Load(nil)
+		if err != nil {
+			Fatal("unable to load the configuration", "error", err)
+		}
+		install(e)
+	}
+	return env
+}
 
-	once.Do(func() {
+// Loads the configuration from the command line arguments (see Load) and makes it the Environment
+func Configure(a []string) (*Environment, error) {
+	e, err := Load(a)
+	if err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	args = a
+	install(e)
+	return e, nil
+}
 
-		log.Println("🌱 [Configuring Springy] 🌱")
-		viper.SetConfigFile(".env")
+// Loads the configuration again from the arguments passed to Configure, returning it with the
+// changed settings without making it the Environment. The settings needing a restart keep their
+// current values (see Setting.Reloadable), and the resulting mix of values is validated again.
+func Reload() (*Environment, []Change, error) {
+	current := Env()
+	mutex.Lock()
+	a := args
+	mutex.Unlock()
 
-		if err := viper.ReadInConfig(); err != nil {
-			log.Fatalf("Error reading config file, %s", err)
+	next, err := Load(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(map[string]Value, len(Settings))
+	for _, s := range Settings {
+		if s.Reloadable {
+			values[s.Name] = next.values[s.Name]
+		} else {
+			values[s.Name] = current.values[s.Name]
 		}
+	}
+	// Settings validated together, such as a reloaded limit against a kept one, may disagree
+	e, err := build(values)
+	if err != nil {
+		return nil, nil, err
+	}
+	e.File = next.File
+	return e, current.Changes(next), nil
+}
 
-		dir, _ := os.Getwd()
-		log.Println("🎯", dir)
-
-		db := DatabaseEnv{
-			Host:       viper.GetString("MONGO_HOST"),
-			Port:       viper.GetInt("MONGO_PORT"),
-			Db:         viper.GetString("MONGO_DB"),
-			Collection: viper.GetString("MONGO_COLLECTION"),
-			Username:   viper.GetString("MONGO_USER"),
-			Password:   viper.GetString("MONGO_PASSWORD"),
-			ReplicaSet: viper.GetString("MONGO_REPLICA_SET"),
-		}
+// Makes the loaded configuration the Environment
+func SetEnv(e *Environment) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	install(e)
+}
 
-		server := ServerEnv{
-			Port: viper.GetInt("SERVER_PORT"),
+// Installs the environment and configures the default logger. The caller must hold the lock.
+func install(e *Environment) {
+	logger, _ := NewLogger(os.Stderr, e.Log.Format, e.Log.Level)
+	slog.SetDefault(logger)
+
+	dir, _ := os.Getwd()
+	slog.Info("configuring springy", "dir", dir, "file", e.File)
+	env = e
+}
+
+// Builds the environment from the effective setting values, reporting the values of the wrong type
+func parse(values map[string]Value) (*Environment, []*SettingError) {
+	p := &parser{values: values}
+
+	e := &Environment{
+		Server: ServerEnv{
+			Port:       p.int("SERVER_PORT"),
+			AdminToken: p.string("ADMIN_TOKEN"),
+			RulesFile:  p.string("RULES_FILE"),
+			Metrics:    p.bool("METRICS_ENABLED"),
+		},
+		Database: DatabaseEnv{
+			URI:        p.string("MONGO_URI"),
+			Host:       p.string("MONGO_HOST"),
+			Port:       p.int("MONGO_PORT"),
+			Db:         p.string("MONGO_DB"),
+			Collection: p.string("MONGO_COLLECTION"),
+			Username:   p.string("MONGO_USER"),
+			Password:   p.string("MONGO_PASSWORD"),
+			ReplicaSet: p.string("MONGO_REPLICA_SET"),
+			IndexFile:  p.string("MONGO_INDEX_FILE"),
+
+			PresenceCollection: p.string("MONGO_PRESENCE_COLLECTION"),
+		},
+		Stamp: StampEnv{
+			Collections:  p.list("STAMP_COLLECTIONS"),
+			CreatedField: p.string("STAMP_CREATED_FIELD"),
+			UpdatedField: p.string("STAMP_UPDATED_FIELD"),
+			AuthorField:  p.string("STAMP_AUTHOR_FIELD"),
+		},
+		Schema: SchemaEnv{
+			Dir:  p.string("SCHEMA_DIR"),
+			Push: p.bool("SCHEMA_PUSH"),
+		},
+		Query: QueryEnv{
+			MaxDepth:   p.int("QUERY_MAX_DEPTH"),
+			MaxClauses: p.int("QUERY_MAX_CLAUSES"),
+		},
+		Event: EventEnv{
+			Buffer:   p.int("EVENT_BUFFER"),
+			Overflow: p.string("EVENT_OVERFLOW"),
+			Timeout:  p.duration("EVENT_TIMEOUT"),
+
+			Node:         p.string("EVENT_NODE"),
+			Broker:       p.string("EVENT_BROKER"),
+			BrokerListen: p.string("EVENT_BROKER_LISTEN"),
+			Export:       p.list("EVENT_EXPORT"),
+			Import:       p.list("EVENT_IMPORT"),
+		},
+		WebSocket: WebSocketEnv{
+			ReadLimit:        int64(p.int("WS_READ_LIMIT")),
+			WriteWait:        p.duration("WS_WRITE_WAIT"),
+			PongWait:         p.duration("WS_PONG_WAIT"),
+			ReadBufferSize:   p.int("WS_READ_BUFFER_SIZE"),
+			WriteBufferSize:  p.int("WS_WRITE_BUFFER_SIZE"),
+			Compression:      p.bool("WS_COMPRESSION"),
+			CompressionLevel: p.int("WS_COMPRESSION_LEVEL"),
+			AllowedOrigins:   p.list("WS_ALLOWED_ORIGINS"),
+
+			QueueMessages: p.int("WS_QUEUE_MESSAGES"),
+			QueueBytes:    p.int("WS_QUEUE_BYTES"),
+			QueuePolicy:   p.string("WS_QUEUE_POLICY"),
+		},
+		Limit: LimitEnv{
+			ConnectionReads:   p.float("LIMIT_CONNECTION_READS"),
+			ConnectionWrites:  p.float("LIMIT_CONNECTION_WRITES"),
+			ConnectionWatches: p.float("LIMIT_CONNECTION_WATCHES"),
+			IdentityReads:     p.float("LIMIT_IDENTITY_READS"),
+			IdentityWrites:    p.float("LIMIT_IDENTITY_WRITES"),
+			IdentityWatches:   p.float("LIMIT_IDENTITY_WATCHES"),
+			CollectionReads:   p.float("LIMIT_COLLECTION_READS"),
+			CollectionWrites:  p.float("LIMIT_COLLECTION_WRITES"),
+			CollectionWatches: p.float("LIMIT_COLLECTION_WATCHES"),
+			Burst:             p.float("LIMIT_BURST"),
+			MaxWatches:        p.int("LIMIT_MAX_WATCHES"),
+			MaxRequests:       p.int("LIMIT_MAX_REQUESTS"),
+		},
+		TLS: TLSEnv{
+			CertFile:       p.string("TLS_CERT_FILE"),
+			KeyFile:        p.string("TLS_KEY_FILE"),
+			ClientCAFile:   p.string("TLS_CLIENT_CA_FILE"),
+			ClientAuth:     p.string("TLS_CLIENT_AUTH"),
+			ClientIdentity: p.string("TLS_CLIENT_IDENTITY"),
+			MinVersion:     p.string("TLS_MIN_VERSION"),
+		},
+		Log: LogEnv{
+			Level:  p.string("LOG_LEVEL"),
+			Format: p.string("LOG_FORMAT"),
+		},
+		Trace: TraceEnv{
+			Exporter: p.string("TRACE_EXPORTER"),
+			Endpoint: p.string("TRACE_ENDPOINT"),
+			Ratio:    p.float("TRACE_SAMPLE_RATIO"),
+			Service:  p.string("TRACE_SERVICE"),
+		},
+		values: values,
+	}
+	return e, p.errors
+}
+
+// Validates the configuration, returning a *ConfigError listing every invalid setting
+func (e *Environment) Validate() error {
+	return configError(e.validate())
+}
+
+func (e *Environment) validate() []*SettingError {
+	var errs []*SettingError
+	check := func(ok bool, name string, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, newSettingError(name, format, args...))
+		}
+	}
+	oneOf := func(name string, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
 		}
+		errs = append(errs, newSettingError(name, "unknown value '%s', expected %s", value, strings.Join(allowed, ", ")))
+	}
+
+	check(e.Server.Port > 0 && e.Server.Port <= 65535, "SERVER_PORT", "must be a port between 1 and 65535")
+	if e.Database.URI != "" {
+		// The hosts of mongodb+srv strings are only resolved when connecting
+		scheme, rest, _ := strings.Cut(e.Database.URI, "://")
+		check(scheme == "mongodb" || scheme == "mongodb+srv", "MONGO_URI", "must start with mongodb:// or mongodb+srv://")
+		check(strings.Trim(rest, "/") != "", "MONGO_URI", "must name at least one host")
+	} else {
+		check(e.Database.Host != "", "MONGO_HOST", "is required without MONGO_URI")
+		check(e.Database.Port > 0 && e.Database.Port <= 65535, "MONGO_PORT", "must be a port between 1 and 65535")
+	}
+	check(e.Database.Db != "", "MONGO_DB", "is required")
+
+	check((e.TLS.CertFile == "") == (e.TLS.KeyFile == ""), "TLS_KEY_FILE", "must be set with TLS_CERT_FILE")
+	oneOf("TLS_CLIENT_AUTH", e.TLS.ClientAuth, "none", "optional", "require")
+	check(e.TLS.ClientAuth == "none" || (e.TLS.Enabled() && e.TLS.ClientCAFile != ""), "TLS_CLIENT_AUTH", "requires TLS_CERT_FILE and TLS_CLIENT_CA_FILE")
+	oneOf("TLS_CLIENT_IDENTITY", e.TLS.ClientIdentity, "cn", "uri", "dns")
+	oneOf("TLS_MIN_VERSION", e.TLS.MinVersion, "1.2", "1.3")
+
+	oneOf("LOG_LEVEL", strings.ToLower(e.Log.Level), "debug", "info", "warn", "error")
+	oneOf("LOG_FORMAT", strings.ToLower(e.Log.Format), "text", "json")
+	oneOf("TRACE_EXPORTER", e.Trace.Exporter, "none", "stdout", "otlp")
+	check(e.Trace.Ratio >= 0 && e.Trace.Ratio <= 1, "TRACE_SAMPLE_RATIO", "must be between 0 and 1")
+
+	check(e.Query.MaxDepth > 0, "QUERY_MAX_DEPTH", "must be positive")
+	check(e.Query.MaxClauses > 0, "QUERY_MAX_CLAUSES", "must be positive")
+
+	check(e.Event.Buffer >= 0, "EVENT_BUFFER", "must not be negative")
+	oneOf("EVENT_OVERFLOW", e.Event.Overflow, "block", "drop_oldest", "drop_newest")
+	check(e.Event.Timeout >= 0, "EVENT_TIMEOUT", "must not be negative")
+
+	check(e.WebSocket.ReadLimit > 0, "WS_READ_LIMIT", "must be positive")
+	check(e.WebSocket.WriteWait > 0, "WS_WRITE_WAIT", "must be positive")
+	check(e.WebSocket.PongWait > 0, "WS_PONG_WAIT", "must be positive")
+	check(e.WebSocket.CompressionLevel >= -2 && e.WebSocket.CompressionLevel <= 9, "WS_COMPRESSION_LEVEL", "must be between -2 and 9")
+	check(e.WebSocket.QueueMessages >= 0, "WS_QUEUE_MESSAGES", "must not be negative")
+	check(e.WebSocket.QueueBytes >= 0, "WS_QUEUE_BYTES", "must not be negative")
+	oneOf("WS_QUEUE_POLICY", e.WebSocket.QueuePolicy, "disconnect", "drop_oldest", "coalesce")
 
-		env = &Environment{
-			Server:   server,
-			Database: db,
+	rates := []struct {
+		name string
+		rate float64
+	}{
+		{"LIMIT_CONNECTION_READS", e.Limit.ConnectionReads},
+		{"LIMIT_CONNECTION_WRITES", e.Limit.ConnectionWrites},
+		{"LIMIT_CONNECTION_WATCHES", e.Limit.ConnectionWatches},
+		{"LIMIT_IDENTITY_READS", e.Limit.IdentityReads},
+		{"LIMIT_IDENTITY_WRITES", e.Limit.IdentityWrites},
+		{"LIMIT_IDENTITY_WATCHES", e.Limit.IdentityWatches},
+		{"LIMIT_COLLECTION_READS", e.Limit.CollectionReads},
+		{"LIMIT_COLLECTION_WRITES", e.Limit.CollectionWrites},
+		{"LIMIT_COLLECTION_WATCHES", e.Limit.CollectionWatches},
+	}
+	for _, r := range rates {
+		check(r.rate >= 0, r.name, "must not be negative")
+	}
+	check(e.Limit.Burst > 0, "LIMIT_BURST", "must be positive")
+	check(e.Limit.MaxWatches >= 0, "LIMIT_MAX_WATCHES", "must not be negative")
+	check(e.Limit.MaxRequests >= 0, "LIMIT_MAX_REQUESTS", "must not be negative")
+
+	return errs
+}
+
+// Converts setting values, collecting the conversion errors
+type parser struct {
+	values map[string]Value
+	errors []*SettingError
+}
+
+func (p *parser) string(name string) string {
+	return strings.TrimSpace(p.values[name].Value)
+}
+
+func (p *parser) int(name string) int {
+	value, err := strconv.Atoi(p.string(name))
+	if err != nil {
+		p.errors = append(p.errors, newSettingError(name, "'%s' is not an integer", p.string(name)))
+	}
+	return value
+}
+
+func (p *parser) float(name string) float64 {
+	value, err := strconv.ParseFloat(p.string(name), 64)
+	if err != nil {
+		p.errors = append(p.errors, newSettingError(name, "'%s' is not a number", p.string(name)))
+	}
+	return value
+}
+
+func (p *parser) bool(name string) bool {
+	value, err := strconv.ParseBool(p.string(name))
+	if err != nil {
+		p.errors = append(p.errors, newSettingError(name, "'%s' is not a boolean", p.string(name)))
+	}
+	return value
+}
+
+func (p *parser) duration(name string) time.Duration {
+	value, err := time.ParseDuration(p.string(name))
+	if err != nil {
+		p.errors = append(p.errors, newSettingError(name, "'%s' is not a duration such as 10s or 1m", p.string(name)))
+	}
+	return value
+}
+
+func (p *parser) list(name string) []string {
+	return split(p.string(name))
+}
+
+// Splits a comma separated list, dropping empty values
+func split(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
 		}
-	})
-	return env
+	}
+	return values
 }
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// LogLevel is the level of the default logger, which may be changed while running
+var LogLevel = new(slog.LevelVar)
+
+// Creates a logger writing json or text lines at or above the level (debug, info, warn or error)
+func NewLogger(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level '%s'", level)
+	}
+	LogLevel.Set(l)
+
+	options := &slog.HandlerOptions{Level: LogLevel}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("invalid log format '%s'", format)
+}
+
+// Logs the error and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,29 @@
+package util_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.springy.io/pkg/util"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+
+	var out bytes.Buffer
+	logger, err := util.NewLogger(&out, "json", "warn")
+	assert.Nil(t, err)
+
+	logger.Info("hidden")
+	logger.Warn("shown", "connection", "abc")
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "shown", line["msg"])
+	assert.Equal(t, "abc", line["connection"])
+
+	_, err = util.NewLogger(&out, "xml", "info")
+	assert.NotNil(t, err)
+	_, err = util.NewLogger(&out, "text", "loud")
+	assert.NotNil(t, err)
+}
@@ -3,8 +3,22 @@ const SpringyScope = Object.freeze({
     findOne: "findOne",
     write: "write",
     watch: "watch",
+    join: "join",
+    leave: "leave",
+    subscribe: "subscribe",
+    unsubscribe: "unsubscribe",
+    publish: "publish",
+    unwatch: "unwatch",
 });
 
+const SpringyProtocol = Object.freeze({
+    json: "springy.json.v2",
+    msgpack: "springy.msgpack.v2",
+});
+
+// The close code of servers not supporting the protocol version
+const SpringyUnsupportedProtocol = 4001;
+
 const SpringyEvents = Object.freeze({
     insert: "insert",
     update: "update",
@@ -34,7 +48,14 @@ class Database {
     constructor(config) {
         this.isConnected = false;
         this.collections = new Map();
-        this.ws = new WebSocket(config.databaseURL);
+        this.channels = new Map();
+        this.topics = new Map();
+        // Called when the server dropped messages because the client fell behind
+        this.onBehind = config.onBehind || ((message) => console.warn('💩', message.error.message));
+        // Frames are json unless the config asks for msgpack
+        this.msgpack = config.protocol === "msgpack";
+        this.ws = new WebSocket(config.databaseURL, this.msgpack ? [SpringyProtocol.msgpack] : [SpringyProtocol.json]);
+        this.ws.binaryType = "arraybuffer";
         this.addSocketHandlers();
     }
 
@@ -46,10 +67,13 @@ class Database {
         };
         this.ws.onclose = function (e) {
             self.isConnected = false;
+            if (e.code === SpringyUnsupportedProtocol) {
+                console.error('💩 Unsupported protocol:', e.reason);
+            }
         };
         this.ws.onmessage = function (e) {
             try {
-                let data = JSON.parse(e.data);
+                let data = typeof e.data === "string" ? JSON.parse(e.data) : MsgPack.decode(new Uint8Array(e.data));
                 data.forEach(message => {
                     self.broadcast(message);
                 });
@@ -62,12 +86,34 @@ class Database {
     /// Publishes a message out to the database
     publish = (message) => {
         this.queueMessage(() => {
-            this.ws.send(message);
+            this.ws.send(this.msgpack ? MsgPack.encode(JSON.parse(message)) : message);
         });
     };
 
     /// Broadcasts an incoming message to collection handlers
     broadcast = (message) => {
+        if (message["_type"] === "hello") {
+            // The server's protocol version and capabilities
+            this.version = message.version;
+            this.connection = message.connection;
+            this.capabilities = message.capabilities;
+            return;
+        }
+        if (message["_uid"] === undefined && message.error && message.error.code === "slow_consumer") {
+            this.onBehind(message);
+            return;
+        }
+        if (message["_channel"] !== undefined) {
+            let channel = this.channels.get(message["_channel"]);
+            if (channel && channel.uid === message["_uid"]) {
+                channel.notify(message);
+            }
+            let topic = this.topics.get(message["_channel"]);
+            if (topic && topic.uid === message["_uid"]) {
+                topic.notify(message);
+            }
+            return;
+        }
         this.collections.forEach((collection, key) => {
             collection.notify(message);
         });
@@ -93,6 +139,120 @@ class Database {
         this.collections.set(name, collection);
         return collection;
     };
+
+    // Returns a presence channel for the specified name
+    channel = (name) => {
+        if (this.channels.has(name)) {
+            return this.channels.get(name);
+        }
+        let channel = new PresenceChannel(this, name);
+        this.channels.set(name, channel);
+        return channel;
+    };
+
+    // Returns an ephemeral pub/sub topic for the specified channel name (messages are never stored)
+    topic = (name) => {
+        if (this.topics.has(name)) {
+            return this.topics.get(name);
+        }
+        let topic = new Topic(this, name);
+        this.topics.set(name, topic);
+        return topic;
+    };
+}
+
+class Topic {
+
+    constructor(database, name) {
+        this.database = database;
+        this.name = name;
+        this.uid = uuidv4();
+        this.callback = null;
+    }
+
+    // Subscribes to messages published on the channel. The callback receives (value, from, error).
+    subscribe = (callback) => {
+        this.callback = callback;
+        this.send(SpringyScope.subscribe, null);
+    };
+
+    // Stops receiving messages published on the channel
+    unsubscribe = () => {
+        this.callback = null;
+        this.send(SpringyScope.unsubscribe, null);
+    };
+
+    // Publishes a message to every subscriber of the channel
+    publish = (value) => {
+        this.send(SpringyScope.publish, value);
+    };
+
+    send = (scope, value) => {
+        let encoded = {
+            _uid: this.uid,
+            channel: this.name,
+            scope: scope,
+            value: value ?? {}
+        };
+        this.database.publish(JSON.stringify(encoded));
+    };
+
+    notify = (data) => {
+        if (data["error"]) {
+            console.error(data["error"]);
+        }
+        if (this.callback) {
+            this.callback(data["value"], data["_from"], data["error"]);
+        }
+    };
+}
+
+class PresenceChannel {
+
+    constructor(database, name) {
+        this.database = database;
+        this.name = name;
+        this.members = new Map();
+        this.uid = null;
+        this.callback = null;
+    }
+
+    // Announces this client in the channel with the specified metadata. The callback receives the
+    // current members and every subsequent presence diff ({members, joined, updated, left}).
+    join = (meta, callback) => {
+        this.uid = uuidv4();
+        this.callback = callback;
+        this.send(SpringyScope.join, meta);
+    };
+
+    // Leaves the channel
+    leave = () => {
+        this.send(SpringyScope.leave, null);
+    };
+
+    send = (scope, meta) => {
+        let encoded = {
+            _uid: this.uid ?? uuidv4(),
+            channel: this.name,
+            scope: scope,
+            value: meta ?? {}
+        };
+        this.database.publish(JSON.stringify(encoded));
+    };
+
+    // Applies a presence diff to the member list
+    notify = (data) => {
+        let diff = data["value"] ?? {};
+        if (diff.members) {
+            this.members.clear();
+            diff.members.forEach(member => this.members.set(member.id, member));
+        }
+        (diff.joined ?? []).concat(diff.updated ?? []).forEach(member => this.members.set(member.id, member));
+        (diff.left ?? []).forEach(member => this.members.delete(member.id));
+        if (this.callback) {
+            this.callback(diff, this.members);
+        }
+    };
 }
 
 class DocumentCollection {
@@ -117,6 +277,12 @@ class DocumentCollection {
         return subscriber;
     };
 
+    // Stops a watch, freeing its place in the watches open on the connection
+    unwatch = (subscriber) => {
+        this.subscribers.delete(subscriber.identifier);
+        this.database.publish(JSON.stringify({_uid: subscriber.uid, scope: SpringyScope.unwatch}));
+    };
+
     // Fetches all documents in the collection
     get = (callback) => {
         let subscriber = new DataSubscriber(this.name, {}, SpringyScope.find, null, null, callback);
@@ -200,7 +366,7 @@ class DataSnapshot {
     }
 
     get key() {
-        return this.value._id;
+        return objectKey(this.value._id);
     }
 
     get identifier() {
@@ -233,6 +399,134 @@ class OnDisconnect {
     }
 }
 
+// Encodes and decodes the json-like values carried by msgpack frames (https://msgpack.org)
+const MsgPack = Object.freeze({
+
+    encode(value) {
+        let bytes = [];
+        let text = new TextEncoder();
+        let header = (n, fix, fixMax, f8, f16, f32) => {
+            if (fix !== null && n <= fixMax) {
+                bytes.push(fix | n);
+            } else if (f8 !== null && n <= 0xff) {
+                bytes.push(f8, n);
+            } else if (n <= 0xffff) {
+                bytes.push(f16, n >> 8, n & 0xff);
+            } else {
+                bytes.push(f32, n >>> 24, (n >> 16) & 0xff, (n >> 8) & 0xff, n & 0xff);
+            }
+        };
+        let write = (v) => {
+            if (v === null || v === undefined) {
+                bytes.push(0xc0);
+            } else if (typeof v === "boolean") {
+                bytes.push(v ? 0xc3 : 0xc2);
+            } else if (typeof v === "number") {
+                if (Number.isInteger(v) && v >= 0 && v <= 0x7f) {
+                    bytes.push(v);
+                } else if (Number.isInteger(v) && v < 0 && v >= -32) {
+                    bytes.push(v & 0xff);
+                } else if (Number.isInteger(v) && v >= -0x80000000 && v <= 0x7fffffff) {
+                    bytes.push(0xd2, (v >>> 24) & 0xff, (v >> 16) & 0xff, (v >> 8) & 0xff, v & 0xff);
+                } else {
+                    let view = new DataView(new ArrayBuffer(8));
+                    view.setFloat64(0, v);
+                    bytes.push(0xcb, ...new Uint8Array(view.buffer));
+                }
+            } else if (typeof v === "string") {
+                let encoded = text.encode(v);
+                header(encoded.length, 0xa0, 31, 0xd9, 0xda, 0xdb);
+                bytes.push(...encoded);
+            } else if (Array.isArray(v)) {
+                header(v.length, 0x90, 15, null, 0xdc, 0xdd);
+                v.forEach(write);
+            } else {
+                let keys = Object.keys(v).filter(k => v[k] !== undefined);
+                header(keys.length, 0x80, 15, null, 0xde, 0xdf);
+                keys.forEach(k => {
+                    write(k);
+                    write(v[k]);
+                });
+            }
+        };
+        write(value);
+        return new Uint8Array(bytes);
+    },
+
+    decode(bytes) {
+        let view = new DataView(bytes.buffer, bytes.byteOffset, bytes.byteLength);
+        let text = new TextDecoder();
+        let offset = 0;
+        let string = (n) => {
+            let s = text.decode(bytes.subarray(offset, offset + n));
+            offset += n;
+            return s;
+        };
+        let array = (n) => {
+            let a = [];
+            for (let i = 0; i < n; i++) {
+                a.push(read());
+            }
+            return a;
+        };
+        let map = (n) => {
+            let m = {};
+            for (let i = 0; i < n; i++) {
+                let k = read();
+                m[k] = read();
+            }
+            return m;
+        };
+        let next = (size, get) => {
+            let v = get(offset);
+            offset += size;
+            return v;
+        };
+        let read = () => {
+            let t = bytes[offset++];
+            if (t <= 0x7f) return t;
+            if (t >= 0xe0) return t - 0x100;
+            if ((t & 0xe0) === 0xa0) return string(t & 0x1f);
+            if ((t & 0xf0) === 0x90) return array(t & 0x0f);
+            if ((t & 0xf0) === 0x80) return map(t & 0x0f);
+            switch (t) {
+                case 0xc0: return null;
+                case 0xc2: return false;
+                case 0xc3: return true;
+                case 0xcc: return next(1, o => view.getUint8(o));
+                case 0xcd: return next(2, o => view.getUint16(o));
+                case 0xce: return next(4, o => view.getUint32(o));
+                case 0xcf: return next(8, o => Number(view.getBigUint64(o)));
+                case 0xd0: return next(1, o => view.getInt8(o));
+                case 0xd1: return next(2, o => view.getInt16(o));
+                case 0xd2: return next(4, o => view.getInt32(o));
+                case 0xd3: return next(8, o => Number(view.getBigInt64(o)));
+                case 0xca: return next(4, o => view.getFloat32(o));
+                case 0xcb: return next(8, o => view.getFloat64(o));
+                case 0xd9: return string(next(1, o => view.getUint8(o)));
+                case 0xda: return string(next(2, o => view.getUint16(o)));
+                case 0xdb: return string(next(4, o => view.getUint32(o)));
+                case 0xc4: case 0xc5: case 0xc6: {
+                    let n = next(1 << (t - 0xc4), o => t === 0xc4 ? view.getUint8(o) : t === 0xc5 ? view.getUint16(o) : view.getUint32(o));
+                    offset += n;
+                    return bytes.slice(offset - n, offset);
+                }
+                case 0xdc: return array(next(2, o => view.getUint16(o)));
+                case 0xdd: return array(next(4, o => view.getUint32(o)));
+                case 0xde: return map(next(2, o => view.getUint16(o)));
+                case 0xdf: return map(next(4, o => view.getUint32(o)));
+            }
+            throw new Error("unsupported msgpack format " + t);
+        };
+        return read();
+    },
+});
+
+// Returns the hex string of an extended json object id ({"$oid": ...}), or the id as is
+function objectKey(id) {
+    return id?.$oid ?? id;
+}
+
 function uuidv4() {
     return ([1e7] + -1e3 + -4e3 + -8e3 + -1e11).replace(/[018]/g, c =>
         (c ^ crypto.getRandomValues(new Uint8Array(1))[0] & 15 >> c / 4).toString(16)